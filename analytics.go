@@ -0,0 +1,249 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	analyticsBatchSize   = 500
+	analyticsQueueSize   = 10000
+	defaultFlushPeriod   = 30 * time.Second
+	analyticsHTTPTimeout = time.Minute
+)
+
+// accessRecord describes a single manifest or blob download.
+type accessRecord struct {
+	Time       time.Time `json:"time"`
+	Repository string    `json:"repository"`
+	Kind       string    `json:"kind"`
+	Reference  string    `json:"reference"`
+	Digest     string    `json:"digest"`
+	Client     string    `json:"client"`
+	Method     string    `json:"method"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	LatencyMs  int64     `json:"latency_ms"`
+}
+
+// analyticsSink stores a batch of access records.
+type analyticsSink interface {
+	export(records []accessRecord) error
+}
+
+// analyticsExporter batches access records and hands them to a sink in the
+// background, so exporting never slows down the requests themselves.
+type analyticsExporter struct {
+	sink   analyticsSink
+	period time.Duration
+	queue  chan accessRecord
+}
+
+// getAnalyticsExporter returns the exporter configured through the
+// ANALYTICS_* environment variables, or nil if analytics are disabled. The
+// sinks authenticate with the Google credentials of the upstream, see
+// gcpAPIAuth.
+func getAnalyticsExporter(auth authenticator) *analyticsExporter {
+	table, bucket := os.Getenv("ANALYTICS_BIGQUERY_TABLE"), os.Getenv("ANALYTICS_GCS_BUCKET")
+	if table == "" && bucket == "" {
+		return nil
+	}
+	auth = gcpAPIAuth(auth)
+	client := &http.Client{Timeout: analyticsHTTPTimeout}
+
+	var sink analyticsSink
+	if table != "" {
+		parts := strings.Split(table, ".")
+		if len(parts) != 3 {
+			log.Fatalf("ANALYTICS_BIGQUERY_TABLE must be in the form project.dataset.table, got %q", table)
+		}
+		sink = &bigQuerySink{client: client, auth: auth, project: parts[0], dataset: parts[1], table: parts[2]}
+		log.Printf("exporting access records to BigQuery table %s", table)
+	} else {
+		sink = &gcsSink{client: client, auth: auth, bucket: bucket, prefix: os.Getenv("ANALYTICS_GCS_PREFIX")}
+		log.Printf("exporting access records to gs://%s", bucket)
+	}
+
+	period := defaultFlushPeriod
+	if v := os.Getenv("ANALYTICS_FLUSH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid ANALYTICS_FLUSH_INTERVAL %q", v)
+		}
+		period = d
+	}
+	e := &analyticsExporter{sink: sink, period: period, queue: make(chan accessRecord, analyticsQueueSize)}
+	go e.run()
+	return e
+}
+
+func (e *analyticsExporter) add(r accessRecord) {
+	select {
+	case e.queue <- r:
+	default:
+		log.Printf("analytics queue is full, dropping access record for %s", r.Repository)
+	}
+}
+
+func (e *analyticsExporter) run() {
+	t := time.NewTicker(e.period)
+	defer t.Stop()
+	var batch []accessRecord
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.sink.export(batch); err != nil {
+			log.Printf("failed to export %d access records: %+v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case r := <-e.queue:
+			batch = append(batch, r)
+			if len(batch) >= analyticsBatchSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		}
+	}
+}
+
+// middleware records manifest and blob downloads.
+func (e *analyticsExporter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rr, ok := parseRegistryPath(req.URL.Path)
+		if !ok || (rr.kind != "manifests" && rr.kind != "blobs") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		start := time.Now()
+		cw := &countingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, req)
+		e.add(accessRecord{
+			Time:       start.UTC(),
+			Repository: rr.name,
+			Kind:       strings.TrimSuffix(rr.kind, "s"),
+			Reference:  rr.reference,
+			Client:     clientID(req),
+			Method:     req.Method,
+			Status:     cw.status,
+			Bytes:      cw.bytes,
+			LatencyMs:  int64(time.Since(start) / time.Millisecond),
+		})
+	})
+}
+
+// bigQuerySink streams records into a BigQuery table with insertAll. The
+// table must have a column for every field of accessRecord.
+type bigQuerySink struct {
+	client                  *http.Client
+	auth                    authenticator
+	project, dataset, table string
+}
+
+func (s *bigQuerySink) export(records []accessRecord) error {
+	type row struct {
+		JSON accessRecord `json:"json"`
+	}
+	body := struct {
+		Rows []row `json:"rows"`
+	}{}
+	for _, r := range records {
+		body.Rows = append(body.Rows, row{JSON: r})
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("https://bigquery.googleapis.com/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll",
+		url.PathEscape(s.project), url.PathEscape(s.dataset), url.PathEscape(s.table))
+	respBody, err := gcpRequest(s.client, s.auth, http.MethodPost, u, "application/json", b)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		InsertErrors []json.RawMessage `json:"insertErrors"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return fmt.Errorf("failed to parse insertAll response: %+v", err)
+	}
+	if len(result.InsertErrors) > 0 {
+		return fmt.Errorf("%d rows were rejected by BigQuery, first error: %s", len(result.InsertErrors), result.InsertErrors[0])
+	}
+	return nil
+}
+
+// gcsSink writes every batch of records as a newline-delimited JSON object
+// into a Cloud Storage bucket.
+type gcsSink struct {
+	client *http.Client
+	auth   authenticator
+	bucket string
+	prefix string
+}
+
+func (s *gcsSink) export(records []accessRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s%s/%d.json", s.prefix, now.Format("2006/01/02"), now.UnixNano())
+	u := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		url.PathEscape(s.bucket), url.QueryEscape(name))
+	_, err := gcpRequest(s.client, s.auth, http.MethodPost, u, "application/x-ndjson", buf.Bytes())
+	return err
+}
+
+// gcpRequest sends an authenticated request to a Google Cloud API and returns
+// the response body.
+func gcpRequest(client *http.Client, auth authenticator, method, u, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", auth.AuthHeader())
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %+v", u, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from %s: %+v", u, err)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("request to %s failed with status %d: %s", u, resp.StatusCode, b)
+	}
+	return b, nil
+}
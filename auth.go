@@ -0,0 +1,430 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metadataProbeTimeout = 2 * time.Second
+	googleTokenURL       = "https://oauth2.googleapis.com/token"
+)
+
+// detectAuth picks the credentials of the proxy when AUTH_MODE=auto: an
+// explicit AUTH_HEADER, the application default credentials file, the GCE
+// metadata server, or no credentials at all, in that order.
+func detectAuth() authenticator {
+	if basic := os.Getenv("AUTH_HEADER"); basic != "" {
+		log.Printf("auth: using AUTH_HEADER")
+		return staticAuthHeader(basic)
+	}
+	if path := adcFile(); path != "" {
+		log.Printf("auth: using application default credentials from %s", path)
+		return credentialsFileAuth(path)
+	}
+	if metadataServerAvailable() {
+		log.Printf("auth: using the service account of the metadata server")
+		return newRegistryMetadataAuth()
+	}
+	log.Printf("auth: no credentials found, proxying requests anonymously")
+	return nil
+}
+
+// adcFile returns the path of the application default credentials file, or
+// "" if there is none.
+func adcFile() string {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return path
+	}
+	dir := os.Getenv("CLOUDSDK_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config", "gcloud")
+	}
+	path := filepath.Join(dir, "application_default_credentials.json")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// metadataServerAvailable probes for a GCE metadata server.
+func metadataServerAvailable() bool {
+	req, err := http.NewRequest("GET", "http://metadata/computeMetadata/v1/", nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	resp, err := (&http.Client{Timeout: metadataProbeTimeout}).Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Metadata-Flavor") == "Google"
+}
+
+// credentialsFileAuth returns an authenticator for a Google credentials JSON
+// file. Service account keys are sent as basic auth, which GCR accepts, and
+// user credentials from "gcloud auth application-default login" are exchanged
+// for access tokens.
+func credentialsFileAuth(path string) authenticator {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("could not read key file from %s: %+v", path, err)
+	}
+	var creds struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKeyID string `json:"private_key_id"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(b, &creds); err != nil {
+		log.Fatalf("invalid credentials file %s: %+v", path, err)
+	}
+	switch creds.Type {
+	case "service_account":
+		auth := authHeader("Basic " + base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("_json_key:%s", string(b)))))
+		return serviceAccountKeyAuth(auth, creds.ClientEmail, creds.PrivateKeyID)
+	case "authorized_user":
+		return &refreshTokenAuth{
+			clientID:     creds.ClientID,
+			clientSecret: creds.ClientSecret,
+			refreshToken: creds.RefreshToken,
+		}
+	default:
+		log.Fatalf("unsupported credentials type %q in %s", creds.Type, path)
+		return nil
+	}
+}
+
+// refreshTokenAuth authenticates with OAuth2 access tokens obtained with a
+// user's refresh token.
+type refreshTokenAuth struct {
+	clientID     string
+	clientSecret string
+	refreshToken string
+
+	mu      sync.Mutex
+	header  string
+	expires time.Time
+	health  credentialHealth
+}
+
+func (r *refreshTokenAuth) AuthHeader() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Now().Before(r.expires) {
+		return r.header
+	}
+	tok, err := r.refresh()
+	if err != nil {
+		log.Printf("could not refresh access token: %+v", err)
+		r.health.failed(err)
+		// Requests keep trying to refresh, but not before the retry
+		// interval.
+		r.expires = time.Now().Add(credentialRetryInterval)
+		return r.header
+	}
+	r.header = "Bearer " + tok.AccessToken
+	r.expires = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - 5*time.Minute)
+	r.health.refreshed(time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second))
+	return r.header
+}
+
+func (r *refreshTokenAuth) expiry() time.Time { return r.health.expiry() }
+
+func (r *refreshTokenAuth) refresh() (token, error) {
+	return postTokenForm(googleTokenURL, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {r.clientID},
+		"client_secret": {r.clientSecret},
+		"refresh_token": {r.refreshToken},
+	})
+}
+
+// postTokenForm requests an OAuth2 access token from a Google token endpoint.
+func postTokenForm(u string, form url.Values) (token, error) {
+	var tok token
+	resp, err := (&http.Client{Timeout: upstreamTimeout}).PostForm(u, form)
+	if err != nil {
+		return tok, fmt.Errorf("token request failed: %+v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, defaultMaxTokenResponseSize))
+	if err != nil {
+		return tok, fmt.Errorf("failed to read token response: %+v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return tok, fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	if err := json.Unmarshal(b, &tok); err != nil {
+		return tok, fmt.Errorf("invalid token response: %+v", err)
+	}
+	return tok, nil
+}
+
+// gcpAPIAuth returns an authenticator for Google Cloud APIs that uses the
+// configured upstream credentials: auth itself if it sends access tokens, or
+// access tokens obtained with its service account key. The metadata server is
+// only used if auth has no Google credentials.
+func gcpAPIAuth(auth authenticator) authenticator {
+	switch a := auth.(type) {
+	case *metadataServerAuth:
+		if a.audience == "" {
+			return a
+		}
+	case *refreshTokenAuth, *impersonatedAuth:
+		return a
+	}
+	if auth != nil {
+		header := auth.AuthHeader()
+		if strings.HasPrefix(header, "Bearer ") {
+			return auth
+		}
+		req := &http.Request{Header: http.Header{"Authorization": {header}}}
+		if user, pass, ok := req.BasicAuth(); ok {
+			switch user {
+			case "_json_key":
+				sa, err := newServiceAccountTokenAuth([]byte(pass))
+				if err != nil {
+					log.Fatalf("could not use the service account key for Google Cloud APIs: %+v", err)
+				}
+				return sa
+			case "oauth2accesstoken":
+				return authHeader("Bearer " + pass)
+			}
+		}
+	}
+	if !metadataServerAvailable() {
+		log.Fatalf("Google Cloud APIs need Google credentials: set GOOGLE_APPLICATION_CREDENTIALS or GCP_KEY, or run on Google Cloud")
+	}
+	m := &metadataServerAuth{}
+	m.Init()
+	return m
+}
+
+// serviceAccountTokenAuth authenticates with OAuth2 access tokens obtained
+// with a service account key, for the Google Cloud APIs that don't accept
+// the key as basic auth like GCR does.
+type serviceAccountTokenAuth struct {
+	email    string
+	keyID    string
+	tokenURI string
+	key      *rsa.PrivateKey
+
+	mu      sync.Mutex
+	header  string
+	expires time.Time
+	health  credentialHealth
+}
+
+// newServiceAccountTokenAuth parses a service account key file.
+func newServiceAccountTokenAuth(keyFile []byte) (*serviceAccountTokenAuth, error) {
+	var creds struct {
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		PrivateKeyID string `json:"private_key_id"`
+		TokenURI     string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(keyFile, &creds); err != nil {
+		return nil, fmt.Errorf("invalid service account key: %+v", err)
+	}
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("service account key of %s has no PEM private key", creds.ClientEmail)
+	}
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rk, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("service account key of %s is not an RSA key", creds.ClientEmail)
+		}
+		key = rk
+	} else if rk, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = rk
+	} else {
+		return nil, fmt.Errorf("invalid private key of %s: %+v", creds.ClientEmail, err)
+	}
+	sa := &serviceAccountTokenAuth{email: creds.ClientEmail, keyID: creds.PrivateKeyID, tokenURI: creds.TokenURI, key: key}
+	if sa.tokenURI == "" {
+		sa.tokenURI = googleTokenURL
+	}
+	return sa, nil
+}
+
+func (sa *serviceAccountTokenAuth) AuthHeader() string {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	if time.Now().Before(sa.expires) {
+		return sa.header
+	}
+	tok, err := sa.refresh()
+	if err != nil {
+		log.Printf("could not get access token for %s: %+v", sa.email, err)
+		sa.health.failed(err)
+		// Requests keep trying to refresh, but not before the retry
+		// interval.
+		sa.expires = time.Now().Add(credentialRetryInterval)
+		return sa.header
+	}
+	sa.header = "Bearer " + tok.AccessToken
+	sa.expires = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - 5*time.Minute)
+	sa.health.refreshed(time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second))
+	return sa.header
+}
+
+func (sa *serviceAccountTokenAuth) expiry() time.Time { return sa.health.expiry() }
+
+// refresh exchanges a JWT signed with the key for an access token.
+func (sa *serviceAccountTokenAuth) refresh() (token, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": sa.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   sa.email,
+		"scope": "https://www.googleapis.com/auth/cloud-platform",
+		"aud":   sa.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	payload := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, sa.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return token{}, fmt.Errorf("failed to sign token request: %+v", err)
+	}
+	return postTokenForm(sa.tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {payload + "." + base64.RawURLEncoding.EncodeToString(sig)},
+	})
+}
+
+// impersonatedAuth authenticates as another service account with short-lived
+// access tokens issued by the IAM Credentials API to the base identity, which
+// needs the Service Account Token Creator role on that account.
+type impersonatedAuth struct {
+	account string
+	base    authenticator
+	client  *http.Client
+
+	mu      sync.Mutex
+	header  string
+	expires time.Time
+	health  credentialHealth
+	// flights makes concurrent requests wait for one refresh.
+	flights flightGroup
+}
+
+// getImpersonatedAuth wraps auth to impersonate IMPERSONATE_SERVICE_ACCOUNT,
+// or returns auth if it is not set. The configured credentials are the base
+// identity, see gcpAPIAuth.
+func getImpersonatedAuth(auth authenticator) authenticator {
+	account := os.Getenv("IMPERSONATE_SERVICE_ACCOUNT")
+	if account == "" {
+		return auth
+	}
+	ia := &impersonatedAuth{
+		account: account,
+		base:    gcpAPIAuth(auth),
+		client:  &http.Client{Timeout: upstreamTimeout},
+	}
+	if err := ia.refresh(); err != nil {
+		log.Fatalf("could not impersonate service account %s: %+v", account, err)
+	}
+	log.Printf("auth: impersonating service account %s", account)
+	return ia
+}
+
+func (ia *impersonatedAuth) AuthHeader() string {
+	ia.mu.Lock()
+	expired := time.Now().After(ia.expires)
+	ia.mu.Unlock()
+	if expired {
+		ia.flights.do("", func() (interface{}, error) {
+			ia.mu.Lock()
+			expired := time.Now().After(ia.expires)
+			ia.mu.Unlock()
+			if !expired {
+				// Another request refreshed the token meanwhile.
+				return nil, nil
+			}
+			if err := ia.refresh(); err != nil {
+				log.Printf("could not refresh token of service account %s: %+v", ia.account, err)
+				ia.health.failed(err)
+				// Requests keep trying to refresh, but not before the retry
+				// interval.
+				ia.mu.Lock()
+				ia.expires = time.Now().Add(credentialRetryInterval)
+				ia.mu.Unlock()
+			}
+			return nil, nil
+		})
+	}
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+	return ia.header
+}
+
+func (ia *impersonatedAuth) refresh() error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"scope":    []string{"https://www.googleapis.com/auth/cloud-platform"},
+		"lifetime": "3600s",
+	})
+	u := fmt.Sprintf("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken",
+		url.PathEscape(ia.account))
+	b, err := gcpRequest(ia.client, ia.base, http.MethodPost, u, "application/json", body)
+	if err != nil {
+		return err
+	}
+	var out struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return fmt.Errorf("invalid generateAccessToken response: %+v", err)
+	}
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+	ia.header = "Bearer " + out.AccessToken
+	ia.expires = out.ExpireTime.Add(-5 * time.Minute)
+	ia.health.refreshed(out.ExpireTime)
+	return nil
+}
+
+func (ia *impersonatedAuth) expiry() time.Time { return ia.health.expiry() }
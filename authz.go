@@ -0,0 +1,256 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// authzRule grants users and groups authenticated by the proxy actions on
+// repositories.
+type authzRule struct {
+	// Users lists usernames, or "*" for every authenticated user.
+	Users []string `json:"users"`
+	// Groups lists groups of the client auth file.
+	Groups []string `json:"groups"`
+	// Repositories lists client-visible repository names, or patterns like
+	// "team-a/*" in path.Match syntax.
+	Repositories []string `json:"repositories"`
+	// Actions lists "pull", "push", "delete", or "admin", which grants all
+	// of them and listing the catalog.
+	Actions []string `json:"actions"`
+}
+
+// authzPolicy decides which actions authenticated clients may perform. A
+// request is allowed if any rule grants it.
+type authzPolicy struct {
+	// live holds the rules, which change when the config file is reloaded.
+	live *liveConfig
+}
+
+// getAuthzPolicy returns the authorization policy of the config file, or nil
+// if there is none, which allows every authenticated client everything. The
+// rules are published to live.
+func getAuthzPolicy(rules []authzRule, clientAuth bool, live *liveConfig) *authzPolicy {
+	if len(rules) == 0 {
+		return nil
+	}
+	if !clientAuth {
+		log.Fatal("the authorization policy requires client authentication, set CLIENT_AUTH_FILE")
+	}
+	if err := checkAuthzRules(rules); err != nil {
+		log.Fatalf("invalid authorization policy: %+v", err)
+	}
+	live.update(func(s *configSnapshot) { s.authz = rules })
+	log.Printf("authorizing clients with %d rules", len(rules))
+	return &authzPolicy{live: live}
+}
+
+func checkAuthzRules(rules []authzRule) error {
+	for i, r := range rules {
+		if len(r.Users) == 0 && len(r.Groups) == 0 {
+			return fmt.Errorf("rule %d: no users or groups", i+1)
+		}
+		if len(r.Repositories) == 0 {
+			return fmt.Errorf("rule %d: no repositories", i+1)
+		}
+		for _, repo := range r.Repositories {
+			if _, err := path.Match(repo, ""); err != nil {
+				return fmt.Errorf("rule %d: invalid repository pattern %q", i+1, repo)
+			}
+		}
+		for _, a := range r.Actions {
+			switch a {
+			case "pull", "push", "delete", "admin":
+			default:
+				return fmt.Errorf("rule %d: unknown action %q, expected pull, push, delete or admin", i+1, a)
+			}
+		}
+	}
+	return nil
+}
+
+func (r authzRule) appliesTo(id *clientIdentity) bool {
+	for _, u := range r.Users {
+		if u == "*" || u == id.username {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		for _, idg := range id.groups {
+			if g == idg {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r authzRule) grants(name, action string) bool {
+	matched := false
+	for _, repo := range r.Repositories {
+		if ok, _ := path.Match(repo, name); ok {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+	for _, a := range r.Actions {
+		if a == action || a == "admin" {
+			return true
+		}
+	}
+	return false
+}
+
+// reloader returns the configReloader for the authorization section of the
+// config file. Removing all rules would allow every client everything, so it
+// requires a restart.
+func (p *authzPolicy) reloader() configReloader {
+	return func(fc fileConfig) (func(*configSnapshot), error) {
+		if len(fc.Authorization) == 0 {
+			return nil, fmt.Errorf("authorization: removing all rules requires a restart")
+		}
+		if err := checkAuthzRules(fc.Authorization); err != nil {
+			return nil, fmt.Errorf("authorization: %v", err)
+		}
+		return func(s *configSnapshot) { s.authz = fc.Authorization }, nil
+	}
+}
+
+// authzAllowed reports whether rules allow id the action on the repository.
+func authzAllowed(rules []authzRule, id *clientIdentity, name, action string) bool {
+	for _, r := range rules {
+		if r.appliesTo(id) && r.grants(name, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// grant returns the repository scopes of a token request, like
+// "repository:team-a/app:pull,push", reduced to the actions the policy allows
+// id. Scopes without any allowed action are left out, as a token service
+// would. All scopes are decided by the rules of the snapshot of ctx.
+func (p *authzPolicy) grant(ctx context.Context, id *clientIdentity, scopes []string) []string {
+	rules := p.live.get(ctx).authz
+	var granted []string
+	for _, s := range scopes {
+		for _, scope := range strings.Fields(s) {
+			fields := strings.Split(scope, ":")
+			if len(fields) < 3 || fields[0] != "repository" {
+				continue
+			}
+			name := strings.Join(fields[1:len(fields)-1], ":")
+			var actions []string
+			for _, a := range strings.Split(fields[len(fields)-1], ",") {
+				check := a
+				if a == "*" {
+					check = "admin"
+				}
+				if authzAllowed(rules, id, name, check) {
+					actions = append(actions, a)
+				}
+			}
+			if len(actions) > 0 {
+				granted = append(granted, "repository:"+name+":"+strings.Join(actions, ","))
+			}
+		}
+	}
+	return granted
+}
+
+// requestAction returns the action a registry API request performs.
+func requestAction(req *http.Request) string {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return "pull"
+	case http.MethodDelete:
+		return "delete"
+	default:
+		return "push"
+	}
+}
+
+// middleware rejects registry API requests the policy, or the scopes of the
+// client's token, don't allow. It must run after client authentication.
+func (p *authzPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := identityFromContext(req.Context())
+		if id == nil {
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+			return
+		}
+		rules := p.live.get(req.Context()).authz
+		if req.URL.Path == "/v2/_catalog" && !authzAllowed(rules, id, "*", "admin") {
+			writeRegistryError(w, http.StatusForbidden, "DENIED", "listing repositories requires the admin action")
+			return
+		}
+		if rr, ok := parseRegistryPath(req.URL.Path); ok {
+			action := requestAction(req)
+			if !authzAllowed(rules, id, rr.name, action) {
+				writeRegistryError(w, http.StatusForbidden, "DENIED",
+					fmt.Sprintf("%s is not allowed to %s %s", id.username, action, rr.name))
+				return
+			}
+			if !id.tokenAllows(rr.name, action) {
+				// Ask the client for a token with the needed scope.
+				w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/_token",service="%s",scope="repository:%s:%s",error="insufficient_scope"`,
+					req.Host, req.Host, rr.name, action))
+				writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "the token does not grant access to "+rr.name)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// imageAccess applies the authorization policy and the external policy to
+// the endpoints that read images outside the registry API, like /inspect/.
+// Either may be nil.
+type imageAccess struct {
+	authz  *authzPolicy
+	policy *externalPolicy
+}
+
+// allowPull reports whether the client of req may pull the image
+// name:reference, and writes an error response to w if it may not.
+func (a imageAccess) allowPull(w http.ResponseWriter, req *http.Request, name, reference string) bool {
+	if a.authz != nil {
+		id := identityFromContext(req.Context())
+		if id == nil {
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+			return false
+		}
+		if !authzAllowed(a.authz.live.get(req.Context()).authz, id, name, "pull") || !id.tokenAllows(name, "pull") {
+			writeRegistryError(w, http.StatusForbidden, "DENIED", fmt.Sprintf("%s is not allowed to pull %s", id.username, name))
+			return false
+		}
+	}
+	if a.policy != nil {
+		in := newPolicyInput(req)
+		in.Action, in.Repository, in.Kind, in.Reference = "pull", name, "manifests", reference
+		return a.policy.allow(w, req, in)
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImageAccessAllowPull(t *testing.T) {
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input policyInput `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		allow := body.Input.Action == "pull" && body.Input.Repository != "team-a/secret"
+		json.NewEncoder(w).Encode(map[string]bool{"result": allow})
+	}))
+	defer policy.Close()
+
+	live := newLiveConfig()
+	live.update(func(s *configSnapshot) {
+		s.authz = []authzRule{{Users: []string{"alice"}, Repositories: []string{"team-a/*"}, Actions: []string{"pull"}}}
+	})
+	access := imageAccess{
+		authz:  &authzPolicy{live: live},
+		policy: &externalPolicy{url: policy.URL, client: policy.Client()},
+	}
+
+	tests := []struct {
+		user   string
+		name   string
+		status int
+	}{
+		{user: "alice", name: "team-a/app", status: http.StatusOK},
+		{user: "alice", name: "team-b/app", status: http.StatusForbidden},
+		{user: "alice", name: "team-a/secret", status: http.StatusForbidden},
+		{user: "bob", name: "team-a/app", status: http.StatusForbidden},
+		{name: "team-a/app", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/inspect/"+tt.name+":latest", nil)
+		if tt.user != "" {
+			req = req.WithContext(context.WithValue(req.Context(), ctxKeyClientIdentity, &clientIdentity{username: tt.user}))
+		}
+		w := httptest.NewRecorder()
+		if access.allowPull(w, req, tt.name, "latest") {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.Code != tt.status {
+			t.Errorf("%s pulling %s: got status %d, want %d", tt.user, tt.name, w.Code, tt.status)
+		}
+	}
+}
+
+// deniedImageRequests sends requests for team-b/app, which alice may not
+// pull, to h and checks that they are denied without asking the upstream.
+func deniedImageRequests(t *testing.T, h func(up *upstreamClient, access imageAccess) http.Handler, method, path, body string) {
+	live := newLiveConfig()
+	live.update(func(s *configSnapshot) {
+		s.authz = []authzRule{{Users: []string{"alice"}, Repositories: []string{"team-a/*"}, Actions: []string{"pull"}}}
+	})
+	up := newUpstreamClient(registryConfig{host: "registry.example.com", transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected upstream request %s", req.URL)
+		return nil, context.Canceled
+	})}, nil)
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), ctxKeyClientIdentity, &clientIdentity{username: "alice"}))
+	w := httptest.NewRecorder()
+	h(up, imageAccess{authz: &authzPolicy{live: live}}).ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("%s %s: got status %d, want %d", method, path, w.Code, http.StatusForbidden)
+	}
+}
+
+func TestResolveAppliesAuthz(t *testing.T) {
+	deniedImageRequests(t, func(up *upstreamClient, access imageAccess) http.Handler {
+		return resolveHandler(up, access)
+	}, http.MethodGet, "/resolve/team-b/app:latest", "")
+}
+
+func TestValidateAppliesAuthz(t *testing.T) {
+	deniedImageRequests(t, func(up *upstreamClient, access imageAccess) http.Handler {
+		return validateHandler(up, access)
+	}, http.MethodPost, "/validate", `{"image": "team-b/app:latest"}`)
+}
+
+func TestValidateAppliesRepoRules(t *testing.T) {
+	rules, err := parseRepoRules("internal/*=!403", "registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := newUpstreamClient(registryConfig{host: "registry.example.com", rules: rules, transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected upstream request %s", req.URL)
+		return nil, context.Canceled
+	})}, nil)
+	req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(`{"image": "internal/app:1.0"}`))
+	w := httptest.NewRecorder()
+	validateHandler(up, imageAccess{}).ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,497 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errCacheMiss = errors.New("object not found in cache")
+
+	cacheRequestsTotal = newCounterVec("registry_proxy_cache_requests_total",
+		"Requests answered from the cache (hit or stale) or the upstream (miss, unauthorized or unlinked).", "result")
+)
+
+// cacheObject is an object read from a blobStore.
+type cacheObject struct {
+	body        io.ReadCloser
+	size        int64
+	contentType string
+}
+
+// blobStore is a storage backend for the cache, like a Cloud Storage or S3
+// bucket.
+type blobStore interface {
+	// get returns the object stored under key, or errCacheMiss.
+	get(ctx context.Context, key string) (*cacheObject, error)
+	// put stores size bytes read from r under key. The object must not be
+	// created if reading from r fails.
+	put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// stat returns the size of the object stored under key, or errCacheMiss.
+	stat(ctx context.Context, key string) (int64, error)
+}
+
+// rangeReader is implemented by blobStores that can read part of an object.
+type rangeReader interface {
+	// getRange returns length bytes of the object stored under key from
+	// offset, or errCacheMiss.
+	getRange(ctx context.Context, key string, offset, length int64) (*cacheObject, error)
+}
+
+// setByteRange makes req ask for length bytes from offset, or for the whole
+// object if length is negative, and returns the status of a successful
+// response.
+func setByteRange(req *http.Request, offset, length int64) int {
+	if length < 0 {
+		return http.StatusOK
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	return http.StatusPartialContent
+}
+
+// urlSigner is implemented by blobStores that can hand out URLs granting
+// temporary read access to an object.
+type urlSigner interface {
+	signedURL(key string, ttl time.Duration) (string, error)
+}
+
+// blobCache keeps copies of the blobs served by the proxy in a blobStore,
+// keyed by their digest, and serves later requests for them from there
+// without contacting the upstream.
+type blobCache struct {
+	store  blobStore
+	prefix string
+	// redirectTTL is the lifetime of the signed URLs clients are redirected
+	// to on cache hits. Cached blobs are streamed through the proxy if 0.
+	redirectTTL time.Duration
+	// serveStale enables keeping manifests in the cache, which are served
+	// when the upstream registry is unavailable.
+	serveStale bool
+	// authorize, if set, decides whether the client of a request may read
+	// the requested blob before it is served from the cache.
+	authorize func(req *http.Request) bool
+	// refs records the repositories using cached blobs. Blobs are only served
+	// to the repositories that use them.
+	refs *cacheRefs
+}
+
+// getBlobCache returns the cache configured by CACHE_URL, which is either
+// gs://bucket/prefix or s3://bucket/prefix, or nil if caching is disabled.
+func getBlobCache(auth authenticator) *blobCache {
+	v := os.Getenv("CACHE_URL")
+	if v == "" {
+		if os.Getenv("SERVE_STALE") != "" {
+			log.Fatal("SERVE_STALE requires a cache, set CACHE_URL")
+		}
+		return nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.Host == "" {
+		log.Fatalf("invalid CACHE_URL %q, expected gs://bucket/prefix or s3://bucket/prefix", v)
+	}
+	c := &blobCache{prefix: strings.Trim(u.Path, "/")}
+	if c.prefix != "" {
+		c.prefix += "/"
+	}
+	switch u.Scheme {
+	case "gs":
+		c.store = newGCSStore(u.Host, gcpAPIAuth(auth))
+	case "s3":
+		c.store = getS3Store(u.Host)
+	default:
+		log.Fatalf("unsupported CACHE_URL scheme %q, expected gs or s3", u.Scheme)
+	}
+	if ttl := os.Getenv("CACHE_REDIRECT_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid CACHE_REDIRECT_TTL %q", ttl)
+		}
+		if _, ok := c.store.(urlSigner); !ok {
+			log.Fatalf("CACHE_REDIRECT_TTL is not supported by the %s cache backend", u.Scheme)
+		}
+		c.redirectTTL = d
+	}
+	c.serveStale = os.Getenv("SERVE_STALE") != ""
+	c.refs = &cacheRefs{cache: c, refresh: defaultRefRefresh, touched: make(map[string]time.Time)}
+	log.Printf("caching blobs in %s", v)
+	return c
+}
+
+// blobKey returns the key for the blob requested by req, or "" if req is not
+// a blob download. Blobs are keyed by digest only, so content pulled through
+// different repository names is stored once.
+func (c *blobCache) blobKey(req *http.Request) string {
+	if req.Method != http.MethodGet {
+		return ""
+	}
+	m := blobPath.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		return ""
+	}
+	return c.digestKey(m[2])
+}
+
+// digestKey returns the key of the blob with the given digest.
+func (c *blobCache) digestKey(digest string) string {
+	return c.prefix + "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+// manifestKey returns the key for the manifest requested by req, or "" if req
+// is not a manifest download. Manifests are keyed by upstream repository and
+// the tag or digest they were requested by.
+func (c *blobCache) manifestKey(req *http.Request) string {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return ""
+	}
+	rr, ok := parseRegistryPath(req.URL.Path)
+	if !ok || rr.kind != "manifests" {
+		return ""
+	}
+	return c.prefix + "manifests/" + rr.name + "/" + rr.reference
+}
+
+// serve returns a response for req from the cache, or nil on a cache miss.
+func (c *blobCache) serve(req *http.Request) *http.Response {
+	key := c.blobKey(req)
+	if key == "" {
+		return nil
+	}
+	if c.authorize != nil && !c.authorize(req) {
+		// The upstream answers the request with its own error.
+		cacheRequestsTotal.inc("unauthorized")
+		return nil
+	}
+	if !c.refs.linked(req) {
+		// The blob is stored once for all repositories, so it is only served
+		// to those the upstream gave it to, not to any repository the client
+		// can pull from.
+		cacheRequestsTotal.inc("unlinked")
+		return nil
+	}
+	if c.redirectTTL > 0 {
+		// Clients send their Range header to the signed URL as well.
+		return c.redirect(req, key)
+	}
+	if spec := req.Header.Get("Range"); spec != "" {
+		return c.serveRange(req, key, spec)
+	}
+	obj, err := c.store.get(req.Context(), key)
+	if err != nil {
+		if err != errCacheMiss {
+			log.Printf("cache lookup for %s failed: %+v", key, err)
+		}
+		cacheRequestsTotal.inc("miss")
+		return nil
+	}
+	cacheRequestsTotal.inc("hit")
+	c.refs.touch(req)
+	log.Printf("serving blob from cache: url=%s", req.URL)
+	h := http.Header{}
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Docker-Content-Digest", blobPath.FindStringSubmatch(req.URL.Path)[2])
+	h.Set("X-Cache", "HIT")
+	return newResponse(req, http.StatusOK, h, obj.body, obj.size)
+}
+
+// serveRange answers a Range request for a cached blob, like a client
+// resuming a download, which may reach another instance than the one that
+// started it. Requests for ranges the cache can't answer go to the upstream.
+func (c *blobCache) serveRange(req *http.Request, key, spec string) *http.Response {
+	rr, ok := c.store.(rangeReader)
+	if !ok {
+		return nil
+	}
+	digest := blobPath.FindStringSubmatch(req.URL.Path)[2]
+	// Blobs never change, but a validator of the upstream other than the
+	// digest can't be checked here.
+	if v := req.Header.Get("If-Range"); v != "" && strings.Trim(v, `"`) != digest {
+		return nil
+	}
+	size, err := c.store.stat(req.Context(), key)
+	if err != nil {
+		if err != errCacheMiss {
+			log.Printf("cache lookup for %s failed: %+v", key, err)
+		}
+		cacheRequestsTotal.inc("miss")
+		return nil
+	}
+	start, end, ok := parseByteRange(spec, size)
+	if !ok {
+		return nil
+	}
+	obj, err := rr.getRange(req.Context(), key, start, end-start+1)
+	if err != nil {
+		if err != errCacheMiss {
+			log.Printf("cache lookup for %s failed: %+v", key, err)
+		}
+		cacheRequestsTotal.inc("miss")
+		return nil
+	}
+	cacheRequestsTotal.inc("hit")
+	c.refs.touch(req)
+	log.Printf("serving blob range from cache: url=%s range=%s", req.URL, spec)
+	h := http.Header{}
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	h.Set("Docker-Content-Digest", digest)
+	h.Set("X-Cache", "HIT")
+	return newResponse(req, http.StatusPartialContent, h, obj.body, end-start+1)
+}
+
+// parseByteRange returns the first and last byte of a single range like
+// "bytes=100-", "bytes=100-199" or "bytes=-100" of an object of size bytes.
+// ok is false for other ranges and ranges starting beyond the object.
+func parseByteRange(spec string, size int64) (start, end int64, ok bool) {
+	if !strings.HasPrefix(spec, "bytes=") || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	spec = strings.TrimSpace(strings.TrimPrefix(spec, "bytes="))
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, 0, false
+	}
+	first, last := spec[:i], spec[i+1:]
+	end = size - 1
+	var err error
+	switch {
+	case first == "":
+		var n int64
+		if n, err = strconv.ParseInt(last, 10, 64); err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if start = size - n; start < 0 {
+			start = 0
+		}
+	default:
+		if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+			return 0, 0, false
+		}
+		if last != "" {
+			var n int64
+			if n, err = strconv.ParseInt(last, 10, 64); err != nil || n < start {
+				return 0, 0, false
+			}
+			if n < end {
+				end = n
+			}
+		}
+	}
+	return start, end, start < size
+}
+
+// upstreamAuthorizer returns a function that asks the upstream whether the
+// credentials of a client allow it to read the blob it requests, for
+// AUTH_PASSTHROUGH where the upstream decides about access.
+func upstreamAuthorizer(cfg registryConfig) func(*http.Request) bool {
+	client := &http.Client{
+		Transport: cfg.transport,
+		Timeout:   upstreamTimeout,
+		// Registries redirect blob requests to their storage, which already
+		// shows access is granted.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return func(req *http.Request) bool {
+		head, err := http.NewRequest(http.MethodHead, req.URL.String(), nil)
+		if err != nil {
+			return false
+		}
+		if v := req.Header.Get("Authorization"); v != "" {
+			head.Header.Set("Authorization", v)
+		}
+		resp, err := client.Do(head.WithContext(req.Context()))
+		if err != nil {
+			log.Printf("could not check access to %s: %+v", req.URL, err)
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode < http.StatusBadRequest
+	}
+}
+
+// redirect answers req with a redirect to a signed URL of the cached blob, so
+// the content is downloaded from the storage service directly rather than
+// through the proxy. Only clients that were allowed to pull the blob from the
+// proxy get a URL, and it expires after redirectTTL.
+func (c *blobCache) redirect(req *http.Request, key string) *http.Response {
+	if _, err := c.store.stat(req.Context(), key); err != nil {
+		if err != errCacheMiss {
+			log.Printf("cache lookup for %s failed: %+v", key, err)
+		}
+		cacheRequestsTotal.inc("miss")
+		return nil
+	}
+	u, err := c.store.(urlSigner).signedURL(key, c.redirectTTL)
+	if err != nil {
+		log.Printf("failed to sign url for %s, serving it from upstream: %+v", key, err)
+		cacheRequestsTotal.inc("miss")
+		return nil
+	}
+	cacheRequestsTotal.inc("hit")
+	c.refs.touch(req)
+	log.Printf("redirecting to cached blob: url=%s", req.URL)
+	h := http.Header{}
+	h.Set("Location", u)
+	h.Set("Docker-Content-Digest", blobPath.FindStringSubmatch(req.URL.Path)[2])
+	h.Set("X-Cache", "HIT")
+	return newResponse(req, http.StatusTemporaryRedirect, h, http.NoBody, 0)
+}
+
+// serveStaleManifest returns a response for req from the last copy of the
+// manifest stored in the cache, or nil if there is none. It is used when the
+// upstream registry can't be reached, so the copy may be outdated, which is
+// signalled to the client with a Warning header.
+func (c *blobCache) serveStaleManifest(req *http.Request) *http.Response {
+	if c == nil || !c.serveStale {
+		return nil
+	}
+	key := c.manifestKey(req)
+	if key == "" {
+		return nil
+	}
+	obj, err := c.store.get(req.Context(), key)
+	if err != nil {
+		if err != errCacheMiss {
+			log.Printf("cache lookup for %s failed: %+v", key, err)
+		}
+		return nil
+	}
+	defer obj.body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(obj.body, defaultMaxManifestSize+1))
+	if err != nil || len(b) > defaultMaxManifestSize {
+		log.Printf("failed to read %s from cache: %+v", key, err)
+		return nil
+	}
+	cacheRequestsTotal.inc("stale")
+	log.Printf("upstream unavailable, serving stale manifest from cache: url=%s", req.URL)
+	h := http.Header{}
+	h.Set("Content-Type", obj.contentType)
+	h.Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(b)))
+	h.Set("Warning", `110 gcr-proxy "Response is Stale"`)
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Cache", "STALE")
+	var body io.ReadCloser = ioutil.NopCloser(bytes.NewReader(b))
+	if req.Method == http.MethodHead {
+		body = http.NoBody
+	}
+	return newResponse(req, http.StatusOK, h, body, int64(len(b)))
+}
+
+// fill copies the body of a successful blob download from upstream into the
+// cache while it streams to the client. The copy is only committed if the
+// client receives the whole blob, so resp must already verify the digest.
+// Manifests are stored as well if stale manifests are served.
+func (c *blobCache) fill(resp *http.Response) *http.Response {
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		// The upstream served the blob in this repository.
+		c.refs.touch(resp.Request)
+	}
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 || resp.Request.Header.Get("Range") != "" {
+		return resp
+	}
+	key, contentType := c.blobKey(resp.Request), "application/octet-stream"
+	if key == "" && c.serveStale && resp.Request.Method == http.MethodGet {
+		key, contentType = c.manifestKey(resp.Request), resp.Header.Get("Content-Type")
+	}
+	if key == "" {
+		return resp
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		err := c.store.put(context.Background(), key, pr, resp.ContentLength, contentType)
+		if err != nil {
+			log.Printf("failed to store %s in cache: %+v", key, err)
+			pr.CloseWithError(err)
+			return
+		}
+		log.Printf("stored %s in cache (%d bytes)", key, resp.ContentLength)
+		pr.Close()
+	}()
+	resp.Body = &cacheTee{ReadCloser: resp.Body, w: pw}
+	return resp
+}
+
+// cacheTee writes everything read from the body into w. It fails w unless
+// the body was read to the end without errors.
+type cacheTee struct {
+	io.ReadCloser
+	w *io.PipeWriter
+}
+
+func (t *cacheTee) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 && t.w != nil {
+		if _, werr := t.w.Write(p[:n]); werr != nil {
+			// The upload failed, keep serving the client without it.
+			t.w = nil
+		}
+	}
+	if err == io.EOF {
+		t.finish(nil)
+	} else if err != nil {
+		t.finish(err)
+	}
+	return n, err
+}
+
+func (t *cacheTee) Close() error {
+	t.finish(errors.New("blob was not read completely"))
+	return t.ReadCloser.Close()
+}
+
+func (t *cacheTee) finish(err error) {
+	if t.w == nil {
+		return
+	}
+	if err == nil {
+		t.w.Close()
+	} else {
+		t.w.CloseWithError(err)
+	}
+	t.w = nil
+}
+
+// placeholderToken is the token response sent to clients while the upstream
+// token service is unavailable and stale content is served.
+var placeholderToken = []byte(`{"token":"stale","access_token":"stale","expires_in":60}` + "\n")
+
+func placeholderTokenResponse(req *http.Request) *http.Response {
+	h := http.Header{}
+	h.Set("Content-Type", "application/json")
+	h.Set("Cache-Control", "no-store")
+	h.Set("Warning", `110 gcr-proxy "Response is Stale"`)
+	return newResponse(req, http.StatusOK, h, ioutil.NopCloser(bytes.NewReader(placeholderToken)), int64(len(placeholderToken)))
+}
+
+func writePlaceholderToken(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Warning", `110 gcr-proxy "Response is Stale"`)
+	w.Write(placeholderToken)
+}
@@ -0,0 +1,308 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTouchedRefs bounds the references remembered as recently recorded.
+const maxTouchedRefs = 100000
+
+// defaultRefRefresh is how long recorded references are not rewritten if
+// garbage collection, which expires them, is disabled.
+const defaultRefRefresh = 24 * time.Hour
+
+var cacheGCDeletedTotal = newCounterVec("registry_proxy_cache_gc_deleted_total",
+	"Objects deleted by cache garbage collection, by kind (blob or ref).", "kind")
+
+// objectInfo describes an object listed from a blobStore.
+type objectInfo struct {
+	key     string
+	size    int64
+	updated time.Time
+}
+
+// objectLister is implemented by blobStores that can list and delete
+// objects, which garbage collection of the cache needs.
+type objectLister interface {
+	// list returns all objects with keys starting with prefix.
+	list(ctx context.Context, prefix string) ([]objectInfo, error)
+	// delete removes the object stored under key. Deleting a missing object
+	// is not an error.
+	delete(ctx context.Context, key string) error
+}
+
+// cacheRefs records which repositories use the blobs of the cache. Blobs are
+// stored once per digest however many repository names they are pulled
+// through, and every repository using a blob holds a reference to it: an
+// empty object under refs/<digest>/<repository>, rewritten when the
+// repository pulls the blob again. The number of live references of a blob is
+// its reference count.
+type cacheRefs struct {
+	cache *blobCache
+	// refresh is how long a recorded reference is not rewritten, so busy
+	// blobs don't cause a write per pull.
+	refresh time.Duration
+
+	mu      sync.Mutex
+	touched map[string]time.Time
+}
+
+// refKey returns the key of the reference of repo to the blob with digest.
+func (c *blobCache) refKey(digest, repo string) string {
+	return c.prefix + "refs/" + strings.Replace(digest, ":", "/", 1) + "/" + repo
+}
+
+// linked reports whether the repository of req holds a reference to the blob
+// it requests.
+func (r *cacheRefs) linked(req *http.Request) bool {
+	m := blobPath.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		return false
+	}
+	key := r.cache.refKey(m[2], m[1])
+	r.mu.Lock()
+	_, ok := r.touched[key]
+	r.mu.Unlock()
+	if ok {
+		return true
+	}
+	_, err := r.cache.store.stat(req.Context(), key)
+	if err != nil && err != errCacheMiss {
+		log.Printf("cache lookup for %s failed: %+v", key, err)
+	}
+	return err == nil
+}
+
+// touch records in the background that the blob requested by req is used by
+// the repository of the request.
+func (r *cacheRefs) touch(req *http.Request) {
+	if r == nil {
+		return
+	}
+	if m := blobPath.FindStringSubmatch(req.URL.Path); m != nil {
+		r.touchRef(m[2], m[1])
+	}
+}
+
+// touchRef records in the background that the blob with digest is used by
+// the upstream repository repo.
+func (r *cacheRefs) touchRef(digest, repo string) {
+	key := r.cache.refKey(digest, repo)
+	now := time.Now()
+	r.mu.Lock()
+	if t, ok := r.touched[key]; ok && now.Sub(t) < r.refresh {
+		r.mu.Unlock()
+		return
+	}
+	if len(r.touched) >= maxTouchedRefs {
+		r.touched = make(map[string]time.Time)
+	}
+	r.touched[key] = now
+	r.mu.Unlock()
+	go func() {
+		if err := r.cache.store.put(context.Background(), key, bytes.NewReader(nil), 0, "application/octet-stream"); err != nil {
+			log.Printf("failed to record cache reference %s: %+v", key, err)
+			r.mu.Lock()
+			delete(r.touched, key)
+			r.mu.Unlock()
+		}
+	}()
+}
+
+// cacheGC deletes the blobs of the cache that no repository has pulled for
+// the retention period. References not refreshed for that long are dropped
+// first, and blobs left without references are deleted.
+type cacheGC struct {
+	cache     *blobCache
+	store     objectLister
+	interval  time.Duration
+	retention time.Duration
+	// leader is the leader election of the replicas, if enabled. Only the
+	// leader collects garbage.
+	leader *leaderElector
+
+	mu   sync.Mutex
+	last *cacheGCReport
+}
+
+// cacheGCReport is the result of a garbage collection run.
+type cacheGCReport struct {
+	Time time.Time `json:"time"`
+	// Blobs and Bytes count the blobs kept in the cache.
+	Blobs int   `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+	// References is the sum of the reference counts of the kept blobs, and
+	// SharedBlobs the number of blobs referenced by more than one
+	// repository.
+	References  int `json:"references"`
+	SharedBlobs int `json:"shared_blobs"`
+	// DeduplicatedBytes is the storage saved by keeping shared blobs once
+	// rather than once per repository.
+	DeduplicatedBytes int64  `json:"deduplicated_bytes"`
+	DeletedBlobs      int    `json:"deleted_blobs"`
+	DeletedBytes      int64  `json:"deleted_bytes"`
+	DeletedRefs       int    `json:"deleted_refs"`
+	Error             string `json:"error,omitempty"`
+}
+
+// getCacheGC returns the garbage collection configured by CACHE_RETENTION
+// and CACHE_GC_INTERVAL, or nil if it is disabled.
+func getCacheGC(c *blobCache) *cacheGC {
+	v := os.Getenv("CACHE_RETENTION")
+	if v == "" {
+		if os.Getenv("CACHE_GC_INTERVAL") != "" {
+			log.Fatal("CACHE_GC_INTERVAL requires CACHE_RETENTION")
+		}
+		return nil
+	}
+	if c == nil {
+		log.Fatal("CACHE_RETENTION requires a cache, set CACHE_URL")
+	}
+	retention, err := time.ParseDuration(v)
+	if err != nil || retention < time.Hour {
+		log.Fatalf("invalid CACHE_RETENTION %q, expected a duration of at least 1h", v)
+	}
+	store, ok := c.store.(objectLister)
+	if !ok {
+		log.Fatal("CACHE_RETENTION is not supported by the cache backend")
+	}
+	g := &cacheGC{cache: c, store: store, interval: 24 * time.Hour, retention: retention}
+	if v := os.Getenv("CACHE_GC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			log.Fatalf("invalid CACHE_GC_INTERVAL %q, expected a duration of at least 1m", v)
+		}
+		g.interval = d
+	}
+	c.refs.refresh = retention / 10
+	log.Printf("deleting cached blobs not pulled for %s, every %s", retention, g.interval)
+	return g
+}
+
+// run collects garbage every interval while this replica is the leader. It
+// never returns.
+func (g *cacheGC) run() {
+	for {
+		time.Sleep(g.interval)
+		if !g.leader.isLeader() {
+			continue
+		}
+		report := g.collect(context.Background())
+		g.mu.Lock()
+		g.last = report
+		g.mu.Unlock()
+	}
+}
+
+// collect runs one garbage collection.
+func (g *cacheGC) collect(ctx context.Context) *cacheGCReport {
+	now := time.Now()
+	report := &cacheGCReport{Time: now}
+	fail := func(err error) *cacheGCReport {
+		log.Printf("cache garbage collection failed: %+v", err)
+		report.Error = err.Error()
+		return report
+	}
+	cutoff := now.Add(-g.retention)
+
+	// Blobs stored before references were recorded have none, so nothing is
+	// deleted for lack of references until the retention has passed since
+	// then. The time is kept in the bucket as the date of a marker object.
+	sinceKey := g.cache.prefix + "refs-since"
+	since, err := g.store.list(ctx, sinceKey)
+	if err != nil {
+		return fail(err)
+	}
+	deleteBlobs := len(since) > 0 && since[0].updated.Before(cutoff)
+	if len(since) == 0 {
+		if err := g.cache.store.put(ctx, sinceKey, bytes.NewReader(nil), 0, "application/octet-stream"); err != nil {
+			return fail(err)
+		}
+	}
+
+	refsPrefix := g.cache.prefix + "refs/"
+	refs, err := g.store.list(ctx, refsPrefix)
+	if err != nil {
+		return fail(err)
+	}
+	counts := map[string]int{}
+	for _, ref := range refs {
+		// Keys are refs/<algorithm>/<hex>/<repository>.
+		parts := strings.SplitN(strings.TrimPrefix(ref.key, refsPrefix), "/", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if ref.updated.Before(cutoff) {
+			if err := g.store.delete(ctx, ref.key); err != nil {
+				return fail(err)
+			}
+			cacheGCDeletedTotal.inc("ref")
+			report.DeletedRefs++
+			continue
+		}
+		counts[g.cache.digestKey(parts[0]+":"+parts[1])]++
+	}
+
+	blobs, err := g.store.list(ctx, g.cache.prefix+"blobs/")
+	if err != nil {
+		return fail(err)
+	}
+	for _, blob := range blobs {
+		n := counts[blob.key]
+		if n == 0 && deleteBlobs && blob.updated.Before(cutoff) {
+			if err := g.store.delete(ctx, blob.key); err != nil {
+				return fail(err)
+			}
+			cacheGCDeletedTotal.inc("blob")
+			report.DeletedBlobs++
+			report.DeletedBytes += blob.size
+			continue
+		}
+		report.Blobs++
+		report.Bytes += blob.size
+		report.References += n
+		if n > 1 {
+			report.SharedBlobs++
+			report.DeduplicatedBytes += int64(n-1) * blob.size
+		}
+	}
+	log.Printf("cache garbage collection: kept %d blobs (%d bytes, %d references, %d bytes deduplicated), deleted %d blobs (%d bytes) and %d references",
+		report.Blobs, report.Bytes, report.References, report.DeduplicatedBytes, report.DeletedBlobs, report.DeletedBytes, report.DeletedRefs)
+	return report
+}
+
+// handler reports the result of the last garbage collection.
+func (g *cacheGC) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g.mu.Lock()
+		last := g.last
+		g.mu.Unlock()
+		writeJSON(w, http.StatusOK, struct {
+			Interval  string         `json:"interval"`
+			Retention string         `json:"retention"`
+			Last      *cacheGCReport `json:"last"`
+		}{g.interval.String(), g.retention.String(), last})
+	}
+}
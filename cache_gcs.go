@@ -0,0 +1,284 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsStore is a blobStore in a Cloud Storage bucket, accessed through the
+// JSON API.
+type gcsStore struct {
+	bucket string
+	auth   authenticator
+	client *http.Client
+
+	// signer is the email of the service account signing URLs, looked up
+	// from the metadata server on first use unless GCS_SIGNING_SERVICE_ACCOUNT
+	// is set.
+	signerOnce sync.Once
+	signer     string
+	signerErr  error
+}
+
+func newGCSStore(bucket string, auth authenticator) *gcsStore {
+	return &gcsStore{
+		bucket: bucket,
+		auth:   auth,
+		client: &http.Client{},
+		signer: os.Getenv("GCS_SIGNING_SERVICE_ACCOUNT"),
+	}
+}
+
+func (s *gcsStore) stat(ctx context.Context, key string) (int64, error) {
+	u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?fields=size",
+		url.PathEscape(s.bucket), url.PathEscape(key))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", s.auth.AuthHeader())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var obj struct {
+			Size int64 `json:"size,string"`
+		}
+		if err := json.Unmarshal(b, &obj); err != nil {
+			return 0, fmt.Errorf("gcs: invalid metadata for %s: %+v", key, err)
+		}
+		return obj.Size, nil
+	case http.StatusNotFound:
+		return 0, errCacheMiss
+	default:
+		return 0, fmt.Errorf("gcs: reading metadata of %s returned status %d: %s", key, resp.StatusCode, b)
+	}
+}
+
+// signedURL returns a V4 signed URL for key. The signature is made by the
+// IAM Credentials API with the key of the instance's service account, which
+// needs the Service Account Token Creator role on itself.
+func (s *gcsStore) signedURL(key string, ttl time.Duration) (string, error) {
+	s.signerOnce.Do(func() {
+		if s.signer == "" {
+			s.signer, s.signerErr = getMetadata("instance/service-accounts/default/email")
+		}
+	})
+	if s.signerErr != nil {
+		return "", fmt.Errorf("could not determine service account to sign urls with: %+v", s.signerErr)
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	scope := date + "/auto/storage/goog4_request"
+	path := "/" + s3Escape(s.bucket, false) + "/" + s3Escape(key, false)
+	q := url.Values{}
+	q.Set("X-Goog-Algorithm", "GOOG4-RSA-SHA256")
+	q.Set("X-Goog-Credential", s.signer+"/"+scope)
+	q.Set("X-Goog-Date", now.Format(s3TimeFormat))
+	q.Set("X-Goog-Expires", strconv.Itoa(int(ttl/time.Second)))
+	q.Set("X-Goog-SignedHeaders", "host")
+	canonicalQuery := s3CanonicalQuery(q)
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		path,
+		canonicalQuery,
+		"host:storage.googleapis.com\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+	stringToSign := "GOOG4-RSA-SHA256\n" + now.Format(s3TimeFormat) + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	sig, err := s.signBlob([]byte(stringToSign))
+	if err != nil {
+		return "", err
+	}
+	return "https://storage.googleapis.com" + path + "?" + canonicalQuery + "&X-Goog-Signature=" + hex.EncodeToString(sig), nil
+}
+
+// signBlob signs b with the private key of the signing service account.
+func (s *gcsStore) signBlob(b []byte) ([]byte, error) {
+	body, _ := json.Marshal(map[string]string{"payload": base64.StdEncoding.EncodeToString(b)})
+	u := fmt.Sprintf("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:signBlob", url.PathEscape(s.signer))
+	resp, err := gcpRequest(s.client, s.auth, http.MethodPost, u, "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		SignedBlob string `json:"signedBlob"`
+	}
+	if err := json.Unmarshal(resp, &out); err != nil {
+		return nil, fmt.Errorf("invalid signBlob response: %+v", err)
+	}
+	return base64.StdEncoding.DecodeString(out.SignedBlob)
+}
+
+func (s *gcsStore) get(ctx context.Context, key string) (*cacheObject, error) {
+	return s.read(ctx, key, 0, -1)
+}
+
+func (s *gcsStore) getRange(ctx context.Context, key string, offset, length int64) (*cacheObject, error) {
+	return s.read(ctx, key, offset, length)
+}
+
+// read returns length bytes of the object from offset, or all of it if
+// length is negative.
+func (s *gcsStore) read(ctx context.Context, key string, offset, length int64) (*cacheObject, error) {
+	u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media",
+		url.PathEscape(s.bucket), url.PathEscape(key))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", s.auth.AuthHeader())
+	ok := setByteRange(req, offset, length)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case ok:
+		return &cacheObject{body: resp.Body, size: resp.ContentLength, contentType: resp.Header.Get("Content-Type")}, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errCacheMiss
+	default:
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("gcs: reading %s returned status %d: %s", key, resp.StatusCode, b)
+	}
+}
+
+func (s *gcsStore) put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	u := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		url.PathEscape(s.bucket), url.QueryEscape(key))
+	// An empty body has to be http.NoBody, or it would be sent chunked.
+	var body io.Reader = http.NoBody
+	if size > 0 {
+		body = ioutil.NopCloser(r)
+	}
+	req, err := http.NewRequest(http.MethodPost, u, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	req.Header.Set("Authorization", s.auth.AuthHeader())
+	req.Header.Set("Content-Type", contentType)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("gcs: writing %s returned status %d: %s", key, resp.StatusCode, b)
+	}
+	return nil
+}
+
+func (s *gcsStore) list(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var objects []objectInfo
+	pageToken := ""
+	for {
+		q := url.Values{}
+		q.Set("prefix", prefix)
+		q.Set("fields", "items(name,size,updated),nextPageToken")
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o?%s", url.PathEscape(s.bucket), q.Encode())
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", s.auth.AuthHeader())
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("gcs: listing %s returned status %d: %.4096s", prefix, resp.StatusCode, b)
+		}
+		var page struct {
+			Items []struct {
+				Name    string    `json:"name"`
+				Size    int64     `json:"size,string"`
+				Updated time.Time `json:"updated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(b, &page); err != nil {
+			return nil, fmt.Errorf("gcs: invalid listing of %s: %+v", prefix, err)
+		}
+		for _, item := range page.Items {
+			objects = append(objects, objectInfo{key: item.Name, size: item.Size, updated: item.Updated})
+		}
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (s *gcsStore) delete(ctx context.Context, key string) error {
+	u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s",
+		url.PathEscape(s.bucket), url.PathEscape(key))
+	req, err := http.NewRequest(http.MethodDelete, u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", s.auth.AuthHeader())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK, http.StatusNotFound:
+		return nil
+	default:
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("gcs: deleting %s returned status %d: %s", key, resp.StatusCode, b)
+	}
+}
@@ -0,0 +1,363 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+)
+
+// s3Store is a blobStore in an S3 compatible bucket (AWS S3, MinIO, Ceph...).
+// Requests are signed with AWS Signature Version 4.
+type s3Store struct {
+	bucket string
+	// endpoint is the scheme and host of the S3 API, e.g.
+	// https://s3.eu-west-1.amazonaws.com or http://minio:9000.
+	endpoint     string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+// getS3Store configures an s3Store for bucket from the standard AWS_*
+// environment variables and S3_ENDPOINT.
+func getS3Store(bucket string) *s3Store {
+	s := &s3Store{
+		bucket:       bucket,
+		endpoint:     strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.endpoint == "" {
+		s.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		log.Fatal("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to use an S3 cache")
+	}
+	return s
+}
+
+// objectURL returns the path-style URL of key, which all S3 implementations
+// support.
+func (s *s3Store) objectURL(key string) string {
+	return s.endpoint + "/" + s3Escape(s.bucket, false) + "/" + s3Escape(key, false)
+}
+
+func (s *s3Store) get(ctx context.Context, key string) (*cacheObject, error) {
+	return s.read(ctx, key, 0, -1)
+}
+
+func (s *s3Store) getRange(ctx context.Context, key string, offset, length int64) (*cacheObject, error) {
+	return s.read(ctx, key, offset, length)
+}
+
+// read returns length bytes of the object from offset, or all of it if
+// length is negative.
+func (s *s3Store) read(ctx context.Context, key string, offset, length int64) (*cacheObject, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	ok := setByteRange(req, offset, length)
+	s.sign(req, time.Now())
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case ok:
+		return &cacheObject{body: resp.Body, size: resp.ContentLength, contentType: resp.Header.Get("Content-Type")}, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errCacheMiss
+	default:
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: reading %s returned status %d: %s", key, resp.StatusCode, b)
+	}
+}
+
+func (s *s3Store) put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	// An empty body has to be http.NoBody, or it would be sent chunked.
+	var body io.Reader = http.NoBody
+	if size > 0 {
+		body = ioutil.NopCloser(r)
+	}
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, time.Now())
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("s3: writing %s returned status %d: %s", key, resp.StatusCode, b)
+	}
+	return nil
+}
+
+func (s *s3Store) stat(ctx context.Context, key string) (int64, error) {
+	req, err := http.NewRequest(http.MethodHead, s.objectURL(key), nil)
+	if err != nil {
+		return 0, err
+	}
+	s.sign(req, time.Now())
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, errCacheMiss
+	default:
+		return 0, fmt.Errorf("s3: reading metadata of %s returned status %d", key, resp.StatusCode)
+	}
+}
+
+func (s *s3Store) list(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var objects []objectInfo
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u := s.endpoint + "/" + s3Escape(s.bucket, false) + "?" + s3CanonicalQuery(q)
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		s.sign(req, time.Now())
+		resp, err := s.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("s3: listing %s returned status %d: %.4096s", prefix, resp.StatusCode, b)
+		}
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(b, &page); err != nil {
+			return nil, fmt.Errorf("s3: invalid listing of %s: %+v", prefix, err)
+		}
+		for _, c := range page.Contents {
+			objects = append(objects, objectInfo{key: c.Key, size: c.Size, updated: c.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *s3Store) delete(ctx context.Context, key string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	s.sign(req, time.Now())
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK, http.StatusNotFound:
+		return nil
+	default:
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("s3: deleting %s returned status %d: %s", key, resp.StatusCode, b)
+	}
+}
+
+// signedURL returns a presigned GET URL for key that is valid for ttl.
+func (s *s3Store) signedURL(key string, ttl time.Duration) (string, error) {
+	now := time.Now().UTC()
+	u, err := url.Parse(s.objectURL(key))
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(now))
+	q.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(ttl/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+	if s.sessionToken != "" {
+		q.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	canonicalQuery := s3CanonicalQuery(q)
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(s.signingKey(now), s.stringToSign(now, canonicalRequest)))
+	return u.Scheme + "://" + u.Host + u.EscapedPath() + "?" + canonicalQuery + "&X-Amz-Signature=" + signature, nil
+}
+
+func (s *s3Store) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+func (s *s3Store) stringToSign(now time.Time, canonicalRequest string) string {
+	return "AWS4-HMAC-SHA256\n" + now.Format(s3TimeFormat) + "\n" + s.scope(now) + "\n" + sha256Hex([]byte(canonicalRequest))
+}
+
+func (s *s3Store) signingKey(now time.Time) []byte {
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req. The
+// payload is not signed so that bodies can be streamed.
+func (s *s3Store) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(s3TimeFormat)
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	var names []string
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "host" || lk == "content-type" || strings.HasPrefix(lk, "x-amz-") {
+			names = append(names, lk)
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, n := range names {
+		canonicalHeaders.WriteString(n + ":" + strings.TrimSpace(req.Header.Get(n)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	req.Header.Del("Host")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	signature := hex.EncodeToString(hmacSHA256(s.signingKey(now), s.stringToSign(now, canonicalRequest)))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, s.scope(now), signedHeaders, signature))
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes s as required by Signature Version 4: everything
+// except unreserved characters is escaped, and "/" only if encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is a blobStore in memory.
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *memStore) get(ctx context.Context, key string) (*cacheObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.objects[key]
+	if !ok {
+		return nil, errCacheMiss
+	}
+	return &cacheObject{body: ioutil.NopCloser(bytes.NewReader(b)), size: int64(len(b)), contentType: "application/octet-stream"}, nil
+}
+
+func (s *memStore) put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = b
+	return nil
+}
+
+func (s *memStore) stat(ctx context.Context, key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.objects[key]
+	if !ok {
+		return 0, errCacheMiss
+	}
+	return int64(len(b)), nil
+}
+
+func (s *memStore) wait(key string) []byte {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		b, ok := s.objects[key]
+		s.mu.Unlock()
+		if ok {
+			return b
+		}
+	}
+	return nil
+}
+
+func newMemCache() (*memStore, *blobCache) {
+	store := &memStore{objects: map[string][]byte{}}
+	cache := &blobCache{store: store}
+	cache.refs = &cacheRefs{cache: cache, refresh: defaultRefRefresh, touched: map[string]time.Time{}}
+	return store, cache
+}
+
+// redirectingUpstream answers blob downloads with a redirect to a separate
+// storage server, like gcr.io, Artifact Registry and Docker Hub do.
+type redirectingUpstream struct {
+	registry, storage *httptest.Server
+	// blobs are served by the storage by digest.
+	blobs map[string][]byte
+	// storageAuth is the Authorization header the storage got last.
+	storageAuth string
+}
+
+func newRedirectingUpstream(blobs map[string][]byte) *redirectingUpstream {
+	u := &redirectingUpstream{blobs: blobs}
+	u.storage = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u.storageAuth = req.Header.Get("Authorization")
+		b, ok := u.blobs[strings.TrimPrefix(req.URL.Path, "/storage/")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(b)
+	}))
+	u.registry = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m := blobPath.FindStringSubmatch(req.URL.Path)
+		if m == nil {
+			http.NotFound(w, req)
+			return
+		}
+		http.Redirect(w, req, u.storage.URL+"/storage/"+m[2], http.StatusTemporaryRedirect)
+	}))
+	return u
+}
+
+func (u *redirectingUpstream) Close() {
+	u.registry.Close()
+	u.storage.Close()
+}
+
+// transport trusts both servers.
+func (u *redirectingUpstream) transport() http.RoundTripper {
+	pool := x509.NewCertPool()
+	pool.AddCert(u.registry.Certificate())
+	pool.AddCert(u.storage.Certificate())
+	return &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+}
+
+func (u *redirectingUpstream) get(t *testing.T, cfg registryConfig, digest string) *http.Response {
+	req, _ := http.NewRequest(http.MethodGet, u.registry.URL+"/v2/library/app/blobs/"+digest, nil)
+	req.Header.Set("Authorization", "Bearer upstream")
+	req = req.WithContext(context.WithValue(req.Context(), ctxKeyOriginalHost, "proxy.example.com"))
+	resp, err := (&registryRoundtripper{cfg: cfg}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestCacheFillsFromRedirectedBlobs(t *testing.T) {
+	blob := []byte("layer content")
+	digest := sha256Digest(blob)
+	up := newRedirectingUpstream(map[string][]byte{digest: blob})
+	defer up.Close()
+
+	store, cache := newMemCache()
+	cfg := registryConfig{
+		host:            strings.TrimPrefix(up.registry.URL, "https://"),
+		transport:       up.transport(),
+		cache:           cache,
+		followRedirects: true,
+	}
+
+	resp := up.get(t, cfg, digest)
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || err != nil || !bytes.Equal(b, blob) {
+		t.Fatalf("got status %d, %q, %v, want the blob", resp.StatusCode, b, err)
+	}
+	if up.storageAuth != "" {
+		t.Errorf("the storage got the upstream credential %q", up.storageAuth)
+	}
+	if got := store.wait(cache.digestKey(digest)); !bytes.Equal(got, blob) {
+		t.Fatalf("cached %q, want the blob", got)
+	}
+
+	// The next pull is served from the cache.
+	up.blobs = nil
+	resp = up.get(t, cfg, digest)
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(b, blob) {
+		t.Fatalf("got status %d, %q from the cache, want the blob", resp.StatusCode, b)
+	}
+}
+
+func TestRedirectedBlobsAreVerified(t *testing.T) {
+	digest := sha256Digest([]byte("layer content"))
+	up := newRedirectingUpstream(map[string][]byte{digest: []byte("corrupt content")})
+	defer up.Close()
+
+	store, cache := newMemCache()
+	cfg := registryConfig{
+		host:            strings.TrimPrefix(up.registry.URL, "https://"),
+		transport:       up.transport(),
+		cache:           cache,
+		followRedirects: true,
+	}
+	resp := up.get(t, cfg, digest)
+	_, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		t.Fatal("a corrupt redirected blob was read without an error")
+	}
+	if got := store.wait(cache.digestKey(digest)); got != nil {
+		t.Fatalf("a corrupt blob was cached: %q", got)
+	}
+}
+
+func TestBlobRedirectsArePassedOnWithoutFollowing(t *testing.T) {
+	digest := sha256Digest([]byte("layer content"))
+	up := newRedirectingUpstream(map[string][]byte{digest: []byte("layer content")})
+	defer up.Close()
+
+	cfg := registryConfig{host: strings.TrimPrefix(up.registry.URL, "https://"), transport: up.transport()}
+	resp := up.get(t, cfg, digest)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || !strings.HasPrefix(resp.Header.Get("Location"), up.storage.URL) {
+		t.Fatalf("got status %d to %q, want the redirect to the storage", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// cachePolicyRule sets the Cache-Control header of successful responses it
+// matches. Empty fields match everything.
+type cachePolicyRule struct {
+	// Repository is a client-visible repository name, or a pattern like
+	// "library/*" in path.Match syntax.
+	Repository string `json:"repository"`
+	// Kind is "blobs", "manifests", "tags" or "referrers".
+	Kind string `json:"kind"`
+	// Reference is "tag" or "digest".
+	Reference string `json:"reference"`
+	// MediaType matches the Content-Type of the response.
+	MediaType string `json:"media_type"`
+	// MaxAge is how long the response may be cached, like "60s" or "8760h".
+	// Responses matching a rule with a zero MaxAge are never cached.
+	MaxAge string `json:"max_age"`
+	// Immutable tells caches that the content never changes.
+	Immutable bool `json:"immutable"`
+
+	maxAge time.Duration
+}
+
+// cachePolicy decides the Cache-Control headers of registry API responses.
+// The first matching rule wins. Responses matching no rule keep the headers
+// of the upstream registry.
+type cachePolicy struct {
+	rules []cachePolicyRule
+	// live, if set, holds the rules instead, which change when the config
+	// file is reloaded.
+	live *liveConfig
+	// private marks cacheable content as private, so shared caches like CDNs
+	// never serve it to other clients.
+	private bool
+}
+
+// getCachePolicy returns the cache policy of the config file, or if there is
+// none, a policy caching content addressed by digest for IMMUTABLE_MAX_AGE.
+// Content is only marked public if clients are not authenticated by the
+// proxy. It returns nil if no policy is configured. The rules are published
+// to live.
+func getCachePolicy(rules []cachePolicyRule, private bool, live *liveConfig) *cachePolicy {
+	rules = defaultCachePolicyRules(rules)
+	if len(rules) == 0 {
+		return nil
+	}
+	p, err := newCachePolicy(rules, private)
+	if err != nil {
+		log.Fatalf("invalid cache policy: %+v", err)
+	}
+	live.update(func(s *configSnapshot) { s.cachePolicy = p.rules })
+	p.rules, p.live = nil, live
+	return p
+}
+
+// defaultCachePolicyRules returns rules, or if there are none, the rules
+// implied by IMMUTABLE_MAX_AGE.
+func defaultCachePolicyRules(rules []cachePolicyRule) []cachePolicyRule {
+	if len(rules) > 0 {
+		return rules
+	}
+	v := os.Getenv("IMMUTABLE_MAX_AGE")
+	if v == "" {
+		return nil
+	}
+	return []cachePolicyRule{
+		{Kind: "blobs", MaxAge: v, Immutable: true},
+		{Kind: "manifests", Reference: "digest", MaxAge: v, Immutable: true},
+	}
+}
+
+// reloader returns the configReloader for the cache_policy section of the
+// config file.
+func (p *cachePolicy) reloader() configReloader {
+	return func(fc fileConfig) (func(*configSnapshot), error) {
+		rules := defaultCachePolicyRules(fc.CachePolicy)
+		if len(rules) == 0 {
+			return nil, fmt.Errorf("cache_policy: removing the cache policy requires a restart")
+		}
+		np, err := newCachePolicy(rules, p.private)
+		if err != nil {
+			return nil, fmt.Errorf("cache_policy: %v", err)
+		}
+		return func(s *configSnapshot) { s.cachePolicy = np.rules }, nil
+	}
+}
+
+func newCachePolicy(rules []cachePolicyRule, private bool) (*cachePolicy, error) {
+	p := &cachePolicy{private: private}
+	for i, r := range rules {
+		switch r.Kind {
+		case "", "blobs", "manifests", "tags", "referrers":
+		default:
+			return nil, fmt.Errorf("rule %d: unknown kind %q", i+1, r.Kind)
+		}
+		switch r.Reference {
+		case "", "tag", "digest":
+		default:
+			return nil, fmt.Errorf("rule %d: reference must be \"tag\" or \"digest\", got %q", i+1, r.Reference)
+		}
+		if _, err := path.Match(r.Repository, ""); err != nil {
+			return nil, fmt.Errorf("rule %d: invalid repository pattern %q", i+1, r.Repository)
+		}
+		d, err := time.ParseDuration(r.MaxAge)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("rule %d: invalid max_age %q", i+1, r.MaxAge)
+		}
+		r.maxAge = d
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+func (r cachePolicyRule) matches(name string, rr registryRequest, mediaType string) bool {
+	if r.Repository != "" {
+		if ok, _ := path.Match(r.Repository, name); !ok {
+			return false
+		}
+	}
+	if r.Kind != "" && r.Kind != rr.kind {
+		return false
+	}
+	if r.Reference == "digest" && !isDigest(rr.reference) ||
+		r.Reference == "tag" && (isDigest(rr.reference) || rr.kind == "tags") {
+		return false
+	}
+	return r.MediaType == "" || r.MediaType == mediaType
+}
+
+func (r cachePolicyRule) header(private bool) string {
+	if r.maxAge == 0 {
+		return "no-store"
+	}
+	visibility := "public"
+	if private {
+		visibility = "private"
+	}
+	v := fmt.Sprintf("%s, max-age=%d", visibility, int64(r.maxAge/time.Second))
+	if r.Immutable {
+		v += ", immutable"
+	}
+	return v
+}
+
+// apply sets the Cache-Control header of successful responses to GET and HEAD
+// requests of the registry API. Upstream repository names are mapped back with
+// cfg so that rules match the names clients know.
+func (p *cachePolicy) apply(resp *http.Response, cfg registryConfig) *http.Response {
+	if p == nil || resp.StatusCode != http.StatusOK {
+		return resp
+	}
+	if m := resp.Request.Method; m != http.MethodGet && m != http.MethodHead {
+		return resp
+	}
+	rr, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok {
+		return resp
+	}
+	name, ok := cfg.clientName(rr.name)
+	if !ok {
+		return resp
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	rules := p.rules
+	if p.live != nil {
+		rules = p.live.get(resp.Request.Context()).cachePolicy
+	}
+	for _, r := range rules {
+		if r.matches(name, rr, mediaType) {
+			resp.Header.Set("Cache-Control", r.header(p.private))
+			resp.Header.Del("Expires")
+			resp.Header.Del("Pragma")
+			break
+		}
+	}
+	return resp
+}
+
+// setNoStore marks a response as not cacheable, as token responses are
+// credentials.
+func setNoStore(resp *http.Response) {
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Header.Set("Pragma", "no-cache")
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+var canaryRequestsTotal = newCounterVec("registry_proxy_canary_requests_total",
+	"Reads split between the primary and the canary upstream, by upstream (primary or canary) and result (ok, not_found or error).", "upstream", "result")
+
+// canaryConfig names a secondary upstream that serves a share of the reads,
+// like the registry a migration moves to.
+type canaryConfig struct {
+	fallbackUpstream
+	// Percent is the share of manifest, blob and tag list reads served by
+	// the canary, between 0 and 100.
+	Percent float64 `json:"percent"`
+}
+
+// canaryRouter serves a random share of the reads from a secondary upstream
+// instead of REGISTRY_HOST, so a migration can be validated with real
+// traffic before moving all of it. Unlike shadow reads, clients get the
+// responses of the canary. Pushes always go to the primary.
+type canaryRouter struct {
+	primary registryConfig
+	handler http.Handler
+	// live holds the canary upstream and percentage, which change when the
+	// config file is reloaded.
+	live *liveConfig
+}
+
+// getCanaryRouter returns the canary of the config file, or nil if none is
+// configured. The canary shares the configuration of primary except for its
+// host, repository prefix and credential, and bypasses the caches, so
+// cached content doesn't hide what the canary serves. The upstream and
+// percentage are published to live.
+func getCanaryRouter(cc canaryConfig, primary registryConfig, live *liveConfig) *canaryRouter {
+	if cc.Host == "" {
+		return nil
+	}
+	if err := checkCanaryPercent(cc.Percent); err != nil {
+		log.Fatal(err)
+	}
+	c := &canaryRouter{primary: primary, live: live}
+	c.handler = registryAPIProxy(func(ctx context.Context) *registryRoundtripper {
+		return live.get(ctx).canary
+	})
+	live.update(func(s *configSnapshot) {
+		s.canary, s.canaryPercent = cc.roundTripper(primary, nil), cc.Percent
+	})
+	log.Printf("serving %g%% of reads from canary upstream %s", cc.Percent, canonicalHost(cc.Host))
+	return c
+}
+
+func checkCanaryPercent(p float64) error {
+	if p < 0 || p > 100 {
+		return fmt.Errorf("invalid canary.percent %v, expected a percentage between 0 and 100", p)
+	}
+	return nil
+}
+
+// reloader applies changes of the canary upstream and percentage. Removing
+// the canary requires a restart.
+func (c *canaryRouter) reloader() configReloader {
+	return func(fc fileConfig) (func(*configSnapshot), error) {
+		if fc.Canary.Host == "" {
+			return nil, fmt.Errorf("canary: removing the canary requires a restart, set percent to 0 instead")
+		}
+		if err := checkCanaryPercent(fc.Canary.Percent); err != nil {
+			return nil, err
+		}
+		canary := fc.Canary.roundTripper(c.primary, c.live.load().canary)
+		return func(s *configSnapshot) {
+			s.canary, s.canaryPercent = canary, fc.Canary.Percent
+			log.Printf("serving %g%% of reads from canary upstream %s", fc.Canary.Percent, canary.cfg.host)
+		}, nil
+	}
+}
+
+// middleware serves the canary's share of reads from the canary upstream,
+// and everything else with next.
+func (c *canaryRouter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rr, ok := parseRegistryPath(req.URL.Path)
+		if !ok || (req.Method != http.MethodGet && req.Method != http.MethodHead) ||
+			(rr.kind != "manifests" && rr.kind != "blobs" && rr.kind != "tags") ||
+			strings.HasPrefix(rr.reference, "uploads/") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		upstream, h := "primary", next
+		if s := c.live.get(req.Context()); rand.Float64()*100 < s.canaryPercent {
+			upstream, h = "canary", c.handler
+			// The client's credentials are meant for the primary upstream.
+			req.Header.Del("Authorization")
+			w.Header().Set("X-Registry-Upstream", s.canary.cfg.host)
+		}
+		cw := &countingResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(cw, req)
+		result := "ok"
+		switch {
+		case cw.status == http.StatusNotFound:
+			result = "not_found"
+		case cw.status >= http.StatusBadRequest:
+			result = "error"
+		}
+		canaryRequestsTotal.inc(upstream, result)
+	})
+}
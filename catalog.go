@@ -0,0 +1,83 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// listingPolicy restricts the enumeration of repositories and tags,
+// independent of what the upstream registry allows.
+type listingPolicy struct {
+	// denyCatalog rejects /v2/_catalog requests. Like all /v2/ requests,
+	// they require authentication already if clients authenticate to the
+	// proxy.
+	denyCatalog bool
+	// maxPageSize caps the number of entries per page of tag lists and the
+	// catalog, 0 if unlimited.
+	maxPageSize int
+}
+
+// getListingPolicy returns the policy configured by CATALOG_ACCESS and
+// MAX_PAGE_SIZE, or nil if listings are not restricted.
+func getListingPolicy() *listingPolicy {
+	p := &listingPolicy{}
+	switch v := os.Getenv("CATALOG_ACCESS"); v {
+	case "", "allow":
+	case "deny":
+		p.denyCatalog = true
+	default:
+		log.Fatalf("invalid CATALOG_ACCESS %q, expected allow or deny", v)
+	}
+	if v := os.Getenv("MAX_PAGE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("invalid MAX_PAGE_SIZE %q", v)
+		}
+		p.maxPageSize = n
+	}
+	if !p.denyCatalog && p.maxPageSize == 0 {
+		return nil
+	}
+	return p
+}
+
+// middleware rejects catalog requests the policy denies and caps the page
+// size requested for listings, which makes clients follow pagination links
+// for the rest.
+func (p *listingPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		catalog := req.URL.Path == "/v2/_catalog"
+		rr, ok := parseRegistryPath(req.URL.Path)
+		tags := ok && rr.kind == "tags"
+		if catalog && p.denyCatalog {
+			writeRegistryError(w, http.StatusForbidden, "DENIED", "listing repositories is not allowed")
+			return
+		}
+		if (catalog || tags) && p.maxPageSize > 0 {
+			q := req.URL.Query()
+			if n, err := strconv.Atoi(q.Get("n")); err != nil || n <= 0 || n > p.maxPageSize {
+				q.Set("n", strconv.Itoa(p.maxPageSize))
+				req.URL.RawQuery = q.Encode()
+				req.RequestURI = req.URL.RequestURI()
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const clientTokenTTL = 5 * time.Minute
+
+type clientIdentityKey struct{}
+
+var ctxKeyClientIdentity = clientIdentityKey{}
+
+// clientIdentity is an authenticated user of the proxy.
+type clientIdentity struct {
+	username string
+	// upstreamAuth is the Authorization header value used for this user's
+	// requests to the upstream registry, instead of the proxy's credential.
+	upstreamAuth string
+	groups       []string
+	// access lists the repository scopes granted to the token the client
+	// presented, or is nil if the client isn't restricted to scopes.
+	access []string
+	// expires is the expiry of the token the client presented, zero if it
+	// authenticated with its password.
+	expires time.Time
+}
+
+// tokenAllows reports whether the scopes of the client's token allow the
+// action on the repository.
+func (id *clientIdentity) tokenAllows(name, action string) bool {
+	if id.access == nil {
+		return true
+	}
+	for _, scope := range id.access {
+		i := strings.LastIndex(scope, ":")
+		if i < 0 || scope[:i] != "repository:"+name {
+			continue
+		}
+		for _, a := range strings.Split(scope[i+1:], ",") {
+			if a == action || a == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// identityFromContext returns the authenticated client of a request, or nil
+// for anonymous requests.
+func identityFromContext(ctx context.Context) *clientIdentity {
+	id, _ := ctx.Value(ctxKeyClientIdentity).(*clientIdentity)
+	return id
+}
+
+type clientUser struct {
+	Username       string   `json:"username"`
+	PasswordSHA256 string   `json:"password_sha256"`
+	UpstreamAuth   string   `json:"upstream_auth,omitempty"`
+	Groups         []string `json:"groups,omitempty"`
+}
+
+type clientUsersFile struct {
+	Users []clientUser `json:"users"`
+}
+
+// clientAuth authenticates clients of the proxy, which makes `docker login`
+// against the proxy work. It acts as the token service for the proxy: clients
+// exchange their username and password on /_token for a short-lived token
+// signed by the proxy, and present either one on /v2/.
+type clientAuth struct {
+	users  map[string]clientUser
+	secret []byte
+	// authz restricts the scopes granted to tokens, if set.
+	authz *authzPolicy
+}
+
+// getClientAuth loads the users from CLIENT_AUTH_FILE, or returns nil if
+// client authentication is not enabled.
+func getClientAuth() *clientAuth {
+	path := os.Getenv("CLIENT_AUTH_FILE")
+	if path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("could not read client auth file from %s: %+v", path, err)
+	}
+	var f clientUsersFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		log.Fatalf("could not parse client auth file %s: %+v", path, err)
+	}
+	ca := &clientAuth{users: make(map[string]clientUser)}
+	for _, u := range f.Users {
+		if u.Username == "" || len(u.PasswordSHA256) != sha256.Size*2 {
+			log.Fatalf("client auth file %s: every user needs a username and a hex encoded password_sha256", path)
+		}
+		ca.users[u.Username] = u
+	}
+	if s := os.Getenv("CLIENT_AUTH_TOKEN_SECRET"); s != "" {
+		ca.secret = []byte(s)
+	} else {
+		log.Printf("CLIENT_AUTH_TOKEN_SECRET not set, tokens issued by this instance will not be accepted by other instances")
+		ca.secret = make([]byte, 32)
+		if _, err := rand.Read(ca.secret); err != nil {
+			log.Fatalf("could not generate token secret: %+v", err)
+		}
+	}
+	log.Printf("client authentication enabled for %d users", len(ca.users))
+	return ca
+}
+
+// checkPassword returns the identity for valid credentials, or nil.
+func (ca *clientAuth) checkPassword(username, password string) *clientIdentity {
+	u, ok := ca.users[username]
+	sum := sha256.Sum256([]byte(password))
+	if !ok || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(u.PasswordSHA256))) != 1 {
+		return nil
+	}
+	return &clientIdentity{username: u.Username, upstreamAuth: u.UpstreamAuth, groups: u.Groups}
+}
+
+type clientTokenClaims struct {
+	Subject string   `json:"sub"`
+	Expiry  int64    `json:"exp"`
+	Access  []string `json:"access,omitempty"`
+}
+
+func (ca *clientAuth) sign(payload string) string {
+	mac := hmac.New(sha256.New, ca.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueToken returns a token identifying username until it expires. If
+// access is not nil, the token only grants these repository scopes.
+func (ca *clientAuth) issueToken(username string, expiry time.Time, access []string) string {
+	b, _ := json.Marshal(clientTokenClaims{Subject: username, Expiry: expiry.Unix(), Access: access})
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + ca.sign(payload)
+}
+
+// checkToken returns the identity of a valid, unexpired token, or nil.
+func (ca *clientAuth) checkToken(token string) *clientIdentity {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(ca.sign(parts[0]))) {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil
+	}
+	var c clientTokenClaims
+	if err := json.Unmarshal(b, &c); err != nil || time.Now().Unix() > c.Expiry {
+		return nil
+	}
+	u, ok := ca.users[c.Subject]
+	if !ok {
+		return nil
+	}
+	return &clientIdentity{username: u.Username, upstreamAuth: u.UpstreamAuth, groups: u.Groups, access: c.Access,
+		expires: time.Unix(c.Expiry, 0)}
+}
+
+// authenticate returns the identity for the credentials of req, or nil.
+func (ca *clientAuth) authenticate(req *http.Request) *clientIdentity {
+	if user, pass, ok := req.BasicAuth(); ok {
+		// Credentials minted on /_credentials carry a token as password.
+		if id := ca.checkToken(pass); id != nil && id.username == user {
+			return id
+		}
+		return ca.checkPassword(user, pass)
+	}
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return ca.checkToken(strings.TrimPrefix(h, "Bearer "))
+	}
+	return nil
+}
+
+// middleware rejects unauthenticated requests with a challenge that points
+// clients to the proxy's token endpoint, and stores the identity of
+// authenticated ones in the request context.
+func (ca *clientAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := ca.authenticate(req)
+		if id == nil {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/_token",service="%s"`, req.Host, req.Host))
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+			return
+		}
+		ctx := context.WithValue(req.Context(), ctxKeyClientIdentity, id)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// tokenHandler issues proxy tokens to clients presenting valid credentials.
+// Tokens issued for another token or minted credentials expire with them.
+func (ca *clientAuth) tokenHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := ca.authenticate(req)
+		if id == nil {
+			w.Header().Set("Www-Authenticate", `Basic realm="registry-proxy"`)
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid username or password")
+			return
+		}
+		var access []string
+		if ca.authz != nil {
+			// An empty list still restricts the token, to no scopes at all.
+			access = append([]string{}, ca.authz.grant(req.Context(), id, req.URL.Query()["scope"])...)
+		}
+		now := time.Now()
+		expiry := now.Add(clientTokenTTL)
+		if !id.expires.IsZero() && id.expires.Before(expiry) {
+			// Tokens and minted credentials can't be renewed beyond their
+			// own expiry.
+			expiry = id.expires
+		}
+		tok := ca.issueToken(id.username, expiry, access)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"token":        tok,
+			"access_token": tok,
+			"expires_in":   int(expiry.Sub(now) / time.Second),
+			"issued_at":    now.UTC().Format(time.RFC3339),
+		})
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minCompressSize is the smallest response body worth compressing, if its
+// size is known.
+const minCompressSize = 1024
+
+// compressJSON gzips JSON responses of the registry API, like manifests, tag
+// lists and the catalog, for clients that accept it. Blobs are already
+// compressed or opaque and are never touched.
+func compressJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet || !acceptsGzip(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if rr, ok := parseRegistryPath(req.URL.Path); ok && rr.kind == "blobs" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		cw := &compressingResponseWriter{ResponseWriter: w}
+		defer cw.close()
+		next.ServeHTTP(cw, req)
+	})
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of req allows gzip.
+func acceptsGzip(req *http.Request) bool {
+	for _, v := range req.Header["Accept-Encoding"] {
+		for _, enc := range strings.Split(v, ",") {
+			parts := strings.Split(strings.TrimSpace(enc), ";")
+			if strings.TrimSpace(parts[0]) != "gzip" {
+				continue
+			}
+			for _, p := range parts[1:] {
+				p = strings.TrimSpace(p)
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(p, "q="), 64); strings.HasPrefix(p, "q=") && err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// compressibleType reports whether a Content-Type is JSON, including the
+// manifest media types like application/vnd.oci.image.index.v1+json and
+// signed schema 1 manifests.
+func compressibleType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || strings.HasSuffix(mt, "+json") || strings.HasSuffix(mt, "+prettyjws")
+}
+
+// compressingResponseWriter decides whether to compress when the headers are
+// written, and gzips the body from then on if so.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *compressingResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if compressibleType(h.Get("Content-Type")) {
+		h.Add("Vary", "Accept-Encoding")
+		size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		if status == http.StatusOK && h.Get("Content-Encoding") == "" && (err != nil || size >= minCompressSize) {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", "gzip")
+			// The compressed body is a different representation, so a strong
+			// validator like the manifest digest no longer applies to it.
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+			w.gz = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressingResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressingResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
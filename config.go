@@ -0,0 +1,211 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// fileConfig is the optional JSON configuration file named by CONFIG_FILE. It
+// holds the settings that are too structured to be passed in environment
+// variables.
+type fileConfig struct {
+	// CachePolicy decides the Cache-Control headers sent to clients, see
+	// cachePolicyRule.
+	CachePolicy []cachePolicyRule `json:"cache_policy"`
+	// Mirror lists images to keep in the cache, see mirrorConfig.
+	Mirror mirrorConfig `json:"mirror"`
+	// Authorization grants clients authenticated by the proxy actions on
+	// repositories, see authzRule.
+	Authorization []authzRule `json:"authorization"`
+	// Virtual lists upstreams to try for pulls REGISTRY_HOST doesn't have,
+	// see virtualConfig.
+	Virtual virtualConfig `json:"virtual"`
+	// UpstreamOverrides names alternate upstreams that requests can be
+	// routed to with the X-Proxy-Upstream header, see upstreamOverrides.
+	UpstreamOverrides map[string]fallbackUpstream `json:"upstream_overrides"`
+	// Shadow names an upstream that reads are replayed against, see
+	// shadowReader.
+	Shadow shadowConfig `json:"shadow"`
+	// Canary names an upstream that serves a share of the reads, see
+	// canaryRouter.
+	Canary canaryConfig `json:"canary"`
+	// Priority assigns pulls to priority classes, see pullScheduler.
+	Priority priorityConfig `json:"priority"`
+}
+
+func getFileConfig() fileConfig {
+	var fc fileConfig
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return fc
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("could not read config file from %s: %+v", path, err)
+	}
+	fc, err = parseFileConfig(b)
+	if err != nil {
+		log.Fatalf("invalid config file %s: %+v", path, err)
+	}
+	log.Printf("loaded configuration from %s", path)
+	return fc
+}
+
+// configReloader validates a changed config file for one component, and
+// returns the function that applies it to the next configSnapshot.
+type configReloader func(fc fileConfig) (apply func(s *configSnapshot), err error)
+
+var configReloadsTotal = newCounterVec("registry_proxy_config_reloads_total",
+	"Reloads of the config file by result (ok or error).", "result")
+
+// configWatcher polls the config file and applies changes to the sections
+// that can change at runtime. Kubernetes updates mounted ConfigMaps by
+// swapping a symlink, so the content is compared rather than the
+// modification time.
+type configWatcher struct {
+	path      string
+	interval  time.Duration
+	content   []byte
+	reloaders []configReloader
+	live      *liveConfig
+	// started is the config the proxy started with, and reloadable the
+	// sections, by JSON name, that have a reloader. Changes to any other
+	// section only take effect on restart.
+	started    fileConfig
+	reloadable map[string]bool
+	// restartRequired is 1 while the config file has changes that only
+	// take effect on restart.
+	restartRequired int32
+}
+
+// getConfigWatcher returns the watcher configured by CONFIG_RELOAD_INTERVAL,
+// or nil if reloading is disabled. Changes are published to live.
+func getConfigWatcher(live *liveConfig) *configWatcher {
+	v := os.Getenv("CONFIG_RELOAD_INTERVAL")
+	if v == "" {
+		return nil
+	}
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		log.Fatal("CONFIG_RELOAD_INTERVAL requires CONFIG_FILE")
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < time.Second {
+		log.Fatalf("invalid CONFIG_RELOAD_INTERVAL %q, expected a duration of at least 1s", v)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("could not read config file from %s: %+v", path, err)
+	}
+	started, err := parseFileConfig(b)
+	if err != nil {
+		log.Fatalf("invalid config file %s: %+v", path, err)
+	}
+	w := &configWatcher{path: path, interval: d, content: b, live: live, started: started, reloadable: map[string]bool{}}
+	newGaugeFunc("registry_proxy_config_restart_required",
+		"Whether the config file has changes that only take effect on restart.", func() float64 {
+			return float64(atomic.LoadInt32(&w.restartRequired))
+		})
+	return w
+}
+
+// add registers the reloader of a component for the config file section
+// with the given JSON name.
+func (w *configWatcher) add(section string, r configReloader) {
+	w.reloaders = append(w.reloaders, r)
+	w.reloadable[section] = true
+}
+
+// unreloadedChanges returns the JSON names of the sections of fc that differ
+// from the config the proxy started with but have no reloader, like
+// virtual, or sections that were empty on startup.
+func (w *configWatcher) unreloadedChanges(fc fileConfig) []string {
+	var changed []string
+	started, current := reflect.ValueOf(w.started), reflect.ValueOf(fc)
+	t := current.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if w.reloadable[name] {
+			continue
+		}
+		if !reflect.DeepEqual(started.Field(i).Interface(), current.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// run checks the config file every interval. It never returns.
+func (w *configWatcher) run() {
+	for {
+		time.Sleep(w.interval)
+		w.check()
+	}
+}
+
+// check reloads the config file if it changed. Changes are only applied if
+// every component accepts them, so a bad edit leaves the running
+// configuration intact, and are published as one snapshot, so no request
+// sees some of them without the others.
+func (w *configWatcher) check() {
+	b, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		log.Printf("could not read config file from %s: %+v", w.path, err)
+		return
+	}
+	if bytes.Equal(b, w.content) {
+		return
+	}
+	w.content = b
+	fc, err := parseFileConfig(b)
+	if err != nil {
+		log.Printf("not reloading invalid config file %s: %+v", w.path, err)
+		configReloadsTotal.inc("error")
+		return
+	}
+	var restart int32
+	if changed := w.unreloadedChanges(fc); len(changed) > 0 {
+		log.Printf("restart required: changes to %s in config file %s only take effect on restart", strings.Join(changed, ", "), w.path)
+		restart = 1
+	}
+	atomic.StoreInt32(&w.restartRequired, restart)
+	var apply []func(s *configSnapshot)
+	for _, r := range w.reloaders {
+		f, err := r(fc)
+		if err != nil {
+			log.Printf("not reloading config file %s: %+v", w.path, err)
+			configReloadsTotal.inc("error")
+			return
+		}
+		apply = append(apply, f)
+	}
+	snapshot := w.live.update(func(s *configSnapshot) {
+		for _, f := range apply {
+			f(s)
+		}
+	})
+	configReloadsTotal.inc("ok")
+	log.Printf("reloaded configuration from %s, now at version %d", w.path, snapshot.version)
+	updateConfigFingerprint()
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestConfigWatcherReportsRestartRequired(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	write := func(config string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"cache_policy": [{"kind": "blobs", "max_age": "1h"}], "priority": {"high": ["kube-system/*"]}}`)
+	defer setenv(map[string]string{"CONFIG_FILE": f.Name(), "CONFIG_RELOAD_INTERVAL": "1s"})()
+	w := getConfigWatcher(newLiveConfig())
+	w.add("cache_policy", func(fc fileConfig) (func(*configSnapshot), error) {
+		return func(*configSnapshot) {}, nil
+	})
+
+	tests := []struct {
+		config  string
+		restart bool
+	}{
+		{config: `{"cache_policy": [{"kind": "blobs", "max_age": "2h"}], "priority": {"high": ["kube-system/*"]}}`},
+		{config: `{"cache_policy": [{"kind": "blobs", "max_age": "2h"}], "priority": {"high": ["kube-system/*", "infra/*"]}}`, restart: true},
+		{config: `{"cache_policy": [{"kind": "blobs", "max_age": "2h"}], "priority": {"high": ["kube-system/*"]}}`},
+		{config: `{"priority": {"high": ["kube-system/*"]}, "shadow": {"host": "shadow.example.com"}}`, restart: true},
+	}
+	for _, tt := range tests {
+		write(tt.config)
+		w.check()
+		if got := w.restartRequired == 1; got != tt.restart {
+			t.Errorf("%s: restart required is %v, want %v", tt.config, got, tt.restart)
+		}
+	}
+}
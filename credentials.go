@@ -0,0 +1,158 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultCredentialsTTL = 12 * time.Hour
+
+// dockerCredentials is the credential format of docker credential helpers.
+type dockerCredentials struct {
+	ServerURL string `json:"ServerURL,omitempty"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+	// ExpiresAt is not part of the helper protocol, docker ignores it.
+	ExpiresAt string `json:"ExpiresAt,omitempty"`
+}
+
+// getCredentialsTTL returns the lifetime of credentials minted on
+// /_credentials, configured with CREDENTIALS_TTL.
+func getCredentialsTTL() time.Duration {
+	v := os.Getenv("CREDENTIALS_TTL")
+	if v == "" {
+		return defaultCredentialsTTL
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("invalid CREDENTIALS_TTL %q", v)
+	}
+	return d
+}
+
+// credentialsHandler mints pull credentials that expire after ttl for
+// authenticated users, so long-lived passwords don't have to be stored on
+// developer machines. The username is the user's and the secret is a proxy
+// token, which the proxy accepts as password until it expires. Minting
+// requires the user's password, so credentials can't renew themselves.
+func (ca *clientAuth) credentialsHandler(ttl time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "use POST to request credentials")
+			return
+		}
+		var id *clientIdentity
+		if user, pass, ok := req.BasicAuth(); ok {
+			id = ca.checkPassword(user, pass)
+		}
+		if id == nil {
+			w.Header().Set("Www-Authenticate", `Basic realm="registry-proxy"`)
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid username or password")
+			return
+		}
+		expiry := time.Now().Add(ttl)
+		log.Printf("issued credentials for user %s valid until %s", id.username, expiry.UTC().Format(time.RFC3339))
+		writeJSON(w, http.StatusOK, dockerCredentials{
+			Username:  id.username,
+			Secret:    ca.issueToken(id.username, expiry, nil),
+			ExpiresAt: expiry.UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+// runCredentialHelper implements the docker credential helper protocol for
+// the proxy: "get" reads the registry URL from stdin and prints credentials
+// minted by the proxy's /_credentials endpoint, authenticating with
+// REGISTRY_PROXY_USERNAME and REGISTRY_PROXY_PASSWORD. Credentials are never
+// stored, so "store" and "erase" do nothing. It returns the exit code.
+func runCredentialHelper(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: docker-credential-registry-proxy get|store|erase|list")
+		return 2
+	}
+	switch args[0] {
+	case "get":
+		b, err := ioutil.ReadAll(io.LimitReader(os.Stdin, 4096))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read server url: %+v\n", err)
+			return 1
+		}
+		creds, err := fetchCredentials(strings.TrimSpace(string(b)),
+			os.Getenv("REGISTRY_PROXY_USERNAME"), os.Getenv("REGISTRY_PROXY_PASSWORD"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		creds.ExpiresAt = ""
+		json.NewEncoder(os.Stdout).Encode(creds)
+	case "store", "erase":
+		ioutil.ReadAll(os.Stdin)
+	case "list":
+		fmt.Println("{}")
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+	return 0
+}
+
+// fetchCredentials requests credentials from the proxy at serverURL.
+func fetchCredentials(serverURL, username, password string) (dockerCredentials, error) {
+	var creds dockerCredentials
+	if username == "" || password == "" {
+		return creds, fmt.Errorf("REGISTRY_PROXY_USERNAME and REGISTRY_PROXY_PASSWORD must be set")
+	}
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "https://" + serverURL
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Host == "" {
+		return creds, fmt.Errorf("invalid server url %q", serverURL)
+	}
+	req, err := http.NewRequest(http.MethodPost, u.Scheme+"://"+u.Host+"/_credentials", nil)
+	if err != nil {
+		return creds, err
+	}
+	req.SetBasicAuth(username, password)
+	resp, err := (&http.Client{Timeout: upstreamTimeout}).Do(req)
+	if err != nil {
+		return creds, fmt.Errorf("failed to request credentials from %s: %+v", u.Host, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, defaultMaxTokenResponseSize))
+	if err != nil {
+		return creds, fmt.Errorf("failed to read credentials from %s: %+v", u.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return creds, fmt.Errorf("%s returned status %d: %s", u.Host, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return creds, fmt.Errorf("invalid credentials from %s: %+v", u.Host, err)
+	}
+	creds.ServerURL = serverURL
+	return creds, nil
+}
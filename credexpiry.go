@@ -0,0 +1,231 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// credentialFailureWarning is the number of failed refreshes in a row
+	// after which a warning is logged, at most once a minute.
+	credentialFailureWarning = 3
+	// credentialRetryInterval is the time between refreshes of a
+	// credential after one failed.
+	credentialRetryInterval = 30 * time.Second
+	// credentialExpiryWarning is how long before a credential that can't
+	// be refreshed expires a warning is logged, once an hour.
+	credentialExpiryWarning = 7 * 24 * time.Hour
+	googleCertsURL          = "https://www.googleapis.com/service_accounts/v1/metadata/x509/"
+)
+
+var credentialRefreshesTotal = newCounterVec("registry_proxy_credential_refreshes_total",
+	"Refreshes of the credentials of the proxy by result (ok or error).", "result")
+
+// expiringCredential is implemented by authenticators whose credential
+// expires at a known time.
+type expiringCredential interface {
+	// expiry returns when the current credential expires, or the zero time
+	// if that isn't known yet.
+	expiry() time.Time
+}
+
+// credentialHealth tracks the expiry of a credential and the refreshes that
+// failed since the last one that succeeded.
+type credentialHealth struct {
+	mu       sync.Mutex
+	expires  time.Time
+	failures int
+	warned   time.Time
+}
+
+func (h *credentialHealth) expiry() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.expires
+}
+
+// refreshed records a new credential valid until expires.
+func (h *credentialHealth) refreshed(expires time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expires, h.failures = expires, 0
+	credentialRefreshesTotal.inc("ok")
+}
+
+// failed records a failed refresh, and warns if refreshes keep failing.
+func (h *credentialHealth) failed(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+	credentialRefreshesTotal.inc("error")
+	if h.failures < credentialFailureWarning || time.Since(h.warned) < time.Minute {
+		return
+	}
+	h.warned = time.Now()
+	log.Printf("refreshing credentials failed %d times in a row, %s: %+v", h.failures, describeExpiry(h.expires), err)
+}
+
+// describeExpiry describes how long a credential expiring at t is valid.
+func describeExpiry(t time.Time) string {
+	switch d := time.Until(t).Round(time.Second); {
+	case t.IsZero():
+		return "its expiry is unknown"
+	case d <= 0:
+		return fmt.Sprintf("it expired %s ago", -d)
+	default:
+		return fmt.Sprintf("it expires in %s", d)
+	}
+}
+
+// staticCredential is a credential that the proxy can't refresh, like a
+// service account key or a token in AUTH_HEADER, with a known expiry.
+type staticCredential struct {
+	authenticator
+	credentialHealth
+}
+
+// staticAuthHeader returns auth for an AUTH_HEADER value, which tracks the
+// expiry of JWT bearer tokens.
+func staticAuthHeader(v string) authenticator {
+	if !strings.HasPrefix(v, "Bearer ") {
+		return authHeader(v)
+	}
+	exp, ok := jwtExpiry(strings.TrimPrefix(v, "Bearer "))
+	if !ok {
+		return authHeader(v)
+	}
+	c := &staticCredential{authenticator: authHeader(v)}
+	c.expires = exp
+	return c
+}
+
+// serviceAccountKeyAuth returns auth for a service account key file, and
+// looks up when the key expires from the public certificates of the service
+// account in the background.
+func serviceAccountKeyAuth(auth authenticator, email, keyID string) authenticator {
+	c := &staticCredential{authenticator: auth}
+	if email == "" || keyID == "" {
+		return c
+	}
+	go func() {
+		for i := 0; ; i++ {
+			exp, err := serviceAccountKeyExpiry(email, keyID)
+			if err == nil {
+				c.mu.Lock()
+				c.expires = exp
+				c.mu.Unlock()
+				return
+			}
+			if i == 0 {
+				log.Printf("could not look up the expiry of key %s of %s, retrying hourly: %+v", keyID, email, err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+	return c
+}
+
+// serviceAccountKeyExpiry returns the expiry of the certificate Google
+// publishes for a service account key, which is when the key expires.
+func serviceAccountKeyExpiry(email, keyID string) (time.Time, error) {
+	resp, err := (&http.Client{Timeout: upstreamTimeout}).Get(googleCertsURL + url.PathEscape(email))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("certificates request returned status %d", resp.StatusCode)
+	}
+	var certs map[string]string
+	if err := json.Unmarshal(b, &certs); err != nil {
+		return time.Time{}, fmt.Errorf("invalid certificates response: %+v", err)
+	}
+	block, _ := pem.Decode([]byte(certs[keyID]))
+	if block == nil {
+		return time.Time{}, fmt.Errorf("no certificate for the key, it may have been deleted")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// jwtExpiry returns the exp claim of a JWT.
+func jwtExpiry(jwt string) (time.Time, bool) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+// watchCredentialExpiry exports the time until the credential of auth
+// expires as a gauge, and warns once an hour while a credential that can't
+// be refreshed is about to expire.
+func watchCredentialExpiry(auth authenticator) {
+	c, ok := auth.(expiringCredential)
+	if !ok {
+		return
+	}
+	newGaugeFunc("registry_proxy_upstream_credential_expiry_seconds",
+		"Seconds until the upstream credential expires, negative once it expired and NaN while unknown.", func() float64 {
+			exp := c.expiry()
+			if exp.IsZero() {
+				return math.NaN()
+			}
+			return time.Until(exp).Seconds()
+		})
+	if _, ok := auth.(*staticCredential); !ok {
+		return
+	}
+	go func() {
+		for {
+			if exp := c.expiry(); !exp.IsZero() && time.Until(exp) < credentialExpiryWarning {
+				log.Printf("the upstream credential can't be refreshed and %s, replace it", describeExpiry(exp))
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
@@ -0,0 +1,339 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsLookupTimeout bounds the lookups of the DNS cache, which are shared by
+// all connections waiting for them.
+const dnsLookupTimeout = 10 * time.Second
+
+var dnsLookupsTotal = newCounterVec("registry_proxy_dns_lookups_total",
+	"Upstream host lookups of the DNS cache by result (cached, resolved, stale, failed or pinned).", "result")
+
+// upstreamDialer opens the connections to the upstream registry, its token
+// service and UPSTREAM_PROXY_URL.
+type upstreamDialer struct {
+	dialer *net.Dialer
+	// family is "" to let the dialer race IPv6 and IPv4 addresses (Happy
+	// Eyeballs), "ipv4" or "ipv6" to use only that family, or
+	// "prefer-ipv4" or "prefer-ipv6" to try that family first and the other
+	// one after the fallback delay.
+	family string
+	// dnsServer is the address of the DNS server used instead of the
+	// system's resolver, if set.
+	dnsServer string
+	// cache resolves hosts if UPSTREAM_DNS_CACHE_TTL or UPSTREAM_PINNED_IPS
+	// is set.
+	cache *dnsCache
+}
+
+// getUpstreamDialer returns the dialer configured by UPSTREAM_IP_FAMILY,
+// UPSTREAM_DIAL_FALLBACK_DELAY, UPSTREAM_DNS_SERVER, UPSTREAM_DNS_CACHE_TTL
+// and UPSTREAM_PINNED_IPS.
+func getUpstreamDialer() *upstreamDialer {
+	d := &upstreamDialer{dialer: &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}}
+	switch v := os.Getenv("UPSTREAM_IP_FAMILY"); v {
+	case "", "dual":
+	case "ipv4", "ipv6", "prefer-ipv4", "prefer-ipv6":
+		d.family = v
+	default:
+		log.Fatalf("invalid UPSTREAM_IP_FAMILY %q, expected dual, ipv4, ipv6, prefer-ipv4 or prefer-ipv6", v)
+	}
+	if v := os.Getenv("UPSTREAM_DIAL_FALLBACK_DELAY"); v != "" {
+		delay, err := time.ParseDuration(v)
+		if err != nil || delay <= 0 {
+			log.Fatalf("invalid UPSTREAM_DIAL_FALLBACK_DELAY %q, expected a positive duration like 300ms", v)
+		}
+		d.dialer.FallbackDelay = delay
+	}
+	if v := os.Getenv("UPSTREAM_DNS_SERVER"); v != "" {
+		d.dnsServer = v
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			d.dnsServer = net.JoinHostPort(v, "53")
+		}
+		if host, _, _ := net.SplitHostPort(d.dnsServer); net.ParseIP(host) == nil {
+			log.Fatalf("invalid UPSTREAM_DNS_SERVER %q, expected an IP address with an optional port", v)
+		}
+		d.dialer.Resolver = d.resolver()
+	}
+	ttl := os.Getenv("UPSTREAM_DNS_CACHE_TTL")
+	pinned := os.Getenv("UPSTREAM_PINNED_IPS")
+	if ttl == "" && pinned == "" {
+		return d
+	}
+	d.cache = &dnsCache{resolver: d.resolver(), pinned: map[string][]string{}, entries: map[string]dnsEntry{}}
+	if ttl != "" {
+		t, err := time.ParseDuration(ttl)
+		if err != nil || t <= 0 {
+			log.Fatalf("invalid UPSTREAM_DNS_CACHE_TTL %q, expected a positive duration like 1m", ttl)
+		}
+		d.cache.ttl = t
+	}
+	if pinned != "" {
+		host := getRegistryHost()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		for _, ip := range strings.Split(pinned, ",") {
+			ip = strings.TrimSpace(ip)
+			if net.ParseIP(ip) == nil {
+				log.Fatalf("invalid UPSTREAM_PINNED_IPS %q, expected comma separated IP addresses", pinned)
+			}
+			d.cache.pinned[host] = append(d.cache.pinned[host], ip)
+		}
+	}
+	return d
+}
+
+// describe returns a summary of the settings that differ from the default.
+func (d *upstreamDialer) describe() string {
+	var parts []string
+	if d.family != "" {
+		parts = append(parts, "over "+d.family)
+	}
+	if d.dnsServer != "" {
+		parts = append(parts, "resolving hosts with "+d.dnsServer)
+	}
+	if d.cache != nil && d.cache.ttl > 0 {
+		parts = append(parts, "caching addresses for "+d.cache.ttl.String())
+	}
+	if d.cache != nil {
+		for host, addrs := range d.cache.pinned {
+			parts = append(parts, fmt.Sprintf("pinning %s to %s", host, strings.Join(addrs, ", ")))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// resolver returns the resolver for upstream hosts.
+func (d *upstreamDialer) resolver() *net.Resolver {
+	if d.dnsServer == "" {
+		return net.DefaultResolver
+	}
+	// The system's dialer reaches the DNS server, d.dialer resolves with
+	// this resolver.
+	var dialer net.Dialer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, d.dnsServer)
+		},
+	}
+}
+
+// DialContext connects to addr with the configured address family.
+func (d *upstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil && d.cache != nil && net.ParseIP(host) == nil {
+		return d.dialCached(ctx, host, port)
+	}
+	dial := func(network string) dialFunc {
+		return func(ctx context.Context) (net.Conn, error) { return d.dialer.DialContext(ctx, network, addr) }
+	}
+	switch d.family {
+	case "ipv4":
+		return dial("tcp4")(ctx)
+	case "ipv6":
+		return dial("tcp6")(ctx)
+	case "prefer-ipv4":
+		return d.race(ctx, dial("tcp4"), dial("tcp6"))
+	case "prefer-ipv6":
+		return d.race(ctx, dial("tcp6"), dial("tcp4"))
+	}
+	return d.dialer.DialContext(ctx, network, addr)
+}
+
+// dialCached connects to host with the addresses of the DNS cache, trying
+// the addresses of a family in order.
+func (d *upstreamDialer) dialCached(ctx context.Context, host, port string) (net.Conn, error) {
+	addrs, err := d.cache.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []string
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	dial := func(addrs []string, family string) dialFunc {
+		return func(ctx context.Context) (net.Conn, error) {
+			err := fmt.Errorf("%s has no %s address", host, family)
+			for _, a := range addrs {
+				var conn net.Conn
+				if conn, err = d.dialer.DialContext(ctx, "tcp", net.JoinHostPort(a, port)); err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		}
+	}
+	switch {
+	case d.family == "ipv4":
+		return dial(v4, "IPv4")(ctx)
+	case d.family == "ipv6":
+		return dial(v6, "IPv6")(ctx)
+	case d.family == "prefer-ipv6", d.family == "" && len(v6) > 0 && addrs[0] == v6[0]:
+		return d.race(ctx, dial(v6, "IPv6"), dial(v4, "IPv4"))
+	}
+	return d.race(ctx, dial(v4, "IPv4"), dial(v6, "IPv6"))
+}
+
+type dialFunc func(ctx context.Context) (net.Conn, error)
+
+// race dials with primary, and also with fallback once primary failed or
+// the fallback delay passed. The first connection established is returned,
+// and the error of primary if neither succeeds.
+func (d *upstreamDialer) race(ctx context.Context, primary, fallback dialFunc) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result, 2)
+	dial := func(fn dialFunc, primary bool) {
+		conn, err := fn(ctx)
+		results <- result{conn, err, primary}
+	}
+	go dial(primary, true)
+	delay := d.dialer.FallbackDelay
+	if delay == 0 {
+		delay = 300 * time.Millisecond
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var primaryErr, fallbackErr error
+	started, pending := false, 1
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if !started {
+				started, pending = true, pending+1
+				go dial(fallback, false)
+			}
+			continue
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					// Close the connection of the slower dial, if any.
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			if r.primary {
+				primaryErr = r.err
+				if !started {
+					started, pending = true, pending+1
+					go dial(fallback, false)
+				}
+			} else {
+				fallbackErr = r.err
+			}
+		}
+	}
+	if primaryErr == nil {
+		primaryErr = fallbackErr
+	}
+	return nil, fmt.Errorf("%v (fallback: %v)", primaryErr, fallbackErr)
+}
+
+// dnsCache keeps the addresses of upstream hosts for a fixed time, so bursts
+// of new connections don't each ask the resolver. If the resolver fails,
+// the addresses resolved before are used until it answers again. Pinned
+// hosts are never resolved.
+type dnsCache struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+	pinned   map[string][]string
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+	flights flightGroup
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// lookup returns the addresses of host.
+func (c *dnsCache) lookup(host string) ([]string, error) {
+	if addrs, ok := c.pinned[host]; ok {
+		dnsLookupsTotal.inc("pinned")
+		return addrs, nil
+	}
+	c.mu.Lock()
+	e, cached := c.entries[host]
+	c.mu.Unlock()
+	if cached && time.Now().Before(e.expires) {
+		dnsLookupsTotal.inc("cached")
+		return e.addrs, nil
+	}
+	v, err, _ := c.flights.do(host, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+		defer cancel()
+		return c.resolver.LookupHost(ctx, host)
+	})
+	if err != nil {
+		if cached {
+			dnsLookupsTotal.inc("stale")
+			log.Printf("resolving %s failed, using the addresses resolved before: %+v", host, err)
+			return e.addrs, nil
+		}
+		dnsLookupsTotal.inc("failed")
+		return nil, err
+	}
+	addrs := v.([]string)
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	dnsLookupsTotal.inc("resolved")
+	return addrs, nil
+}
+
+// lookupHost resolves host like connections to the upstream do.
+func (d *upstreamDialer) lookupHost(ctx context.Context, host string) ([]string, error) {
+	if d.cache != nil {
+		return d.cache.lookup(host)
+	}
+	return d.resolver().LookupHost(ctx, host)
+}
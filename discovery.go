@@ -0,0 +1,247 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTokenDiscoveryInterval = 10 * time.Minute
+	// tokenDiscoveryRetryInterval limits how often discovery is retried
+	// while it hasn't succeeded yet, lazily by requests or in the background.
+	tokenDiscoveryRetryInterval = 5 * time.Second
+)
+
+// tokenDiscovery locates the token service of the upstream registry. It
+// doesn't fail if the upstream is unreachable on startup, but retries until
+// it succeeds, and then re-validates the token service every interval so a
+// changed realm is picked up without a restart.
+type tokenDiscovery struct {
+	cfg      registryConfig
+	interval time.Duration
+	// realmHosts are the hosts the token service may be located on, along
+	// with their subdomains. Clients' credentials are sent there, so a realm
+	// elsewhere is rejected rather than trusted.
+	realmHosts realmAllowlist
+	// bypass, if set, lets requests through before the token service is
+	// discovered while it returns true, like during maintenance, when they
+	// don't reach the upstream.
+	bypass func() bool
+	// disabled skips discovery for anonymous upstreams, which have no token
+	// service to proxy.
+	disabled bool
+
+	// attempt serializes discovery attempts, so a burst of requests while
+	// the upstream is down causes one attempt rather than one each.
+	attempt     sync.Mutex
+	lastAttempt time.Time
+
+	mu         sync.RWMutex
+	endpoint   string
+	service    string
+	discovered bool
+}
+
+// newTokenDiscovery attempts the first discovery before it returns, and
+// reads the re-validation interval from TOKEN_DISCOVERY_INTERVAL. Discovery
+// is disabled for anonymous upstreams.
+func newTokenDiscovery(cfg registryConfig) *tokenDiscovery {
+	if cfg.anonymous {
+		return &tokenDiscovery{cfg: cfg, disabled: true}
+	}
+	d := &tokenDiscovery{cfg: cfg, interval: defaultTokenDiscoveryInterval, realmHosts: getTokenRealmHosts(cfg)}
+	if v := os.Getenv("TOKEN_DISCOVERY_INTERVAL"); v != "" {
+		i, err := time.ParseDuration(v)
+		if err != nil || i < time.Second {
+			log.Fatalf("invalid TOKEN_DISCOVERY_INTERVAL %q, expected a duration of at least 1s", v)
+		}
+		d.interval = i
+	}
+	d.retry()
+	return d
+}
+
+// current returns the token endpoint and service, and false if they haven't
+// been discovered yet.
+func (d *tokenDiscovery) current() (string, string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.endpoint, d.service, d.discovered
+}
+
+// retry runs discovery unless it succeeded already or was attempted less
+// than tokenDiscoveryRetryInterval ago, and reports whether the token
+// service is known.
+func (d *tokenDiscovery) retry() bool {
+	if d.disabled {
+		return true
+	}
+	if _, _, ok := d.current(); ok {
+		return true
+	}
+	d.attempt.Lock()
+	defer d.attempt.Unlock()
+	if _, _, ok := d.current(); ok {
+		return true
+	}
+	if time.Since(d.lastAttempt) < tokenDiscoveryRetryInterval {
+		return false
+	}
+	d.lastAttempt = time.Now()
+	return d.refresh()
+}
+
+// refresh runs discovery and stores its result. A failed re-validation keeps
+// the token service discovered before.
+func (d *tokenDiscovery) refresh() bool {
+	endpoint, service, err := discoverTokenService(d.cfg)
+	if err == nil {
+		err = d.realmHosts.check(endpoint)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		if d.discovered {
+			log.Printf("re-validating the token endpoint failed, keeping %s: %+v", d.endpoint, err)
+		} else {
+			log.Printf("target registry's token endpoint could not be discovered, retrying: %+v", err)
+		}
+		return d.discovered
+	}
+	switch {
+	case !d.discovered:
+		log.Printf("discovered token endpoint for backend registry: %s", endpoint)
+	case endpoint != d.endpoint || service != d.service:
+		log.Printf("token endpoint of backend registry changed from %s to %s", d.endpoint, endpoint)
+	}
+	d.endpoint, d.service, d.discovered = endpoint, service, true
+	return true
+}
+
+// realmAllowlist lists the hosts a token service may be located on. Each
+// host also allows its subdomains.
+type realmAllowlist struct {
+	hosts []string
+	// allowHTTP accepts realms without TLS, which would send credentials in
+	// the clear. It is only meant for test setups.
+	allowHTTP bool
+}
+
+// knownRealmHosts are the token service hosts of public registries that
+// don't serve it on the registry host.
+var knownRealmHosts = map[string]string{
+	"docker.io":            "auth.docker.io",
+	"index.docker.io":      "auth.docker.io",
+	"registry-1.docker.io": "auth.docker.io",
+}
+
+// getTokenRealmHosts returns the hosts the token service of the upstream in
+// cfg may be located on: the registry host, the token host of the registry
+// profile, the token service of well-known registries like auth.docker.io
+// for Docker Hub, and the comma separated hosts in TOKEN_REALM_HOSTS. Realms
+// must use https unless TOKEN_REALM_ALLOW_HTTP is set.
+func getTokenRealmHosts(cfg registryConfig) realmAllowlist {
+	name := hostName(cfg.host)
+	hosts := []string{name}
+	if h, ok := knownRealmHosts[name]; ok {
+		hosts = append(hosts, h)
+	}
+	if cfg.profile.tokenHost != "" {
+		hosts = append(hosts, hostName(cfg.profile.tokenHost))
+	}
+	if v := os.Getenv("TOKEN_REALM_HOSTS"); v != "" {
+		n := len(hosts)
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.ToLower(strings.Trim(strings.TrimSpace(h), ".")); h != "" {
+				hosts = append(hosts, h)
+			}
+		}
+		if len(hosts) == n {
+			log.Fatalf("invalid TOKEN_REALM_HOSTS %q, expected a comma separated list of hosts", v)
+		}
+	}
+	l := realmAllowlist{hosts: hosts, allowHTTP: os.Getenv("TOKEN_REALM_ALLOW_HTTP") != ""}
+	if l.allowHTTP {
+		log.Printf("accepting token realms without TLS, credentials may be sent in the clear")
+	}
+	return l
+}
+
+// hostName returns the lower-case name of host without its port.
+func hostName(host string) string {
+	name := strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+	return strings.Trim(name, "[]")
+}
+
+// check returns an error unless realm is an https URL and its host is one of
+// the hosts or a subdomain of one.
+func (l realmAllowlist) check(realm string) error {
+	u, err := url.Parse(realm)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid token realm %q", realm)
+	}
+	if u.Scheme != "https" && !(l.allowHTTP && u.Scheme == "http") {
+		return fmt.Errorf("token realm %s does not use https, set TOKEN_REALM_ALLOW_HTTP to allow it", realm)
+	}
+	name := strings.ToLower(u.Hostname())
+	for _, h := range l.hosts {
+		if name == h || strings.HasSuffix(name, "."+h) {
+			return nil
+		}
+	}
+	return fmt.Errorf("token realm %s is not on an allowed host (%s), set TOKEN_REALM_HOSTS to allow it",
+		realm, strings.Join(l.hosts, ", "))
+}
+
+// run retries discovery until it succeeds, and then re-validates it every
+// interval. It never returns.
+func (d *tokenDiscovery) run() {
+	if d.disabled {
+		return
+	}
+	for !d.retry() {
+		time.Sleep(tokenDiscoveryRetryInterval)
+	}
+	for {
+		time.Sleep(d.interval)
+		d.refresh()
+	}
+}
+
+// middleware answers 503 until the token service is discovered, since
+// clients could not authenticate against the proxy before.
+func (d *tokenDiscovery) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if (d.bypass == nil || !d.bypass()) && !d.retry() {
+			w.Header().Set("Retry-After", "5")
+			writeRegistryError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "the upstream registry could not be reached yet")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import "testing"
+
+func TestRealmAllowlistCheck(t *testing.T) {
+	tests := []struct {
+		realm     string
+		allowHTTP bool
+		ok        bool
+	}{
+		{realm: "https://auth.docker.io/token", ok: true},
+		{realm: "https://registry.example.com/token", ok: true},
+		{realm: "https://eu.auth.docker.io/token", ok: true},
+		{realm: "https://evil.example/token", ok: false},
+		{realm: "https://auth.docker.io.evil.example/token", ok: false},
+		{realm: "http://auth.docker.io/token", ok: false},
+		{realm: "http://auth.docker.io/token", allowHTTP: true, ok: true},
+		{realm: "ftp://auth.docker.io/token", allowHTTP: true, ok: false},
+		{realm: "auth.docker.io/token", ok: false},
+	}
+	for _, tt := range tests {
+		l := realmAllowlist{hosts: []string{"registry.example.com", "auth.docker.io"}, allowHTTP: tt.allowHTTP}
+		if err := l.check(tt.realm); (err == nil) != tt.ok {
+			t.Errorf("check(%q) with allowHTTP=%v = %v, want ok=%v", tt.realm, tt.allowHTTP, err, tt.ok)
+		}
+	}
+}
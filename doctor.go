@@ -0,0 +1,299 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// doctorCertExpiryWarning is how long before the expiry of the
+	// upstream's certificate the doctor warns about it.
+	doctorCertExpiryWarning = 14 * 24 * time.Hour
+	// doctorClockSkewWarning and doctorClockSkewError bound the difference
+	// between the local clock and the upstream's. Tokens are issued with
+	// the clock of the token service, so a large skew makes them look
+	// expired or not yet valid.
+	doctorClockSkewWarning = 30 * time.Second
+	doctorClockSkewError   = 5 * time.Minute
+)
+
+// doctorReport prints the results of the checks of the doctor command.
+type doctorReport struct {
+	failed int
+}
+
+func (r *doctorReport) ok(check, format string, v ...interface{}) {
+	fmt.Printf("OK    %-12s %s\n", check, fmt.Sprintf(format, v...))
+}
+
+func (r *doctorReport) warn(check, format string, v ...interface{}) {
+	fmt.Printf("WARN  %-12s %s\n", check, fmt.Sprintf(format, v...))
+}
+
+func (r *doctorReport) fail(check, format string, v ...interface{}) {
+	r.failed++
+	fmt.Printf("FAIL  %-12s %s\n", check, fmt.Sprintf(format, v...))
+}
+
+func (r *doctorReport) skip(check, format string, v ...interface{}) {
+	fmt.Printf("SKIP  %-12s %s\n", check, fmt.Sprintf(format, v...))
+}
+
+// runDoctor implements the "doctor" command: it checks what the proxy
+// needs from its environment, configured like the server, and prints a
+// report: DNS resolution and the TLS certificate of the upstream, the token
+// service, the credentials, whether the cache can be written and the skew
+// between the local clock and the upstream's. It returns the exit code, 1 if
+// a check failed. The log, which explains invalid configuration, goes to
+// stderr as usual.
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	image := fs.String("image", os.Getenv("SELF_CHECK_IMAGE"), "image the credentials must be allowed to pull, like SELF_CHECK_IMAGE")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	host := getRegistryHost()
+	rules, err := parseRepoRules(os.Getenv("REPO_RULES"), host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid REPO_RULES: %+v\n", err)
+		return 2
+	}
+	cfg := registryConfig{
+		host:         host,
+		repoPrefix:   strings.Trim(os.Getenv("REPO_PREFIX"), "/"),
+		rules:        rules,
+		maxTokenSize: getSizeEnv("MAX_TOKEN_RESPONSE_SIZE", defaultMaxTokenResponseSize),
+		profile:      getRegistryProfile(host),
+		anonymous:    os.Getenv("AUTH_MODE") == "none",
+	}
+	cfg.transport = cfg.profile.wrapTransport(cfg.host, getUpstreamTransport())
+	auth := getAuthData(nil)
+	r := &doctorReport{}
+	fmt.Printf("checking upstream registry %s\n", host)
+
+	r.checkDNS(host)
+	date, reachable := r.checkTLS(cfg)
+	if reachable {
+		r.checkTokenService(cfg)
+		r.checkCredentials(cfg, auth, *image)
+	} else {
+		r.skip("token", "the upstream can't be reached")
+		r.skip("credentials", "the upstream can't be reached")
+	}
+	r.checkCache(auth)
+	r.checkClock(date)
+
+	if r.failed > 0 {
+		fmt.Printf("%d checks failed\n", r.failed)
+		return 1
+	}
+	fmt.Println("all checks passed")
+	return 0
+}
+
+// checkDNS resolves the upstream host like the proxy does.
+func (r *doctorReport) checkDNS(host string) {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+	addrs, err := getUpstreamDialer().lookupHost(ctx, name)
+	switch {
+	case err != nil && os.Getenv("UPSTREAM_PROXY_URL") != "":
+		r.warn("dns", "%s does not resolve locally, which is fine if UPSTREAM_PROXY_URL resolves it: %v", name, err)
+	case err != nil:
+		r.fail("dns", "%s does not resolve: %v", name, err)
+	default:
+		r.ok("dns", "%s resolves to %s", name, strings.Join(addrs, ", "))
+	}
+}
+
+// checkTLS connects to /v2/ of the upstream and verifies its certificate
+// chain. It returns the Date header of the response, or the zero time, and
+// whether the upstream answered at all.
+func (r *doctorReport) checkTLS(cfg registryConfig) (time.Time, bool) {
+	client := &http.Client{Transport: cfg.transport, Timeout: upstreamTimeout}
+	resp, err := client.Get(fmt.Sprintf("https://%s/v2/", cfg.host))
+	if err != nil {
+		if strings.Contains(err.Error(), "x509") {
+			r.fail("tls", "the certificate of %s is not trusted, set UPSTREAM_CA_FILE for a private CA: %v", cfg.host, err)
+		} else {
+			r.fail("tls", "could not connect to %s: %v", cfg.host, err)
+		}
+		return time.Time{}, false
+	}
+	resp.Body.Close()
+	if resp.TLS == nil || len(resp.TLS.VerifiedChains) == 0 {
+		r.fail("tls", "%s did not present a verified certificate chain", cfg.host)
+	} else {
+		chain := resp.TLS.VerifiedChains[0]
+		leaf := chain[0]
+		var expiring *x509.Certificate
+		for _, c := range chain {
+			if expiring == nil || c.NotAfter.Before(expiring.NotAfter) {
+				expiring = c
+			}
+		}
+		desc := fmt.Sprintf("%s issued by %s, valid until %s", certName(leaf), certName(chain[len(chain)-1]),
+			expiring.NotAfter.UTC().Format(time.RFC3339))
+		if time.Until(expiring.NotAfter) < doctorCertExpiryWarning {
+			r.warn("tls", "%s, renew %s soon", desc, certName(expiring))
+		} else {
+			r.ok("tls", "%s", desc)
+		}
+	}
+	date, _ := http.ParseTime(resp.Header.Get("Date"))
+	return date, true
+}
+
+// certName returns the common name of the subject of c, or its organization
+// or first DNS name if it has none.
+func certName(c *x509.Certificate) string {
+	switch {
+	case c.Subject.CommonName != "":
+		return c.Subject.CommonName
+	case len(c.Subject.Organization) > 0:
+		return c.Subject.Organization[0]
+	case len(c.DNSNames) > 0:
+		return c.DNSNames[0]
+	}
+	return c.Subject.String()
+}
+
+// checkTokenService discovers the token service like the proxy does on
+// startup.
+func (r *doctorReport) checkTokenService(cfg registryConfig) {
+	if cfg.anonymous {
+		r.skip("token", "AUTH_MODE=none doesn't use the token service")
+		return
+	}
+	endpoint, service, err := discoverTokenService(cfg)
+	if err == nil {
+		err = getTokenRealmHosts(cfg).check(endpoint)
+	}
+	if err != nil {
+		r.fail("token", "%v", err)
+		return
+	}
+	r.ok("token", "realm %s, service %q", endpoint, service)
+}
+
+// checkCredentials gets a token for /v2/ with the proxy's credentials, and
+// checks that image can be pulled with them if set.
+func (r *doctorReport) checkCredentials(cfg registryConfig, auth authenticator, image string) {
+	desc := "anonymous access"
+	if auth != nil {
+		desc = "the proxy's credentials"
+	}
+	up := newUpstreamClient(cfg, auth)
+	resp, err := up.do(http.MethodGet, fmt.Sprintf("https://%s/v2/", cfg.host), "", "")
+	if err != nil {
+		r.fail("credentials", "%s rejected: %v", desc, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.fail("credentials", "%s rejected, the upstream answered /v2/ with status %d", desc, resp.StatusCode)
+		return
+	}
+	if image == "" {
+		r.ok("credentials", "%s accepted (set -image to check pulling an image)", desc)
+		return
+	}
+	name, reference, err := parseReference(image, cfg.host)
+	if err != nil {
+		r.fail("credentials", "invalid -image: %v", err)
+		return
+	}
+	c := &selfCheck{up: up, image: image, name: name, reference: reference}
+	if err := c.pull(); err != nil {
+		r.fail("credentials", "%v", err)
+		return
+	}
+	r.ok("credentials", "%s can pull %s", desc, image)
+}
+
+// checkCache writes, reads back and deletes an object in the cache.
+func (r *doctorReport) checkCache(auth authenticator) {
+	if os.Getenv("CACHE_URL") == "" {
+		r.skip("cache", "CACHE_URL not set")
+		return
+	}
+	c := getBlobCache(auth)
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+	hostname, _ := os.Hostname()
+	key := fmt.Sprintf("%sdoctor/%s-%d", c.prefix, hostname, time.Now().UnixNano())
+	content := []byte("written by gcr-proxy doctor")
+	if err := c.store.put(ctx, key, bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		r.fail("cache", "could not write %s: %v", key, err)
+		return
+	}
+	obj, err := c.store.get(ctx, key)
+	if err != nil {
+		r.fail("cache", "could not read back %s: %v", key, err)
+		return
+	}
+	b, err := ioutil.ReadAll(obj.body)
+	obj.body.Close()
+	if err != nil || !bytes.Equal(b, content) {
+		r.fail("cache", "%s was not read back as written: %v", key, err)
+		return
+	}
+	if l, ok := c.store.(objectLister); ok {
+		if err := l.delete(ctx, key); err != nil {
+			r.warn("cache", "%s is writable, but %s could not be deleted: %v", os.Getenv("CACHE_URL"), key, err)
+			return
+		}
+	}
+	r.ok("cache", "%s is writable", os.Getenv("CACHE_URL"))
+}
+
+// checkClock compares the local clock with the Date header of the upstream.
+func (r *doctorReport) checkClock(upstream time.Time) {
+	if upstream.IsZero() {
+		r.skip("clock", "the upstream did not send its time")
+		return
+	}
+	// The Date header has a resolution of one second.
+	skew := time.Since(upstream).Round(time.Second)
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+	switch {
+	case abs > doctorClockSkewError:
+		r.fail("clock", "the local clock is %s off the upstream's, tokens will be rejected", skew)
+	case abs > doctorClockSkewWarning:
+		r.warn("clock", "the local clock is %s off the upstream's", skew)
+	default:
+		r.ok("clock", "the local clock is within %s of the upstream's", doctorClockSkewWarning)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type registryErrors struct {
+	Errors []registryError `json:"errors"`
+}
+
+// registryErrorResponse builds a response carrying a Distribution-spec error
+// body, used when the proxy answers a request in place of the upstream.
+func registryErrorResponse(req *http.Request, status int, code, message string) *http.Response {
+	b, _ := json.Marshal(registryErrors{Errors: []registryError{{Code: code, Message: message}}})
+	h := http.Header{"Content-Type": {"application/json; charset=utf-8"}}
+	return newResponse(req, status, h, ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)))
+}
+
+// newResponse builds a response to req generated by the proxy itself. length
+// is the size of body, or -1 if unknown.
+func newResponse(req *http.Request, status int, h http.Header, body io.ReadCloser, length int64) *http.Response {
+	if length >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          body,
+		ContentLength: length,
+		Request:       req,
+	}
+}
+
+// upstreamErrorCode returns the Distribution-spec error code for an error
+// status of the upstream on a request for kind ("manifests", "blobs", ...).
+func upstreamErrorCode(status int, kind string) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "UNAUTHORIZED"
+	case status == http.StatusForbidden:
+		return "DENIED"
+	case status == http.StatusNotFound && kind == "manifests":
+		return "MANIFEST_UNKNOWN"
+	case status == http.StatusNotFound && kind == "blobs":
+		return "BLOB_UNKNOWN"
+	case status == http.StatusNotFound:
+		return "NAME_UNKNOWN"
+	case status == http.StatusTooManyRequests:
+		return "TOOMANYREQUESTS"
+	case status == http.StatusMethodNotAllowed:
+		return "UNSUPPORTED"
+	case status >= http.StatusInternalServerError:
+		return "UNAVAILABLE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// normalizeErrorResponse replaces the body of error responses from the
+// upstream that are not JSON, like HTML error pages of load balancers, with a
+// Distribution-spec error body, so clients show a meaningful message. Headers
+// like WWW-Authenticate and Retry-After are kept.
+func normalizeErrorResponse(resp *http.Response) *http.Response {
+	if resp.StatusCode < http.StatusBadRequest || resp.Request.Method == http.MethodHead ||
+		strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return resp
+	}
+	var kind string
+	if rr, ok := parseRegistryPath(resp.Request.URL.Path); ok {
+		kind = rr.kind
+	}
+	resp.Body.Close()
+	out := registryErrorResponse(resp.Request, resp.StatusCode, upstreamErrorCode(resp.StatusCode, kind),
+		fmt.Sprintf("upstream registry returned %s", resp.Status))
+	for k, v := range resp.Header {
+		if _, ok := out.Header[k]; !ok && k != "Content-Encoding" && k != "Transfer-Encoding" {
+			out.Header[k] = v
+		}
+	}
+	return out
+}
+
+// writeRegistryError writes a Distribution-spec error body to w.
+func writeRegistryError(w http.ResponseWriter, status int, code, message string) {
+	b, _ := json.Marshal(registryErrors{Errors: []registryError{{Code: code, Message: message}}})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultStripResponseHeaders are headers of the upstream's backends, like
+// Google Cloud Storage, that mean nothing to clients of the proxy. Alt-Svc
+// would advertise the upstream's protocols for the proxy's host.
+const defaultStripResponseHeaders = "X-Goog-*,X-GUploader-*,X-Cloud-Trace-Context,Alt-Svc"
+
+var digestHeaderMismatchesTotal = newCounterVec("registry_proxy_digest_header_mismatches_total",
+	"Upstream responses whose Docker-Content-Digest header differed from the requested digest, by kind (manifests or blobs).",
+	"kind")
+
+// getStripResponseHeaders returns the headers removed from upstream
+// responses, from STRIP_RESPONSE_HEADERS, a comma separated list of header
+// names where a trailing * matches any suffix. "none" keeps all headers.
+func getStripResponseHeaders() []string {
+	v := os.Getenv("STRIP_RESPONSE_HEADERS")
+	if v == "" {
+		v = defaultStripResponseHeaders
+	} else if v == "none" {
+		return nil
+	}
+	var headers []string
+	for _, h := range strings.Split(v, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, http.CanonicalHeaderKey(h))
+		}
+	}
+	return headers
+}
+
+// checkResponseHeaders makes the headers of an upstream response consistent
+// with the request the client sent: responses for a digest must carry that
+// digest in Docker-Content-Digest, or are rejected, Location headers
+// pointing to the upstream's registry API are made relative with the
+// repository names clients know, like pagination links, and the headers in
+// cfg.stripHeaders are removed.
+func checkResponseHeaders(resp *http.Response, cfg registryConfig) *http.Response {
+	req := resp.Request
+	rr, ok := parseRegistryPath(req.URL.Path)
+	if ok && (rr.kind == "manifests" || rr.kind == "blobs") && isDigest(rr.reference) &&
+		(resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent) &&
+		(req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		if got := resp.Header.Get("Docker-Content-Digest"); got == "" {
+			resp.Header.Set("Docker-Content-Digest", rr.reference)
+		} else if got != rr.reference {
+			digestHeaderMismatchesTotal.inc(rr.kind)
+			log.Printf("upstream answered with the wrong digest, rejecting response: url=%s expected=%s got=%s", req.URL, rr.reference, got)
+			resp.Body.Close()
+			return registryErrorResponse(req, http.StatusBadGateway, "DIGEST_INVALID",
+				fmt.Sprintf("the upstream registry answered with %s instead of %s", got, rr.reference))
+		}
+	}
+	if loc := resp.Header.Get("Location"); loc != "" {
+		if u, err := req.URL.Parse(loc); err == nil && canonicalHost(u.Host) == canonicalHost(req.URL.Host) {
+			if lr, ok := parseRegistryPath(u.Path); ok {
+				if name, ok := cfg.clientName(lr.name); ok {
+					u.Path = fmt.Sprintf("/v2/%s/%s/%s", name, lr.kind, lr.reference)
+					u.Scheme, u.Host, u.RawPath = "", "", ""
+					resp.Header.Set("Location", u.String())
+				}
+			}
+		}
+	}
+	for _, h := range cfg.stripHeaders {
+		if !strings.HasSuffix(h, "*") {
+			resp.Header.Del(h)
+			continue
+		}
+		for k := range resp.Header {
+			if strings.HasPrefix(k, strings.TrimSuffix(h, "*")) {
+				delete(resp.Header, k)
+			}
+		}
+	}
+	return resp
+}
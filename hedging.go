@@ -0,0 +1,157 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+var hedgedRequestsTotal = newCounterVec("registry_proxy_hedged_requests_total",
+	"Hedged upstream requests by whether they answered before the original request (won or lost).", "result")
+
+// hedgingTransport sends a second, hedged request for small registry API
+// requests that the upstream hasn't answered after delay, and uses the
+// response that arrives first. This cuts the tail latency of occasional slow
+// upstream responses at the cost of a few duplicate requests.
+type hedgingTransport struct {
+	base  http.RoundTripper
+	delay time.Duration
+}
+
+// getHedgingTransport wraps t with hedging after HEDGE_DELAY, or returns t
+// if hedging is disabled.
+func getHedgingTransport(t http.RoundTripper) http.RoundTripper {
+	v := os.Getenv("HEDGE_DELAY")
+	if v == "" {
+		return t
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("invalid HEDGE_DELAY %q", v)
+	}
+	log.Printf("hedging manifest and HEAD requests not answered within %s", d)
+	return &hedgingTransport{base: t, delay: d}
+}
+
+// hedgeable reports whether req is a manifest request or a HEAD request for
+// a blob, which are small and safe to repeat.
+func hedgeable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	rr, ok := parseRegistryPath(req.URL.Path)
+	if !ok {
+		return false
+	}
+	return rr.kind == "manifests" || (rr.kind == "blobs" && req.Method == http.MethodHead)
+}
+
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	hedged bool
+}
+
+func (t *hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !hedgeable(req) {
+		return t.base.RoundTrip(req)
+	}
+	results := make(chan hedgeResult, 2)
+	var cancels [2]context.CancelFunc
+	send := func(hedged bool) {
+		r := req
+		i := 0
+		if hedged {
+			i = 1
+			// Transports may modify the headers of a request, so the hedge
+			// gets its own copy.
+			r = new(http.Request)
+			*r = *req
+			r.Header = make(http.Header, len(req.Header))
+			for k, v := range req.Header {
+				r.Header[k] = append([]string(nil), v...)
+			}
+		}
+		var ctx context.Context
+		ctx, cancels[i] = context.WithCancel(req.Context())
+		r = r.WithContext(ctx)
+		go func() {
+			resp, err := t.base.RoundTrip(r)
+			results <- hedgeResult{resp: resp, err: err, hedged: hedged}
+		}()
+	}
+	send(false)
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+	inflight := 1
+	for {
+		select {
+		case <-timer.C:
+			inflight++
+			send(true)
+		case res := <-results:
+			inflight--
+			winner, loser := 0, 1
+			if res.hedged {
+				winner, loser = 1, 0
+			}
+			if res.err != nil {
+				cancels[winner]()
+				if inflight > 0 {
+					// The other request may still succeed.
+					continue
+				}
+				return nil, res.err
+			}
+			if inflight > 0 {
+				cancels[loser]()
+				go discardHedge(results)
+			}
+			if res.hedged {
+				hedgedRequestsTotal.inc("won")
+			} else if inflight > 0 {
+				hedgedRequestsTotal.inc("lost")
+			}
+			res.resp.Body = &cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[winner]}
+			res.resp.Request = req
+			return res.resp, nil
+		}
+	}
+}
+
+// discardHedge closes the response of the request that lost the race.
+func discardHedge(results <-chan hedgeResult) {
+	if res := <-results; res.err == nil {
+		res.resp.Body.Close()
+	}
+}
+
+// cancelOnClose releases the context of a request once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
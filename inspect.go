@@ -0,0 +1,186 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// descriptor references content in a registry.
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// imageManifest has the fields of OCI and Docker image manifests that the
+// proxy reads.
+type imageManifest struct {
+	Config descriptor   `json:"config"`
+	Layers []descriptor `json:"layers"`
+}
+
+// imageConfig has the fields of image configuration blobs that the proxy
+// reads.
+type imageConfig struct {
+	Created string `json:"created"`
+	imagePlatform
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// imageSummary describes an image for one platform, or a multi-platform
+// image index.
+type imageSummary struct {
+	Platform  string `json:"platform,omitempty"`
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType,omitempty"`
+	// Size is the size of the manifest, config and layers.
+	Size    int64             `json:"size"`
+	Created string            `json:"created,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Layers  []descriptor      `json:"layers,omitempty"`
+}
+
+type inspectResponse struct {
+	Image string `json:"image"`
+	imageSummary
+	Platforms []imageSummary `json:"platforms,omitempty"`
+}
+
+// inspectHandler answers GET <prefix><name>:<tag> with a summary of the
+// image: its size, layers, labels and creation date, for every platform of
+// multi-platform images, so tools can inspect images without parsing
+// manifests and configs themselves. Images are only inspected if access
+// allows the client to pull them.
+func inspectHandler(up *upstreamClient, access imageAccess, prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "use GET to inspect images")
+			return
+		}
+		image := strings.TrimPrefix(r.URL.Path, prefix)
+		name, reference, err := parseReference(image, r.Host)
+		if err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+			return
+		}
+		if d := up.cfg.denial(name); d != nil {
+			d.writeTo(w, r, name)
+			return
+		}
+		if !access.allowPull(w, r, name, reference) {
+			return
+		}
+		info, b, err := up.getManifest(name, reference)
+		if err != nil {
+			log.Printf("inspect: lookup of %s failed: %+v", image, err)
+			writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", err.Error())
+			return
+		}
+		if !info.Exists {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", fmt.Sprintf("%s:%s not found", name, reference))
+			return
+		}
+		out := inspectResponse{Image: image}
+		var idx imageIndex
+		if err := json.Unmarshal(b, &idx); err != nil {
+			writeRegistryError(w, http.StatusBadGateway, "MANIFEST_INVALID", fmt.Sprintf("invalid manifest %s: %+v", image, err))
+			return
+		}
+		if len(idx.Manifests) == 0 {
+			out.imageSummary, err = up.summarize(name, info, b)
+		} else {
+			out.imageSummary = imageSummary{Digest: info.Digest, MediaType: info.MediaType, Size: info.Size}
+			for _, m := range idx.Manifests {
+				var s imageSummary
+				if s, err = up.inspectManifest(name, m.Digest); err != nil {
+					break
+				}
+				if m.Platform != nil {
+					s.Platform = m.Platform.String()
+				}
+				out.Platforms = append(out.Platforms, s)
+				out.Size += s.Size
+			}
+		}
+		if err != nil {
+			log.Printf("inspect: %s failed: %+v", image, err)
+			writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// inspectManifest summarizes the image manifest with the given digest.
+func (u *upstreamClient) inspectManifest(name, digest string) (imageSummary, error) {
+	info, b, err := u.getManifest(name, digest)
+	if err != nil {
+		return imageSummary{}, err
+	}
+	if !info.Exists {
+		return imageSummary{}, fmt.Errorf("manifest %s@%s not found", name, digest)
+	}
+	return u.summarize(name, info, b)
+}
+
+// summarize describes the image manifest b, reading its config blob.
+func (u *upstreamClient) summarize(name string, info manifestInfo, b []byte) (imageSummary, error) {
+	s := imageSummary{Digest: info.Digest, MediaType: info.MediaType, Size: info.Size}
+	var m imageManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return s, fmt.Errorf("invalid manifest %s@%s: %+v", name, info.Digest, err)
+	}
+	s.Layers = m.Layers
+	s.Size += m.Config.Size
+	for _, l := range m.Layers {
+		s.Size += l.Size
+	}
+	if m.Config.Digest == "" {
+		return s, nil
+	}
+	resp, err := u.get(http.MethodGet, name, "blobs", m.Config.Digest, "")
+	if err != nil {
+		return s, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s, fmt.Errorf("upstream returned status %d for config %s@%s", resp.StatusCode, name, m.Config.Digest)
+	}
+	cb, err := ioutil.ReadAll(io.LimitReader(resp.Body, u.cfg.maxManifestSize))
+	if err != nil {
+		return s, fmt.Errorf("failed to read config %s@%s: %+v", name, m.Config.Digest, err)
+	}
+	var c imageConfig
+	if err := json.Unmarshal(cb, &c); err != nil {
+		// Artifacts have configs that aren't image configs.
+		return s, nil
+	}
+	s.Created, s.Labels = c.Created, c.Config.Labels
+	if c.OS != "" {
+		s.Platform = c.imagePlatform.String()
+	}
+	return s, nil
+}
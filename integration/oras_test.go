@@ -0,0 +1,391 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package integration pushes and pulls OCI artifacts through a proxy binary
+// with oras-go. It is a separate module so that the proxy itself keeps
+// building with old Go versions; run it with "go test ./..." in this
+// directory.
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+const artifactManifestType = "application/vnd.oci.artifact.manifest.v1+json"
+
+// proxyBinary is built once by TestMain.
+var proxyBinary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "gcr-proxy-integration")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	proxyBinary = filepath.Join(dir, "gcr-proxy")
+	build := exec.Command("go", "build", "-o", proxyBinary, ".")
+	build.Dir = ".."
+	build.Stdout, build.Stderr = os.Stderr, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to build the proxy: %+v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// registry is an in-memory upstream registry. Like real registries, it only
+// serves a manifest if its media type is accepted by the client.
+type registry struct {
+	mu        sync.Mutex
+	manifests map[string]stored
+	blobs     map[string][]byte
+	uploads   map[string][]byte
+	accepts   []string
+}
+
+type stored struct {
+	mediaType string
+	body      []byte
+}
+
+func newRegistry() *registry {
+	return &registry{manifests: map[string]stored{}, blobs: map[string][]byte{}, uploads: map[string][]byte{}}
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == "" {
+		return
+	}
+	switch {
+	case strings.Contains(path, "/blobs/uploads/"):
+		r.upload(w, req, path)
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		name, ref := path[:i], path[i+len("/manifests/"):]
+		r.manifest(w, req, name, ref)
+	case strings.Contains(path, "/blobs/"):
+		b, ok := r.blobs[path[strings.LastIndex(path, "/")+1:]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UNKNOWN")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		serve(w, req, b)
+	default:
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN")
+	}
+}
+
+func (r *registry) manifest(w http.ResponseWriter, req *http.Request, name, ref string) {
+	if req.Method == http.MethodPut {
+		b, _ := io.ReadAll(req.Body)
+		m := stored{mediaType: req.Header.Get("Content-Type"), body: b}
+		r.manifests[name+"@"+ref] = m
+		r.manifests[name+"@"+digest.FromBytes(b).String()] = m
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(b).String())
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	m, ok := r.manifests[name+"@"+ref]
+	if !ok {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+		return
+	}
+	accept := strings.Join(req.Header.Values("Accept"), ",")
+	r.accepts = append(r.accepts, accept)
+	if !strings.Contains(accept, m.mediaType) {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+		return
+	}
+	w.Header().Set("Content-Type", m.mediaType)
+	serve(w, req, m.body)
+}
+
+// upload implements POST-PUT uploads.
+func (r *registry) upload(w http.ResponseWriter, req *http.Request, path string) {
+	name := path[:strings.Index(path, "/blobs/uploads/")]
+	switch req.Method {
+	case http.MethodPost:
+		id := fmt.Sprint(len(r.uploads) + 1)
+		r.uploads[id] = nil
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		id := path[strings.LastIndex(path, "/")+1:]
+		b, _ := io.ReadAll(req.Body)
+		b = append(r.uploads[id], b...)
+		d := req.URL.Query().Get("digest")
+		if d != digest.FromBytes(b).String() {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID")
+			return
+		}
+		delete(r.uploads, id)
+		r.blobs[d] = b
+		w.Header().Set("Docker-Content-Digest", d)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED")
+	}
+}
+
+func serve(w http.ResponseWriter, req *http.Request, b []byte) {
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(b).String())
+	w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+	if req.Method != http.MethodHead {
+		w.Write(b)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":"%s"}]}`, code, strings.ToLower(code))
+}
+
+// startProxy runs the proxy binary in front of the upstream and returns its
+// host.
+func startProxy(t *testing.T, upstream *httptest.Server) string {
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	cmd := exec.Command(proxyBinary)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("PORT=%d", port),
+		"REGISTRY_HOST="+strings.TrimPrefix(upstream.URL, "https://"),
+		"UPSTREAM_CA_FILE="+ca,
+		"AUTH_MODE=none",
+		"ALLOWED_ACTIONS=pull,push",
+	)
+	var logs bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &logs, &logs
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("proxy log:\n%s", logs.String())
+		}
+	})
+
+	host := fmt.Sprintf("127.0.0.1:%d", port)
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		resp, err := http.Get("http://" + host + "/v2/")
+		if err == nil {
+			resp.Body.Close()
+			return host
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy did not start: %+v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// artifact is a manifest and its blobs, as a client packs them.
+type artifact struct {
+	name   string
+	pack   func(ctx context.Context, store *memory.Store) (ocispec.Descriptor, error)
+	blobs  map[string][]byte
+	accept string
+}
+
+func pushBlobs(ctx context.Context, store *memory.Store, blobs map[string][]byte, mediaTypes ...string) ([]ocispec.Descriptor, error) {
+	var descs []ocispec.Descriptor
+	for _, mt := range mediaTypes {
+		desc := content.NewDescriptorFromBytes(mt, blobs[mt])
+		if err := store.Push(ctx, desc, bytes.NewReader(blobs[mt])); err != nil {
+			return nil, err
+		}
+		descs = append(descs, desc)
+	}
+	return descs, nil
+}
+
+func TestOCIArtifacts(t *testing.T) {
+	helm := map[string][]byte{
+		"application/vnd.cncf.helm.config.v1+json":            []byte(`{"name":"chart","version":"1.0.0"}`),
+		"application/vnd.cncf.helm.chart.content.v1.tar+gzip": []byte("chart archive"),
+		"application/vnd.cncf.helm.chart.provenance.v1.prov":  []byte("-----BEGIN PGP SIGNED MESSAGE-----"),
+	}
+	wasm := map[string][]byte{
+		"application/vnd.wasm.config.v0+json":        []byte(`{}`),
+		"application/vnd.wasm.content.layer.v1+wasm": []byte("\x00asm\x01\x00\x00\x00"),
+	}
+	sbom := map[string][]byte{
+		"application/spdx+json": []byte(`{"spdxVersion":"SPDX-2.3"}`),
+	}
+	tests := []artifact{{
+		name:  "helm chart with provenance",
+		blobs: helm,
+		pack: func(ctx context.Context, store *memory.Store) (ocispec.Descriptor, error) {
+			config, err := pushBlobs(ctx, store, helm, "application/vnd.cncf.helm.config.v1+json")
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			layers, err := pushBlobs(ctx, store, helm, "application/vnd.cncf.helm.chart.content.v1.tar+gzip", "application/vnd.cncf.helm.chart.provenance.v1.prov")
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			return oras.PackManifest(ctx, store, oras.PackManifestVersion1_0, "", oras.PackManifestOptions{ConfigDescriptor: &config[0], Layers: layers})
+		},
+		accept: ocispec.MediaTypeImageManifest,
+	}, {
+		name:  "wasm module",
+		blobs: wasm,
+		pack: func(ctx context.Context, store *memory.Store) (ocispec.Descriptor, error) {
+			config, err := pushBlobs(ctx, store, wasm, "application/vnd.wasm.config.v0+json")
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			layers, err := pushBlobs(ctx, store, wasm, "application/vnd.wasm.content.layer.v1+wasm")
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			return oras.PackManifest(ctx, store, oras.PackManifestVersion1_0, "", oras.PackManifestOptions{ConfigDescriptor: &config[0], Layers: layers})
+		},
+		accept: ocispec.MediaTypeImageManifest,
+	}, {
+		name:  "sbom with artifact type",
+		blobs: sbom,
+		pack: func(ctx context.Context, store *memory.Store) (ocispec.Descriptor, error) {
+			layers, err := pushBlobs(ctx, store, sbom, "application/spdx+json")
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			return oras.PackManifest(ctx, store, oras.PackManifestVersion1_1, "application/vnd.example.sbom", oras.PackManifestOptions{Layers: layers})
+		},
+		accept: ocispec.MediaTypeImageManifest,
+	}, {
+		name:  "oci artifact manifest",
+		blobs: sbom,
+		pack: func(ctx context.Context, store *memory.Store) (ocispec.Descriptor, error) {
+			layers, err := pushBlobs(ctx, store, sbom, "application/spdx+json")
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			b, err := json.Marshal(map[string]interface{}{
+				"mediaType":    artifactManifestType,
+				"artifactType": "application/vnd.example.sbom",
+				"blobs":        layers,
+			})
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			desc := content.NewDescriptorFromBytes(artifactManifestType, b)
+			return desc, store.Push(ctx, desc, bytes.NewReader(b))
+		},
+		accept: artifactManifestType,
+	}}
+
+	up := newRegistry()
+	upstream := httptest.NewTLSServer(up)
+	defer upstream.Close()
+	host := startProxy(t, upstream)
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo, err := remote.NewRepository(fmt.Sprintf("%s/artifacts/test%d", host, i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo.PlainHTTP = true
+
+			src := memory.New()
+			desc, err := tc.pack(ctx, src)
+			if err != nil {
+				t.Fatalf("pack: %+v", err)
+			}
+			if err := src.Tag(ctx, desc, "v1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := oras.Copy(ctx, src, "v1", repo, "v1", oras.DefaultCopyOptions); err != nil {
+				t.Fatalf("push through the proxy: %+v", err)
+			}
+
+			up.mu.Lock()
+			up.accepts = nil
+			up.mu.Unlock()
+			dst := memory.New()
+			pulled, err := oras.Copy(ctx, repo, "v1", dst, "v1", oras.DefaultCopyOptions)
+			if err != nil {
+				t.Fatalf("pull through the proxy: %+v", err)
+			}
+			if pulled.Digest != desc.Digest || pulled.MediaType != desc.MediaType {
+				t.Fatalf("pulled %s (%s), pushed %s (%s)", pulled.Digest, pulled.MediaType, desc.Digest, desc.MediaType)
+			}
+			for mt, b := range tc.blobs {
+				d := digest.FromBytes(b)
+				got, err := content.FetchAll(ctx, dst, ocispec.Descriptor{MediaType: mt, Digest: d, Size: int64(len(b))})
+				if err != nil {
+					t.Fatalf("blob %s was not pulled: %+v", mt, err)
+				}
+				if sha256.Sum256(got) != sha256.Sum256(b) {
+					t.Fatalf("blob %s has the wrong content", mt)
+				}
+			}
+
+			up.mu.Lock()
+			defer up.mu.Unlock()
+			if len(up.accepts) == 0 {
+				t.Fatal("the upstream got no manifest request")
+			}
+			for _, a := range up.accepts {
+				if !strings.Contains(a, tc.accept) {
+					t.Errorf("the upstream got Accept %q, which lacks %s", a, tc.accept)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// leaseDuration is how long a lease is valid without renewal, after which
+	// another replica takes over.
+	leaseDuration = 15 * time.Second
+	// leaderRetryInterval is the time between attempts to acquire or renew
+	// the lease.
+	leaderRetryInterval = 5 * time.Second
+
+	// microTimeFormat is the format of the time fields of leases.
+	microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// lease is a coordination.k8s.io/v1 Lease.
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// leaderElector elects one replica of a Kubernetes deployment to run the
+// background jobs that must not run on every replica, like mirror syncs. The
+// replicas compete for a Lease object through the Kubernetes API, with the
+// credentials of the pod's service account.
+type leaderElector struct {
+	client    *http.Client
+	leasesURL string
+	name      string
+	namespace string
+	identity  string
+
+	// observed is the last lease seen, and observedAt the local time its
+	// renewal was first seen. Leases expire leaseDuration after that, which
+	// doesn't depend on the clocks of the replicas being in sync.
+	observed   leaseSpec
+	observedAt time.Time
+
+	mu     sync.Mutex
+	leader bool
+}
+
+// getLeaderElector returns the leader election configured by
+// LEADER_ELECTION_LEASE, or nil if it is disabled.
+func getLeaderElector() *leaderElector {
+	name := os.Getenv("LEADER_ELECTION_LEASE")
+	if name == "" {
+		return nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		log.Fatal("LEADER_ELECTION_LEASE requires running in Kubernetes, KUBERNETES_SERVICE_HOST is not set")
+	}
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		b, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			log.Fatalf("could not read the pod namespace, set POD_NAMESPACE: %+v", err)
+		}
+		namespace = strings.TrimSpace(string(b))
+	}
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	pool := x509.NewCertPool()
+	b, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil || !pool.AppendCertsFromPEM(b) {
+		log.Fatalf("could not read the Kubernetes API CA from %s/ca.crt: %v", serviceAccountDir, err)
+	}
+	e := &leaderElector{
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+			Timeout:   leaderRetryInterval,
+		},
+		leasesURL: fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", net.JoinHostPort(host, port), namespace),
+		name:      name,
+		namespace: namespace,
+		identity:  identity,
+	}
+	newGaugeFunc("registry_proxy_leader", "Whether this replica is the leader running background jobs.", func() float64 {
+		if e.isLeader() {
+			return 1
+		}
+		return 0
+	})
+	log.Printf("electing a leader with lease %s/%s as %s", namespace, name, identity)
+	return e
+}
+
+// isLeader reports whether this replica holds the lease. Without leader
+// election every replica is the leader.
+func (e *leaderElector) isLeader() bool {
+	if e == nil {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// run acquires and renews the lease. It never returns.
+func (e *leaderElector) run() {
+	for {
+		leader, err := e.tryAcquire()
+		if err != nil {
+			log.Printf("leader election failed: %+v", err)
+			// Keep leading until the lease expires for the other replicas.
+			leader = e.isLeader() && time.Since(e.observedAt) < leaseDuration
+		}
+		e.mu.Lock()
+		if leader != e.leader {
+			if leader {
+				log.Printf("became the leader")
+			} else {
+				log.Printf("stopped being the leader")
+			}
+		}
+		e.leader = leader
+		e.mu.Unlock()
+		time.Sleep(leaderRetryInterval)
+	}
+}
+
+// tryAcquire creates or renews the lease for this replica, or takes it over
+// once it expired, and reports whether this replica holds it.
+func (e *leaderElector) tryAcquire() (bool, error) {
+	now := time.Now()
+	stamp := now.UTC().Format(microTimeFormat)
+	var l lease
+	status, err := e.call(http.MethodGet, e.leasesURL+"/"+e.name, nil, &l)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusNotFound {
+		l = lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMetadata{Name: e.name, Namespace: e.namespace},
+			Spec: leaseSpec{
+				HolderIdentity:       e.identity,
+				LeaseDurationSeconds: int(leaseDuration / time.Second),
+				AcquireTime:          stamp,
+				RenewTime:            stamp,
+			},
+		}
+		status, err = e.call(http.MethodPost, e.leasesURL, l, nil)
+		if err != nil {
+			return false, err
+		}
+		if status == http.StatusConflict {
+			// Another replica created it first.
+			return false, nil
+		}
+		if status != http.StatusCreated {
+			return false, fmt.Errorf("creating lease %s: unexpected status %d", e.name, status)
+		}
+		e.observed, e.observedAt = l.Spec, now
+		return true, nil
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("reading lease %s: unexpected status %d", e.name, status)
+	}
+
+	if l.Spec != e.observed {
+		e.observed, e.observedAt = l.Spec, now
+	}
+	duration := time.Duration(l.Spec.LeaseDurationSeconds) * time.Second
+	if duration <= 0 {
+		duration = leaseDuration
+	}
+	if l.Spec.HolderIdentity != "" && l.Spec.HolderIdentity != e.identity && now.Sub(e.observedAt) < duration {
+		return false, nil
+	}
+	if l.Spec.HolderIdentity != e.identity {
+		l.Spec.HolderIdentity = e.identity
+		l.Spec.AcquireTime = stamp
+		l.Spec.LeaseTransitions++
+	}
+	l.Spec.LeaseDurationSeconds = int(leaseDuration / time.Second)
+	l.Spec.RenewTime = stamp
+	// The resource version makes the update fail with a conflict if another
+	// replica updated the lease in the meantime.
+	status, err = e.call(http.MethodPut, e.leasesURL+"/"+e.name, l, nil)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusConflict {
+		return false, nil
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("updating lease %s: unexpected status %d", e.name, status)
+	}
+	e.observed, e.observedAt = l.Spec, now
+	return true, nil
+}
+
+// call sends a request to the Kubernetes API with the service account
+// token, and decodes successful responses into out if not nil.
+func (e *leaderElector) call(method, url string, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return 0, err
+	}
+	// The token is read on every request, as projected tokens are rotated.
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return 0, fmt.Errorf("could not read service account token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out); err != nil {
+			return 0, fmt.Errorf("could not decode %s response: %v", method, err)
+		}
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
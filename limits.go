@@ -0,0 +1,238 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMaxManifestSize      = 4 << 20
+	defaultMaxTokenResponseSize = 1 << 20
+	defaultMaxRequestBodySize   = 1 << 20
+)
+
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseSize parses a byte size like "4MiB", "10GB" or "1024".
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	num, mult := s, int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			num, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * mult, nil
+}
+
+// getSizeEnv reads a byte size from the environment variable key, returning
+// def if it is not set.
+func getSizeEnv(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := parseSize(v)
+	if err != nil {
+		log.Fatalf("%s: %+v", key, err)
+	}
+	return n
+}
+
+// errBodyTooLarge is returned when reading past the limit of a limitedBody.
+type errBodyTooLarge struct {
+	limit int64
+}
+
+func (e errBodyTooLarge) Error() string {
+	return fmt.Sprintf("response body exceeds the maximum size of %d bytes", e.limit)
+}
+
+// limitedBody fails reads once more than n bytes were read from the wrapped
+// body, which makes the reverse proxy abort the response to the client.
+type limitedBody struct {
+	io.ReadCloser
+	n, limit int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return 0, errBodyTooLarge{l.limit}
+	}
+	return n, err
+}
+
+// limitResponseSize rejects resp if its advertised length is over limit and
+// otherwise enforces the limit while the body streams.
+func limitResponseSize(resp *http.Response, limit int64) error {
+	if resp.ContentLength > limit {
+		resp.Body.Close()
+		return errBodyTooLarge{limit}
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, limit: limit}
+	return nil
+}
+
+// limitManifestSize rejects manifest responses over limit with a registry
+// error, so a misbehaving upstream can't make clients and the proxy buffer
+// arbitrary amounts of data as a manifest.
+func limitManifestSize(resp *http.Response, limit int64) *http.Response {
+	if limit <= 0 || !strings.Contains(resp.Request.URL.Path, "/manifests/") {
+		return resp
+	}
+	if err := limitResponseSize(resp, limit); err != nil {
+		log.Printf("rejecting manifest from url=%s: %+v", resp.Request.URL, err)
+		return registryErrorResponse(resp.Request, http.StatusBadGateway, "MANIFEST_INVALID",
+			fmt.Sprintf("manifest exceeds the maximum size of %d bytes", limit))
+	}
+	return resp
+}
+
+// limitBlobSize rejects blob downloads larger than limit bytes. Blobs whose
+// size is not advertised upfront are aborted once they exceed the limit.
+// For redirects to external storage, the size is looked up with a HEAD
+// request through transport first, since the client downloads the content
+// elsewhere.
+func limitBlobSize(resp *http.Response, limit int64, transport http.RoundTripper) *http.Response {
+	req := resp.Request
+	if limit <= 0 || req.Method != http.MethodGet || !blobPath.MatchString(req.URL.Path) {
+		return resp
+	}
+	if isRedirect(resp.StatusCode) {
+		size, err := headBlobSize(req, transport)
+		if err != nil {
+			log.Printf("could not look up the size of redirected blob, not limiting it: url=%s: %+v", req.URL, err)
+			return resp
+		}
+		if size > limit {
+			log.Printf("rejecting redirected blob of %d bytes from url=%s", size, req.URL)
+			resp.Body.Close()
+			return blobTooLargeResponse(req, size, limit)
+		}
+		return resp
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp
+	}
+	if err := limitResponseSize(resp, limit); err != nil {
+		log.Printf("rejecting blob of %d bytes from url=%s: %+v", resp.ContentLength, req.URL, err)
+		return blobTooLargeResponse(req, resp.ContentLength, limit)
+	}
+	return resp
+}
+
+func blobTooLargeResponse(req *http.Request, size, limit int64) *http.Response {
+	return registryErrorResponse(req, http.StatusForbidden, "DENIED",
+		fmt.Sprintf("blob is %d bytes, larger than the maximum of %d bytes allowed by this registry", size, limit))
+}
+
+// headBlobSize returns the size of the blob downloaded by req from the
+// Content-Length of a HEAD request for it, following redirects.
+func headBlobSize(req *http.Request, transport http.RoundTripper) (int64, error) {
+	head, err := http.NewRequest(http.MethodHead, req.URL.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	head = head.WithContext(req.Context())
+	for k, v := range req.Header {
+		head.Header[k] = v
+	}
+	resp, err := transport.RoundTrip(head)
+	if err != nil {
+		return 0, err
+	}
+	if isRedirect(resp.StatusCode) {
+		if resp, err = fetchRedirect(head, resp, transport); err != nil {
+			return 0, err
+		}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return 0, fmt.Errorf("HEAD request answered with status %d and length %d", resp.StatusCode, resp.ContentLength)
+	}
+	return resp.ContentLength, nil
+}
+
+// limitRequestBodies rejects request bodies larger than limit bytes with 413,
+// except for blob uploads, which are not limited, and manifest pushes, which
+// may be up to maxManifestSize bytes, or any size if that is 0. Bodies of unknown length are read
+// upfront to check their size.
+func limitRequestBodies(limit, maxManifestSize int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Body == nil || req.Body == http.NoBody {
+			next.ServeHTTP(w, req)
+			return
+		}
+		allowed := limit
+		if rr, ok := parseRegistryPath(req.URL.Path); ok {
+			switch {
+			case rr.kind == "blobs" && strings.HasPrefix(rr.reference, "uploads/"),
+				rr.kind == "manifests" && maxManifestSize <= 0:
+				next.ServeHTTP(w, req)
+				return
+			case rr.kind == "manifests" && maxManifestSize > allowed:
+				allowed = maxManifestSize
+			}
+		}
+		if req.ContentLength > allowed {
+			writeRegistryError(w, http.StatusRequestEntityTooLarge, "SIZE_INVALID",
+				fmt.Sprintf("request body exceeds the maximum size of %d bytes", allowed))
+			return
+		}
+		if req.ContentLength < 0 {
+			b, err := ioutil.ReadAll(io.LimitReader(req.Body, allowed+1))
+			req.Body.Close()
+			if err != nil {
+				writeRegistryError(w, http.StatusBadRequest, "UNSUPPORTED", "could not read request body")
+				return
+			}
+			if int64(len(b)) > allowed {
+				writeRegistryError(w, http.StatusRequestEntityTooLarge, "SIZE_INVALID",
+					fmt.Sprintf("request body exceeds the maximum size of %d bytes", allowed))
+				return
+			}
+			req.Body, req.ContentLength = ioutil.NopCloser(bytes.NewReader(b)), int64(len(b))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
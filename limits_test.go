@@ -0,0 +1,68 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLimitBlobSizeOfRedirectedBlobs(t *testing.T) {
+	blob := bytes.Repeat([]byte("x"), 100)
+	digest := sha256Digest(blob)
+	up := newRedirectingUpstream(map[string][]byte{digest: blob})
+	defer up.Close()
+
+	tests := []struct {
+		limit  int64
+		status int
+	}{
+		{limit: 99, status: http.StatusForbidden},
+		{limit: 100, status: http.StatusTemporaryRedirect},
+		{limit: 0, status: http.StatusTemporaryRedirect},
+	}
+	for _, tt := range tests {
+		cfg := registryConfig{host: strings.TrimPrefix(up.registry.URL, "https://"), transport: up.transport(), maxBlobSize: tt.limit}
+		resp := up.get(t, cfg, digest)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("limit %d: got status %d, want %d", tt.limit, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"1024", 1024, true},
+		{"10KiB", 10 << 10, true},
+		{"1GiB", 1 << 30, true},
+		{"8EiB", 0, false},
+		{"99999999999999999999", 0, false},
+		{"-1", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("parseSize(%q) = %d, %v, want %d, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -20,13 +20,16 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -39,103 +42,478 @@ const (
 var (
 	re                 = regexp.MustCompile(`^/v2/`)
 	realm              = regexp.MustCompile(`realm="(.*?)"`)
+	challengeService   = regexp.MustCompile(`service="(.*?)"`)
+	challengeScope     = regexp.MustCompile(`scope="(.*?)"`)
 	ctxKeyOriginalHost = struct{}{}
+
+	tokenRequestsCoalescedTotal = newCounterVec("registry_proxy_token_requests_coalesced_total",
+		"Token requests answered with the result of an identical request in flight.")
+	upstreamRequestsTotal = newCounterVec("registry_proxy_upstream_requests_total",
+		"Requests sent to the upstream registry, by kind (ping, manifests, blobs, tags, referrers or other) and method.",
+		"kind", "method")
 )
 
 type registryConfig struct {
 	host       string
 	repoPrefix string
+	// rules map repository names to upstream names. Names not matching any
+	// rule are put under repoPrefix, or used as is if repoPrefix is empty.
+	rules         []repoRule
+	schema1Policy schema1Policy
+	verifyBlobs   bool
+	// passthrough forwards the clients' own credentials to the upstream
+	// instead of the proxy's.
+	passthrough bool
+	// anonymous sends no credentials to the upstream at all and doesn't
+	// proxy its token service, for public registries (AUTH_MODE=none).
+	anonymous bool
+	// logProbes logs /v2/ pings and HEAD requests like pulls, rather than
+	// only their failures.
+	logProbes bool
+	// allowedActions are the repository actions (pull, push, delete)
+	// clients may perform through the proxy.
+	allowedActions map[string]bool
+	// maxManifestSize and maxTokenSize are the largest manifest and token
+	// service response bodies accepted from upstream, in bytes.
+	maxManifestSize int64
+	maxTokenSize    int64
+	maxBlobSize     int64
+	// followRedirects downloads blobs that the upstream redirects to its
+	// storage through the proxy, see followBlobRedirect.
+	followRedirects bool
+	profile         registryProfile
+	// stripHeaders are removed from upstream responses, see
+	// checkResponseHeaders.
+	stripHeaders []string
+	// transport sends all requests to the upstream registry.
+	transport http.RoundTripper
+	cache     *blobCache
+	tagLists  *tagListCache
+	// cachePolicy sets the Cache-Control headers of responses. Upstream
+	// headers are kept if nil.
+	cachePolicy *cachePolicy
+	// virtual serves pulls this registry doesn't have from other upstreams,
+	// if configured.
+	virtual *virtualRegistry
+	// notFound answers pulls the upstream recently answered with 404, if
+	// configured.
+	notFound *notFoundCache
 }
 
 func main() {
+	if strings.HasPrefix(filepath.Base(os.Args[0]), "docker-credential-") {
+		os.Exit(runCredentialHelper(os.Args[1:]))
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "credential-helper":
+			os.Exit(runCredentialHelper(os.Args[2:]))
+		case "selftest":
+			os.Exit(runSelftest(os.Args[2:]))
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		case "--print-schema":
+			printConfigSchema()
+			os.Exit(0)
+		default:
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		log.Fatal("PORT environment variable not specified")
 	}
+	srv := newProxyServer()
+	srv.start()
+
+	addr := ":" + port
+	log.Printf("starting to listen on %s", addr)
+	var err error
+	server := &http.Server{
+		Addr:    addr,
+		Handler: srv.handler,
+		// Requests with larger headers are answered with 431.
+		MaxHeaderBytes: int(getSizeEnv("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)),
+	}
+	if cert, key := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY"); cert != "" && key != "" {
+		err = server.ListenAndServeTLS(cert, key)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalf("listen error: %+v", err)
+	}
+
+	log.Printf("server shutdown successfully")
+}
+
+// proxyServer is the HTTP handler of the proxy, configured from the
+// environment, along with its background jobs.
+type proxyServer struct {
+	handler   http.Handler
+	check     *selfCheck
+	mirror    *mirror
+	pinger    *upstreamPinger
+	leader    *leaderElector
+	cacheGC   *cacheGC
+	watcher   *configWatcher
+	discovery *tokenDiscovery
+}
+
+// start runs the startup self-check and starts the background jobs.
+func (s *proxyServer) start() {
+	if s.check != nil {
+		s.check.start()
+	}
+	go s.discovery.run()
+	if s.leader != nil {
+		go s.leader.run()
+	}
+	if s.mirror != nil {
+		go s.mirror.run()
+	}
+	if s.cacheGC != nil {
+		go s.cacheGC.run()
+	}
+	if s.pinger != nil {
+		go s.pinger.run()
+	}
+	if s.watcher != nil {
+		go s.watcher.run()
+	}
+}
+
+func newProxyServer() *proxyServer {
 	browserRedirects := os.Getenv("DISABLE_BROWSER_REDIRECTS") == ""
+	fc := getFileConfig()
 
-	registryHost := os.Getenv("REGISTRY_HOST")
-	if registryHost == "" {
-		log.Fatal("REGISTRY_HOST environment variable not specified (example: gcr.io)")
+	registryHost := getRegistryHost()
+	rules, err := parseRepoRules(os.Getenv("REPO_RULES"), registryHost)
+	if err != nil {
+		log.Fatalf("invalid REPO_RULES: %+v", err)
 	}
-	repoPrefix := os.Getenv("REPO_PREFIX")
+	repoPrefix := strings.Trim(os.Getenv("REPO_PREFIX"), "/")
 	if repoPrefix == "" {
-		log.Fatal("REPO_PREFIX environment variable not specified")
+		log.Printf("REPO_PREFIX not specified, mirroring all repositories of %s", registryHost)
 	}
 
 	reg := registryConfig{
-		host:       registryHost,
-		repoPrefix: repoPrefix,
-	}
+		host:          registryHost,
+		repoPrefix:    repoPrefix,
+		rules:         rules,
+		schema1Policy: getSchema1Policy(),
+		verifyBlobs:   os.Getenv("DISABLE_BLOB_VERIFICATION") == "",
+		passthrough:   os.Getenv("AUTH_PASSTHROUGH") != "",
+		anonymous:     os.Getenv("AUTH_MODE") == "none",
+		logProbes:     os.Getenv("LOG_PROBES") != "",
 
-	tokenEndpoint, err := discoverTokenService(reg.host)
-	if err != nil {
-		log.Fatalf("target registry's token endpoint could not be discovered: %+v", err)
+		allowedActions: getAllowedActions(),
+
+		maxManifestSize: getSizeEnv("MAX_MANIFEST_SIZE", defaultMaxManifestSize),
+		maxTokenSize:    getSizeEnv("MAX_TOKEN_RESPONSE_SIZE", defaultMaxTokenResponseSize),
+		maxBlobSize:     getSizeEnv("MAX_BLOB_SIZE", 0),
+
+		profile:      getRegistryProfile(registryHost),
+		stripHeaders: getStripResponseHeaders(),
+		transport:    getUpstreamTransport(),
+		tagLists:     getTagListCache(),
+		notFound:     getNotFoundCache(),
 	}
-	log.Printf("discovered token endpoint for backend registry: %s", tokenEndpoint)
+	reg.transport = getHedgingTransport(wrapPluginTransports(reg.profile.wrapTransport(reg.host, reg.transport)))
+	if len(plugins) > 0 {
+		log.Printf("plugins enabled: %s", pluginNames())
+	}
+	reg.virtual = getVirtualRegistry(fc.Virtual, reg)
+
+	discovery := newTokenDiscovery(reg)
 
 	var auth authenticator
 
 	auth = getAuthData(auth)
+	watchCredentialExpiry(auth)
+	reg.cache = getBlobCache(auth)
+	// The cache can only fill with blobs that pass through the proxy.
+	reg.followRedirects = reg.cache != nil || os.Getenv("FOLLOW_BLOB_REDIRECTS") != ""
+	if reg.verifyBlobs && !reg.followRedirects {
+		log.Printf("blobs the upstream redirects to its storage are downloaded by clients directly and not verified against their digest, set FOLLOW_BLOB_REDIRECTS to verify them")
+	}
+	cacheGC := getCacheGC(reg.cache)
 
 	mux := http.NewServeMux()
+	registerWellKnownHandlers(mux, getWellKnownConfig())
+	mux.Handle("/.well-known/registry-proxy", statusHandler(reg, map[string]bool{
+		"push":             reg.allowedActions["push"],
+		"cache":            reg.cache != nil,
+		"serve_stale":      reg.cache != nil && reg.cache.serveStale,
+		"tag_list_cache":   reg.tagLists != nil,
+		"browser_redirect": browserRedirects,
+		"token_proxy":      !reg.anonymous,
+	}))
 	if browserRedirects {
 		mux.Handle("/", browserRedirectHandler(reg))
 	}
-	if tokenEndpoint != "" {
-		mux.Handle("/_token", tokenProxyHandler(tokenEndpoint, repoPrefix))
+	clientAuth := getClientAuth()
+	if reg.passthrough {
+		if clientAuth != nil {
+			log.Fatal("AUTH_PASSTHROUGH can't be combined with CLIENT_AUTH_FILE, clients authenticate with the upstream")
+		}
+		if reg.cache != nil && reg.cache.serveStale {
+			log.Fatal("AUTH_PASSTHROUGH can't be combined with SERVE_STALE, stale content is served without asking the upstream")
+		}
+		if reg.cache != nil {
+			reg.cache.authorize = upstreamAuthorizer(reg)
+		}
+		log.Printf("forwarding the credentials of clients to the upstream")
+	}
+	// live holds the configuration that changes while the proxy runs.
+	live := newLiveConfig()
+	reg.cachePolicy = getCachePolicy(fc.CachePolicy, clientAuth != nil, live)
+	if authz := getAuthzPolicy(fc.Authorization, clientAuth != nil, live); authz != nil {
+		clientAuth.authz = authz
+	}
+	var upstreamTokenExchange *upstreamTokens
+	if clientAuth != nil {
+		// The proxy is the token service for its clients, so it has to answer
+		// the token challenges of the upstream registry on their behalf.
+		mux.Handle("/_token", clientAuth.tokenHandler())
+		mux.Handle("/_credentials", clientAuth.credentialsHandler(getCredentialsTTL()))
+		if !reg.anonymous {
+			upstreamTokenExchange = newUpstreamTokens(&http.Client{Transport: reg.transport}, reg)
+		}
+	} else if !reg.anonymous {
+		mux.Handle("/_token", tokenProxyHandler(reg, discovery))
+	}
+	upstream := newUpstreamClient(reg, auth)
+	access := imageAccess{policy: getExternalPolicy()}
+	if clientAuth != nil {
+		access.authz = clientAuth.authz
+	}
+	check := getSelfCheck(upstream)
+	mux.Handle("/readyz", readyzHandler(check))
+	var validate http.Handler = validateHandler(upstream, access)
+	if clientAuth != nil {
+		validate = clientAuth.middleware(validate)
+	}
+	mux.Handle("/validate", validate)
+	var resolve http.Handler = resolveHandler(upstream, access)
+	if clientAuth != nil {
+		resolve = clientAuth.middleware(resolve)
+	}
+	mux.Handle("/resolve/", resolve)
+	if clientAuth != nil {
+		mux.Handle("/inspect/", clientAuth.middleware(inspectHandler(upstream, access, "/inspect/")))
 	}
-	mux.Handle("/v2/", registryAPIProxy(reg, auth))
 
-	addr := ":" + port
-	handler := captureHostHeader(mux)
-	log.Printf("starting to listen on %s", addr)
-	if cert, key := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY"); cert != "" && key != "" {
-		err = http.ListenAndServeTLS(addr, cert, key, handler)
-	} else {
-		err = http.ListenAndServe(addr, handler)
+	mirror := getMirror(fc.Mirror, reg, auth, live)
+	leader := getLeaderElector()
+	if mirror != nil {
+		mirror.leader = leader
 	}
-	if err != http.ErrServerClosed {
-		log.Fatalf("listen error: %+v", err)
+	if cacheGC != nil {
+		cacheGC.leader = leader
+	}
+	pinger := getUpstreamPinger(reg)
+	stats := newPullStats()
+	live.update(func(s *configSnapshot) {
+		s.upstream = &registryRoundtripper{cfg: reg, auth: auth, tokens: upstreamTokenExchange}
+	})
+	var registryHandler http.Handler = registryAPIProxy(func(ctx context.Context) *registryRoundtripper {
+		return live.get(ctx).upstream
+	})
+	shadow := getShadowReader(fc.Shadow, reg)
+	if shadow != nil {
+		registryHandler = shadow.middleware(registryHandler)
+	}
+	canary := getCanaryRouter(fc.Canary, reg, live)
+	if canary != nil {
+		registryHandler = canary.middleware(registryHandler)
+	}
+	overrides := getUpstreamOverrides(fc.UpstreamOverrides, reg, live)
+	if overrides != nil {
+		registryHandler = overrides.middleware(registryHandler)
+	}
+	maintenance := getMaintenanceMode(reg, live)
+	registryHandler = maintenance.middleware(registryHandler)
+	discovery.bypass = func() bool { return maintenance.current().Enabled }
+	if os.Getenv("DISABLE_COMPRESSION") == "" {
+		registryHandler = compressJSON(registryHandler)
+	}
+	registryHandler = stats.middleware(registryHandler)
+	if exporter := getAnalyticsExporter(auth); exporter != nil {
+		registryHandler = exporter.middleware(registryHandler)
 	}
+	if pinning := getPinningPolicy(); pinning != nil {
+		registryHandler = pinning.middleware(registryHandler)
+	}
+	if listing := getListingPolicy(); listing != nil {
+		registryHandler = listing.middleware(registryHandler)
+	}
+	if quota := getTransferQuota(); quota != nil {
+		registryHandler = quota.middleware(registryHandler)
+	}
+	if scheduler := getPullScheduler(fc.Priority, fc.UpstreamOverrides); scheduler != nil {
+		registryHandler = scheduler.middleware(registryHandler)
+	}
+	registryHandler = wrapPluginHandlers(registryHandler)
+	if access.policy != nil {
+		registryHandler = access.policy.middleware(registryHandler)
+	}
+	if clientAuth != nil {
+		if clientAuth.authz != nil {
+			registryHandler = clientAuth.authz.middleware(registryHandler)
+		}
+		registryHandler = clientAuth.middleware(registryHandler)
+	}
+	mux.Handle("/v2/", live.middleware(discovery.middleware(registryHandler)))
 
-	log.Printf("server shutdown successfully")
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/_admin/stats", stats.handler())
+		adminMux.Handle("/_admin/maintenance", maintenance.handler())
+		adminMux.Handle("/_admin/inspect/", inspectHandler(upstream, imageAccess{}, "/_admin/inspect/"))
+		if mirror != nil {
+			adminMux.Handle("/_admin/mirror", mirror.handler())
+		}
+		if pinger != nil {
+			adminMux.Handle("/_admin/upstream", pinger.handler())
+		}
+		if cacheGC != nil {
+			adminMux.Handle("/_admin/cache", cacheGC.handler())
+		}
+		if shadow != nil {
+			adminMux.Handle("/_admin/shadow", shadow.handler())
+		}
+		mux.Handle("/_admin/", requireAdmin(token, adminMux))
+		mux.Handle("/metrics", requireAdmin(token, metricsHandler()))
+	}
+
+	watcher := getConfigWatcher(live)
+	if watcher != nil {
+		if reg.cachePolicy != nil {
+			watcher.add("cache_policy", reg.cachePolicy.reloader())
+		}
+		if clientAuth != nil && clientAuth.authz != nil {
+			watcher.add("authorization", clientAuth.authz.reloader())
+		}
+		if mirror != nil {
+			watcher.add("mirror", mirror.reloader(reg))
+		}
+		if canary != nil {
+			watcher.add("canary", canary.reloader())
+		}
+		if overrides != nil {
+			watcher.add("upstream_overrides", overrides.reloader())
+		}
+	}
+
+	updateConfigFingerprint()
+	handler := limitRequestBodies(getSizeEnv("MAX_REQUEST_BODY_SIZE", defaultMaxRequestBodySize), reg.maxManifestSize, mux)
+	requestSLIs.availabilityTarget = getAvailabilityTarget()
+	handler = requestSLIs.middleware(handler)
+	return &proxyServer{handler: versionHeader(captureHostHeader(handler)), check: check, mirror: mirror, pinger: pinger, leader: leader, cacheGC: cacheGC, watcher: watcher, discovery: discovery}
+}
+
+// getRegistryHost returns the upstream registry host from REGISTRY_HOST,
+// which may include a port for registries not served on 443, like
+// registry.internal:5443. The default port is dropped, so the host compares
+// equal to the hosts in URLs the registry returns.
+func getRegistryHost() string {
+	v := os.Getenv("REGISTRY_HOST")
+	if v == "" {
+		log.Fatal("REGISTRY_HOST environment variable not specified (example: gcr.io)")
+	}
+	u, err := url.Parse("https://" + strings.TrimPrefix(strings.TrimRight(v, "/"), "https://"))
+	if err != nil || u.Host == "" || u.Path != "" || u.User != nil || u.RawQuery != "" {
+		log.Fatalf("invalid REGISTRY_HOST %q, expected a host with an optional port (example: registry.internal:5443)", v)
+	}
+	if p := u.Port(); p != "" {
+		if n, err := strconv.Atoi(p); err != nil || n <= 0 || n > 65535 {
+			log.Fatalf("invalid port in REGISTRY_HOST %q", v)
+		}
+	}
+	return canonicalHost(u.Host)
+}
+
+// canonicalHost returns host without the default https port.
+func canonicalHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ":443")
 }
 
 func getAuthData(auth authenticator) authenticator {
+	switch mode := os.Getenv("AUTH_MODE"); mode {
+	case "":
+	case "auto":
+		return getImpersonatedAuth(detectAuth())
+	case "none":
+		for _, v := range []string{"AUTH_HEADER", "AUTH_PASSTHROUGH", "USE_METADATA_SERVER", "GOOGLE_APPLICATION_CREDENTIALS",
+			"ARTIFACTORY_API_KEY", "IMPERSONATE_SERVICE_ACCOUNT"} {
+			if os.Getenv(v) != "" {
+				log.Fatalf("AUTH_MODE=none can't be combined with %s, the upstream is accessed anonymously", v)
+			}
+		}
+		log.Printf("auth: AUTH_MODE=none, accessing the upstream anonymously")
+		return nil
+	default:
+		log.Fatalf("invalid AUTH_MODE %q, expected auto or none", mode)
+	}
 	if useMetadataServer := os.Getenv("USE_METADATA_SERVER"); useMetadataServer != "" {
-		metadataServerAuth := &metadataServerAuth{}
-		metadataServerAuth.Init()
-
-		auth = metadataServerAuth
+		auth = newRegistryMetadataAuth()
 	} else if basic := os.Getenv("AUTH_HEADER"); basic != "" {
-		auth = authHeader(basic)
+		auth = staticAuthHeader(basic)
+	} else if key := os.Getenv("ARTIFACTORY_API_KEY"); key != "" {
+		log.Printf("using the Artifactory API key of %s to authenticate proxied requests", os.Getenv("ARTIFACTORY_USER"))
+		auth = authHeader("Basic " + base64.StdEncoding.EncodeToString([]byte(os.Getenv("ARTIFACTORY_USER")+":"+key)))
 	} else if gcpKey := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); gcpKey != "" {
-		b, err := ioutil.ReadFile(gcpKey)
-		if err != nil {
-			log.Fatalf("could not read key file from %s: %+v", gcpKey, err)
-		}
 		log.Printf("using specified service account json key to authenticate proxied requests")
-		auth = authHeader("Basic " + base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("_json_key:%s", string(b)))))
+		auth = credentialsFileAuth(gcpKey)
+	} else {
+		log.Printf("no credentials configured, proxying requests anonymously (set AUTH_MODE=auto to detect them)")
 	}
-	return auth
+	return getImpersonatedAuth(auth)
 }
 
-func discoverTokenService(registryHost string) (string, error) {
-	url := fmt.Sprintf("https://%s/v2/", registryHost)
-	resp, err := http.Get(url)
+// discoverTokenService returns the realm and service of the token service
+// advertised by the registry.
+func discoverTokenService(cfg registryConfig) (string, string, error) {
+	url := fmt.Sprintf("https://%s/v2/", cfg.host)
+	resp, err := (&http.Client{Transport: cfg.transport}).Get(url)
 	if err != nil {
-		return "", fmt.Errorf("failed to query the registry host %s: %+v", registryHost, err)
+		return "", "", fmt.Errorf("failed to query the registry host %s: %+v", cfg.host, err)
 	}
+	resp.Body.Close()
 	hdr := resp.Header.Get("www-authenticate")
+	if hdr == "" && cfg.profile.tokenPath != "" {
+		return profileTokenService(cfg)
+	}
 	if hdr == "" {
-		return "", fmt.Errorf("www-authenticate header not returned from %s, cannot locate token endpoint", url)
+		return "", "", fmt.Errorf("www-authenticate header not returned from %s, cannot locate token endpoint", url)
 	}
 	matches := realm.FindStringSubmatch(hdr)
 	if len(matches) == 0 {
-		return "", fmt.Errorf("cannot locate 'realm' in %s response header www-authenticate: %s", url, hdr)
+		return "", "", fmt.Errorf("cannot locate 'realm' in %s response header www-authenticate: %s", url, hdr)
 	}
-	return matches[1], nil
+	var service string
+	if m := challengeService.FindStringSubmatch(hdr); len(m) > 0 {
+		service = m[1]
+	} else if cfg.profile.service != "" {
+		service = cfg.profile.service
+	}
+	return matches[1], service, nil
+}
+
+// profileTokenService returns the token service that the registry profile
+// knows for registries that don't advertise one.
+func profileTokenService(cfg registryConfig) (string, string, error) {
+	service := cfg.profile.service
+	if service == "" {
+		service = cfg.host
+	}
+	host := cfg.profile.tokenHost
+	if host == "" {
+		host = cfg.host
+	}
+	return fmt.Sprintf("https://%s%s", host, cfg.profile.tokenPath), service, nil
 }
 
 // captureHostHeader is a middleware to capture Host header in a context key.
@@ -149,27 +527,124 @@ func captureHostHeader(next http.Handler) http.Handler {
 
 // tokenProxyHandler proxies the token requests to the specified token service.
 // It adjusts the ?scope= parameter in the query from "repository:foo:..." to
-// "repository:repoPrefix/foo:.." and reverse proxies the query to the specified
-// tokenEndpoint.
-func tokenProxyHandler(tokenEndpoint, repoPrefix string) http.HandlerFunc {
-	return (&httputil.ReverseProxy{
+// "repository:repoPrefix/foo:..", restores the upstream's ?service= value and
+// reverse proxies the query to the discovered token endpoint. Token responses
+// larger than cfg.maxTokenSize bytes are rejected.
+func tokenProxyHandler(cfg registryConfig, discovery *tokenDiscovery) http.HandlerFunc {
+	// Clients don't attempt to pull without a token, so while stale content
+	// is served they get a placeholder token if the token service is down.
+	// It grants nothing, the upstream rejects it once it is back.
+	stale := cfg.cache != nil && cfg.cache.serveStale
+	proxy := (&httputil.ReverseProxy{
+		Transport: cfg.transport,
 		Director: func(r *http.Request) {
 			orig := r.URL.String()
 
+			tokenEndpoint, service, _ := discovery.current()
 			q := r.URL.Query()
-			scope := q.Get("scope")
-			if scope == "" {
-				return
+			var scopes []string
+			for _, scope := range q["scope"] {
+				// Tokens never grant more than the proxy allows, even if the
+				// upstream would grant the client more.
+				if scope = restrictScope(servedScope(scope, cfg.upstreamName), cfg.allowedActions); scope != "" {
+					scopes = append(scopes, scope)
+				}
+			}
+			if len(scopes) > 0 {
+				q["scope"] = scopes
+			} else {
+				q.Del("scope")
+			}
+			if service != "" {
+				q.Set("service", service)
 			}
-			newScope := strings.Replace(scope, "repository:", fmt.Sprintf("repository:%s/", repoPrefix), 1)
-			q.Set("scope", newScope)
 			u, _ := url.Parse(tokenEndpoint)
 			u.RawQuery = q.Encode()
 			r.URL = u
 			log.Printf("tokenProxyHandler: rewrote url:%s into:%s", orig, r.URL)
 			r.Host = u.Host
 		},
+		ModifyResponse: func(resp *http.Response) error {
+			if stale && upstreamUnavailable(resp.StatusCode) {
+				log.Printf("token service returned status %d, issuing placeholder token", resp.StatusCode)
+				resp.Body.Close()
+				*resp = *placeholderTokenResponse(resp.Request)
+				return nil
+			}
+			setNoStore(resp)
+			if cfg.maxTokenSize <= 0 {
+				return nil
+			}
+			return limitResponseSize(resp, cfg.maxTokenSize)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("tokenProxyHandler: request failed with error: %+v", err)
+			if !stale {
+				writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", "the upstream token service could not be reached")
+				return
+			}
+			writePlaceholderToken(w)
+		},
 	}).ServeHTTP
+
+	// During pull storms many clients ask for the same token at once, only
+	// one request per query and credentials is sent to the token service.
+	var flights flightGroup
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !discovery.retry() {
+			writeRegistryError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "the upstream token service is not known yet")
+			return
+		}
+		if r.Method != http.MethodGet {
+			proxy(w, r)
+			return
+		}
+		key := r.URL.RawQuery + "\x00" + r.Header.Get("Authorization")
+		v, _, shared := flights.do(key, func() (interface{}, error) {
+			// The request is shared, so it must not be cancelled when the
+			// client that happened to make it goes away.
+			buf := newBufferedResponse()
+			proxy(buf, r.WithContext(context.Background()))
+			return buf, nil
+		})
+		if shared {
+			tokenRequestsCoalescedTotal.inc()
+		}
+		v.(*bufferedResponse).writeTo(w)
+	}
+}
+
+// upstreamName returns the name of the upstream repository that the
+// client-visible repository name maps to. It returns false for names that
+// are not served by the proxy.
+func (c registryConfig) upstreamName(name string) (string, bool) {
+	for _, r := range c.rules {
+		if u, ok := r.apply(name); ok {
+			return u, r.denyStatus == 0
+		}
+	}
+	if c.repoPrefix == "" {
+		return name, true
+	}
+	return c.repoPrefix + "/" + name, true
+}
+
+// clientName is the inverse of upstreamName. It returns false for upstream
+// repositories that are not exposed through the proxy.
+func (c registryConfig) clientName(upstream string) (string, bool) {
+	for _, r := range c.rules {
+		if n, ok := r.reverse(upstream); ok {
+			return n, true
+		}
+	}
+	if c.repoPrefix == "" {
+		return upstream, c.denial(upstream) == nil
+	}
+	if !strings.HasPrefix(upstream, c.repoPrefix+"/") {
+		return "", false
+	}
+	name := strings.TrimPrefix(upstream, c.repoPrefix+"/")
+	return name, c.denial(name) == nil
 }
 
 // browserRedirectHandler redirects a request like example.com/my-image to
@@ -178,19 +653,63 @@ func tokenProxyHandler(tokenEndpoint, repoPrefix string) http.HandlerFunc {
 // entered into the browser, like GCR (gcr.io/google-containers/busybox).
 func browserRedirectHandler(cfg registryConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		url := fmt.Sprintf("https://%s/%s%s", cfg.host, cfg.repoPrefix, r.RequestURI)
+		name, ok := cfg.upstreamName(strings.Trim(r.URL.Path, "/"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		url := fmt.Sprintf("https://%s/%s", cfg.host, name)
+		if r.URL.RawQuery != "" {
+			url += "?" + r.URL.RawQuery
+		}
 		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 	}
 }
 
-// registryAPIProxy returns a reverse proxy to the specified registry.
-func registryAPIProxy(cfg registryConfig, auth authenticator) http.HandlerFunc {
-	return (&httputil.ReverseProxy{
-		Director: rewriteRegistryV2URL(cfg),
-		Transport: &registryRoundtripper{
-			auth: auth,
+// registryAPIProxy returns a reverse proxy to the registry that upstream
+// returns for the context of each request, which is usually an upstream of
+// the request's configSnapshot. If the upstream has tokens, the proxy
+// answers its bearer token challenges itself instead of sending them to the
+// client.
+func registryAPIProxy(upstream func(ctx context.Context) *registryRoundtripper) http.HandlerFunc {
+	proxy := (&httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			rewriteRegistryV2URL(upstream(req.Context()).cfg)(req)
+		},
+		Transport: liveRoundTripper(upstream),
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if req.Context().Err() != nil {
+				// The client went away, nobody reads the response.
+				return
+			}
+			writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", "the upstream registry could not be reached")
 		},
 	}).ServeHTTP
+	return func(w http.ResponseWriter, req *http.Request) {
+		cfg := upstream(req.Context()).cfg
+		if action := requestAction(req); !cfg.allowedActions[action] {
+			writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED",
+				fmt.Sprintf("%s is not allowed through this proxy", action))
+			return
+		}
+		if rr, ok := parseRegistryPath(req.URL.Path); ok {
+			if d := cfg.denial(rr.name); d != nil {
+				d.writeTo(w, req, rr.name)
+				return
+			}
+			name, ok := cfg.upstreamName(rr.name)
+			if !ok {
+				writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN",
+					fmt.Sprintf("repository %s is not served by this registry", rr.name))
+				return
+			}
+			if err := cfg.profile.checkName(name); err != nil {
+				writeRegistryError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+				return
+			}
+		}
+		proxy(w, req)
+	}
 }
 
 // handleRegistryAPIVersion signals docker-registry v2 API on /v2/ endpoint.
@@ -199,62 +718,309 @@ func handleRegistryAPIVersion(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "ok")
 }
 
-// rewriteRegistryV2URL rewrites request.URL like /v2/* that come into the server
-// into https://[GCR_HOST]/v2/[PROJECT_ID]/*. It leaves /v2/ as is.
+// rewriteRegistryV2URL rewrites request.URL like /v2/[NAME]/* that come into
+// the server into https://[GCR_HOST]/v2/[UPSTREAM NAME]/*, where the upstream
+// name is determined by the repository rules and is [PROJECT_ID]/[NAME] by
+// default. It leaves /v2/ as is.
 func rewriteRegistryV2URL(c registryConfig) func(*http.Request) {
 	return func(req *http.Request) {
 		u := req.URL.String()
 		req.Host = c.host
 		req.URL.Scheme = "https"
 		req.URL.Host = c.host
-		if req.URL.Path != "/v2/" {
+		if rr, ok := parseRegistryPath(req.URL.Path); ok {
+			if name, ok := c.upstreamName(rr.name); ok {
+				req.URL.Path = fmt.Sprintf("/v2/%s/%s/%s", name, rr.kind, rr.reference)
+				req.URL.RawPath = ""
+			}
+		} else if req.URL.Path == "/v2/_catalog" {
+			// The catalog lists all repositories of the upstream, and the
+			// proxy filters it. Pages continue after an upstream name.
+			q := req.URL.Query()
+			if last := q.Get("last"); last != "" {
+				if name, ok := c.upstreamName(last); ok {
+					q.Set("last", name)
+					req.URL.RawQuery = q.Encode()
+				}
+			}
+		} else if req.URL.Path != "/v2/" && c.repoPrefix != "" {
 			req.URL.Path = re.ReplaceAllString(req.URL.Path, fmt.Sprintf("/v2/%s/", c.repoPrefix))
 		}
-		log.Printf("rewrote url: %s into %s", u, req.URL)
+		c.logf(req, "rewrote url: %s into %s", u, req.URL)
+	}
+}
+
+// isProbe reports whether req is a /v2/ ping or a HEAD request, which
+// clients send far more often than they pull.
+func isProbe(req *http.Request) bool {
+	return req.URL.Path == "/v2/" || req.Method == http.MethodHead
+}
+
+// logf logs the progress of req, unless it is a probe and probes aren't
+// logged.
+func (c registryConfig) logf(req *http.Request, format string, v ...interface{}) {
+	if c.logProbes || !isProbe(req) {
+		log.Printf(format, v...)
 	}
 }
 
+// upstreamRequestKind returns the kind of an upstream request for metrics.
+func upstreamRequestKind(req *http.Request) string {
+	if req.URL.Path == "/v2/" {
+		return "ping"
+	}
+	if rr, ok := parseRegistryPath(req.URL.Path); ok {
+		return rr.kind
+	}
+	return "other"
+}
+
+// registryRoundtripper sends requests to an upstream registry with its
+// configuration, credential and token exchange.
 type registryRoundtripper struct {
-	auth authenticator
+	cfg    registryConfig
+	auth   authenticator
+	tokens *upstreamTokens
+}
+
+// liveRoundTripper sends each request with the registryRoundtripper it
+// returns for the request's context.
+type liveRoundTripper func(ctx context.Context) *registryRoundtripper
+
+func (l liveRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return l(req.Context()).RoundTrip(req)
 }
 
 func (rrt *registryRoundtripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	log.Printf("request received. url=%s", req.URL)
+	rrt.cfg.logf(req, "request received. url=%s", req.URL)
 
-	if rrt.auth != nil {
-		req.Header.Set("Authorization", rrt.auth.AuthHeader())
+	tagsKey := rrt.cfg.tagLists.key(req)
+	if resp := rrt.cfg.tagLists.serve(req, tagsKey); resp != nil {
+		return rrt.cfg.cachePolicy.apply(resp, rrt.cfg), nil
+	}
+	if rrt.cfg.cache != nil {
+		if resp := rrt.cfg.cache.serve(req); resp != nil {
+			return watchTransfer(rrt.cfg.cachePolicy.apply(resp, rrt.cfg)), nil
+		}
+	}
+
+	// Clients ping /v2/ without credentials to learn how to authenticate,
+	// so the upstream's challenge is passed on rather than answered with
+	// the proxy's credential.
+	id := identityFromContext(req.Context())
+	ping := req.URL.Path == "/v2/" && id == nil && req.Header.Get("Authorization") == ""
+	var cred string
+	if rrt.auth != nil && !rrt.cfg.passthrough && !ping {
+		cred = rrt.auth.AuthHeader()
+	}
+	if id != nil {
+		// Never forward the client's proxy credentials to the upstream.
+		req.Header.Del("Authorization")
+		if id.upstreamAuth != "" {
+			cred = id.upstreamAuth
+		}
+	}
+	if rrt.cfg.anonymous {
+		// Public upstreams get no credentials, not even the client's.
+		cred = ""
+		req.Header.Del("Authorization")
+	}
+	scope := upstreamScope(req.URL.Path)
+	if cred != "" {
+		req.Header.Set("Authorization", cred)
+	}
+	if rrt.tokens != nil && !ping {
+		if authz := rrt.tokens.cached(cred, scope); authz != "" {
+			req.Header.Set("Authorization", authz)
+		}
 	}
 
 	origHost := req.Context().Value(ctxKeyOriginalHost).(string)
 	if ua := req.Header.Get("user-agent"); ua != "" {
-		req.Header.Set("user-agent", "gcr-proxy/0.1 customDomain/"+origHost+" "+ua)
+		req.Header.Set("user-agent", "gcr-proxy/"+version+" customDomain/"+origHost+" "+ua)
 	}
 
-	// TODO(ahmetb) remove after Google internal bug 129780113 is fixed.
-	req.Header.Set("accept", "*/*")
+	// Clients list the manifest media types they understand in the Accept
+	// header (OCI image index, OCI artifact manifests, Helm charts etc.) and
+	// the registry picks the response type from it, so it must be forwarded
+	// untouched. Only requests without any preference get the catch-all.
+	if len(req.Header["Accept"]) == 0 {
+		req.Header.Set("accept", "*/*")
+	}
 
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	var resp *http.Response
+	var err error
+	var timing *pullTiming
+	notFoundKey := rrt.cfg.notFound.key(req)
+	skipped := rrt.cfg.virtual.pull(req) && rrt.cfg.virtual.knownMissing(rrt.cfg.host, req)
+	if skipped {
+		virtualRequestsTotal.inc(rrt.cfg.host, "skipped")
+		rr, _ := parseRegistryPath(req.URL.Path)
+		resp = registryErrorResponse(req, http.StatusNotFound, upstreamErrorCode(http.StatusNotFound, rr.kind),
+			"not found on any upstream registry")
+	} else if resp = rrt.cfg.notFound.serve(req, notFoundKey); resp != nil {
+		// Remembering the miss again would keep it cached forever while
+		// clients poll for it.
+		notFoundKey = ""
+	} else {
+		req, timing = startPullTiming(req)
+		upstreamRequestsTotal.inc(upstreamRequestKind(req), req.Method)
+		resp, err = rrt.cfg.transport.RoundTrip(req)
+	}
 	if err == nil {
-		log.Printf("request completed (status=%d) url=%s", resp.StatusCode, req.URL)
+		rrt.cfg.logf(req, "request completed (status=%d) url=%s", resp.StatusCode, req.URL)
 	} else {
 		log.Printf("request failed with error: %+v", err)
+		if stale := rrt.cfg.cache.serveStaleManifest(req); stale != nil {
+			return applySchema1Policy(rrt.cfg.schema1Policy, stale), nil
+		}
 		return nil, err
 	}
-	updateTokenEndpoint(resp, origHost)
-	return resp, nil
+	var tokenErr error
+	if rrt.tokens != nil && !ping && resp.StatusCode == http.StatusUnauthorized &&
+		(req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		resp, tokenErr = rrt.retryWithToken(req, resp, cred, scope)
+	}
+	if tokenErr != nil || upstreamUnavailable(resp.StatusCode) {
+		if stale := rrt.cfg.cache.serveStaleManifest(req); stale != nil {
+			resp.Body.Close()
+			return applySchema1Policy(rrt.cfg.schema1Policy, stale), nil
+		}
+	}
+	if rrt.cfg.followRedirects {
+		resp = followBlobRedirect(resp, rrt.cfg.transport)
+	}
+	rrt.cfg.notFound.update(notFoundKey, resp)
+	if resp.StatusCode == http.StatusNotFound && rrt.cfg.virtual.pull(req) {
+		if !skipped {
+			rrt.cfg.virtual.remember(rrt.cfg.host, req)
+		}
+		if vresp := rrt.cfg.virtual.serve(req); vresp != nil {
+			resp.Body.Close()
+			resp = vresp
+		}
+	}
+	if rrt.cfg.anonymous {
+		// There is no token service on the proxy to send clients to.
+		resp.Header.Del("Www-Authenticate")
+	} else {
+		updateTokenEndpoint(resp, origHost, rrt.cfg)
+	}
+	resp = normalizeErrorResponse(resp)
+	rewriteLinks(resp, rrt.cfg)
+	resp = checkResponseHeaders(resp, rrt.cfg)
+	resp = rewriteBody(resp, rrt.cfg.maxManifestSize, tagListNames{rrt.cfg}, catalogNames{rrt.cfg})
+	resp = limitManifestSize(resp, rrt.cfg.maxManifestSize)
+	resp = rrt.cfg.tagLists.fill(tagsKey, resp, rrt.cfg.maxManifestSize)
+	resp = resumeBlobTransfers(resp, rrt.cfg.transport)
+	resp = limitBlobSize(resp, rrt.cfg.maxBlobSize, rrt.cfg.transport)
+	// Blobs are always verified before they are cached.
+	if rrt.cfg.verifyBlobs || rrt.cfg.cache != nil {
+		resp = verifyBlobDigest(resp)
+	}
+	if rrt.cfg.cache != nil {
+		resp = rrt.cfg.cache.fill(resp)
+	}
+	resp = rrt.cfg.cachePolicy.apply(resp, rrt.cfg)
+	return watchTransfer(timing.finish(applySchema1Policy(rrt.cfg.schema1Policy, resp))), nil
+}
+
+// retryWithToken answers the upstream's token challenge in resp with cred and
+// repeats req with the obtained token. It returns the original response if
+// that fails, along with the error if no token could be obtained.
+func (rrt *registryRoundtripper) retryWithToken(req *http.Request, resp *http.Response, cred, scope string) (*http.Response, error) {
+	start := time.Now()
+	authz, err := rrt.tokens.exchange(resp.Header.Get("www-authenticate"), scope, cred)
+	pullTimingFromContext(req.Context()).addToken(time.Since(start))
+	if err != nil {
+		log.Printf("upstream token exchange failed for url=%s: %+v", req.URL, err)
+		return resp, err
+	}
+	req.Header.Set("Authorization", authz)
+	upstreamRequestsTotal.inc(upstreamRequestKind(req), req.Method)
+	retry, err := rrt.cfg.transport.RoundTrip(req)
+	if err != nil {
+		log.Printf("request failed with error: %+v", err)
+		return resp, nil
+	}
+	resp.Body.Close()
+	rrt.cfg.logf(req, "request completed with upstream token (status=%d) url=%s", retry.StatusCode, req.URL)
+	return retry, nil
+}
+
+// upstreamUnavailable reports whether an upstream response with status means
+// that the registry can't serve requests at the moment.
+func upstreamUnavailable(status int) bool {
+	return status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
+}
+
+// upstreamScope returns the token scope needed to pull from the upstream
+// repository addressed by path, or "" for paths outside of repositories.
+func upstreamScope(path string) string {
+	rr, ok := parseRegistryPath(path)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("repository:%s:pull", rr.name)
 }
 
 // updateTokenEndpoint modifies the response header like:
-//    Www-Authenticate: Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+//
+//	Www-Authenticate: Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:prefix/foo:pull"
+//
 // to point to the https://host/token endpoint to force using local token
-// endpoint proxy.
-func updateTokenEndpoint(resp *http.Response, host string) {
+// endpoint proxy. The service is replaced with the proxy's host and the
+// repository names in the scope with the names the client knows, since
+// clients echo these values back to the token endpoint, where
+// tokenProxyHandler restores the upstream's values.
+func updateTokenEndpoint(resp *http.Response, host string, cfg registryConfig) {
 	v := resp.Header.Get("www-authenticate")
 	if v == "" {
 		return
 	}
 	cur := fmt.Sprintf("https://%s/_token", host)
-	resp.Header.Set("www-authenticate", realm.ReplaceAllString(v, fmt.Sprintf(`realm="%s"`, cur)))
+	v = realm.ReplaceAllString(v, fmt.Sprintf(`realm="%s"`, cur))
+	v = challengeService.ReplaceAllString(v, fmt.Sprintf(`service="%s"`, host))
+	v = challengeScope.ReplaceAllStringFunc(v, func(m string) string {
+		scope := challengeScope.FindStringSubmatch(m)[1]
+		return fmt.Sprintf(`scope="%s"`, rewriteScope(scope, cfg.clientName))
+	})
+	resp.Header.Set("www-authenticate", v)
+}
+
+// rewriteScope maps the repository names in a space separated list of token
+// scopes like "repository:foo:pull,push" with the mapping function. Scopes
+// whose name is not mapped (mapping returns false) are left as is.
+func rewriteScope(scope string, mapping func(string) (string, bool)) string {
+	return mapScope(scope, mapping, true)
+}
+
+// servedScope maps the repository names of the token scopes a client asks
+// for to upstream names. Scopes whose name is not mapped, like repositories
+// denied by REPO_RULES, are left out, so clients can't get tokens for
+// upstream repositories the proxy doesn't serve them.
+func servedScope(scope string, mapping func(string) (string, bool)) string {
+	return mapScope(scope, mapping, false)
+}
+
+func mapScope(scope string, mapping func(string) (string, bool), keepUnmapped bool) string {
+	var out []string
+	for _, p := range strings.Fields(scope) {
+		fields := strings.Split(p, ":")
+		if len(fields) < 3 || fields[0] != "repository" {
+			out = append(out, p)
+			continue
+		}
+		// Repository names may contain a registry port, so the name spans
+		// everything between the resource type and the actions.
+		name := strings.Join(fields[1:len(fields)-1], ":")
+		if mapped, ok := mapping(name); ok {
+			out = append(out, "repository:"+mapped+":"+fields[len(fields)-1])
+		} else if keepUnmapped {
+			out = append(out, p)
+		}
+	}
+	return strings.Join(out, " ")
 }
 
 type authenticator interface {
@@ -270,6 +1036,33 @@ type metadataServerAuth struct {
 	authToken string
 	ExpiresIn int
 	t         *time.Timer
+
+	// account is the service account to get tokens for, "default" if empty.
+	account string
+	// audience selects identity tokens for this audience instead of access
+	// tokens if set.
+	audience string
+	health   credentialHealth
+}
+
+// newRegistryMetadataAuth returns an initialized metadataServerAuth for the
+// upstream registry, configured by METADATA_SERVICE_ACCOUNT,
+// METADATA_TOKEN_TYPE and METADATA_TOKEN_AUDIENCE.
+func newRegistryMetadataAuth() *metadataServerAuth {
+	m := &metadataServerAuth{account: os.Getenv("METADATA_SERVICE_ACCOUNT")}
+	switch typ := os.Getenv("METADATA_TOKEN_TYPE"); typ {
+	case "", "access":
+	case "identity":
+		m.audience = os.Getenv("METADATA_TOKEN_AUDIENCE")
+		if m.audience == "" {
+			m.audience = "https://" + os.Getenv("REGISTRY_HOST")
+		}
+		log.Printf("using identity tokens for audience %s", m.audience)
+	default:
+		log.Fatalf("invalid METADATA_TOKEN_TYPE %q, expected access or identity", typ)
+	}
+	m.Init()
+	return m
 }
 
 func (m *metadataServerAuth) AuthHeader() string {
@@ -279,29 +1072,68 @@ func (m *metadataServerAuth) AuthHeader() string {
 }
 
 func (m *metadataServerAuth) Init() {
-	m.updateToken()
+	if err := m.updateToken(); err != nil {
+		log.Fatalf("could not get token from metadata server: %+v", err)
+	}
 
 	go m.updateTokenTimer()
 }
 
-func (m *metadataServerAuth) updateToken() {
-	authToken, expiresIn, err := getAuthToken("metadata")
+func (m *metadataServerAuth) expiry() time.Time { return m.health.expiry() }
+
+func (m *metadataServerAuth) updateToken() error {
+	account := m.account
+	if account == "" {
+		account = "default"
+	}
+	var authToken string
+	var expiresIn int
+	var err error
+	if m.audience != "" {
+		authToken, expiresIn, err = getIdentityToken(account, m.audience)
+	} else {
+		authToken, expiresIn, err = getAuthToken("metadata", account)
+	}
 	if err != nil {
-		log.Fatalf("could not get token from metadata server: %+v", err)
+		return err
 	}
 
 	m.Lock()
 	defer m.Unlock()
 	m.ExpiresIn = expiresIn
 	m.authToken = authToken
-	m.t = time.NewTimer(time.Duration(m.ExpiresIn)*time.Second - 5*time.Minute)
+	m.t = time.NewTimer(tokenRefreshInterval(time.Duration(expiresIn) * time.Second))
+	m.health.refreshed(time.Now().Add(time.Duration(expiresIn) * time.Second))
+	return nil
+}
+
+// tokenRefreshInterval returns when to refresh a token valid for lifetime:
+// five minutes before it expires, but not before half of it passed, and not
+// sooner than credentialRetryInterval, so short or missing lifetimes don't
+// make the proxy refresh in a loop.
+func tokenRefreshInterval(lifetime time.Duration) time.Duration {
+	d := lifetime - 5*time.Minute
+	if d < lifetime/2 {
+		d = lifetime / 2
+	}
+	if d < credentialRetryInterval {
+		d = credentialRetryInterval
+	}
+	return d
 }
 
 func (m *metadataServerAuth) updateTokenTimer() {
 	for {
 		<-m.t.C
 		fmt.Println(time.Now(), "Update authToken")
-		m.updateToken()
+		if err := m.updateToken(); err != nil {
+			// The current token stays valid for a few more minutes.
+			log.Printf("could not refresh token from metadata server: %+v", err)
+			m.health.failed(err)
+			m.Lock()
+			m.t = time.NewTimer(credentialRetryInterval)
+			m.Unlock()
+		}
 	}
 }
 
@@ -311,8 +1143,32 @@ type token struct {
 	TokenType   string `json:"token_type"`
 }
 
-func getAuthToken(host string) (string, int, error) {
-	url := fmt.Sprintf("http://%s/computeMetadata/v1/instance/service-accounts/default/token", host)
+// getMetadata reads a value from the GCE metadata server, e.g.
+// "instance/service-accounts/default/email".
+func getMetadata(path string) (string, error) {
+	url := "http://metadata/computeMetadata/v1/" + path
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to make request %s: %+v", url, err)
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to query the host %s: %+v", url, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response from %s: %+v", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned status %d for %s: %s", resp.StatusCode, url, b)
+	}
+	return string(b), nil
+}
+
+func getAuthToken(host, account string) (string, int, error) {
+	url := fmt.Sprintf("http://%s/computeMetadata/v1/instance/service-accounts/%s/token", host, account)
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -321,25 +1177,46 @@ func getAuthToken(host string) (string, int, error) {
 
 	req.Header.Add("Metadata-Flavor", "Google")
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: 10 * time.Second}
 
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", 0, fmt.Errorf("failed to query the host %s: %+v", url, err)
 	}
 
-	body, readErr := ioutil.ReadAll(resp.Body)
-	if readErr != nil {
-		log.Fatal(readErr)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, defaultMaxTokenResponseSize))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read response from %s: %+v", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("metadata server returned status %d for %s: %s", resp.StatusCode, url, body)
 	}
 
 	token := token{}
-	jsonErr := json.Unmarshal(body, &token)
-	if jsonErr != nil {
-		log.Fatalf("error: %s data: %s", jsonErr, body)
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, fmt.Errorf("invalid token response from %s: %+v", url, err)
+	}
+	if token.AccessToken == "" {
+		return "", 0, fmt.Errorf("metadata server returned no access token for %s", url)
 	}
 
 	auth := fmt.Sprintf("%s %s", token.TokenType, token.AccessToken)
 
 	return auth, token.ExpiresIn, nil
 }
+
+// getIdentityToken returns an Authorization header value with an identity
+// token of account for audience, and its lifetime in seconds.
+func getIdentityToken(account, audience string) (string, int, error) {
+	jwt, err := getMetadata(fmt.Sprintf("instance/service-accounts/%s/identity?audience=%s&format=full",
+		account, url.QueryEscape(audience)))
+	if err != nil {
+		return "", 0, err
+	}
+	exp, ok := jwtExpiry(jwt)
+	if !ok {
+		return "", 0, fmt.Errorf("metadata server returned a malformed identity token")
+	}
+	return "Bearer " + jwt, int(time.Until(exp) / time.Second), nil
+}
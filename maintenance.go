@@ -0,0 +1,216 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const defaultMaintenanceMessage = "the registry is down for maintenance, please try again later"
+
+// maintenanceMode rejects registry API requests with 503 and an explanation
+// while the upstream is under planned maintenance, so it doesn't look like
+// random failures to users. It is switched on with MAINTENANCE_MODE or on
+// /_admin/maintenance.
+type maintenanceMode struct {
+	cfg registryConfig
+	// serveCached answers the pulls the cache can serve during maintenance.
+	serveCached bool
+	// live holds the maintenanceState.
+	live *liveConfig
+}
+
+// maintenanceState is the state of the maintenance mode, as shown on
+// /_admin/maintenance.
+type maintenanceState struct {
+	Enabled    bool       `json:"enabled"`
+	Since      *time.Time `json:"since,omitempty"`
+	Message    string     `json:"message"`
+	RetryAfter string     `json:"retry_after"`
+
+	retryAfter time.Duration
+}
+
+// getMaintenanceMode returns the maintenance mode configured by
+// MAINTENANCE_MODE, MAINTENANCE_MESSAGE, MAINTENANCE_RETRY_AFTER and
+// MAINTENANCE_SERVE_CACHED, and publishes its state to live.
+func getMaintenanceMode(cfg registryConfig, live *liveConfig) *maintenanceMode {
+	m := &maintenanceMode{cfg: cfg, serveCached: os.Getenv("MAINTENANCE_SERVE_CACHED") != "", live: live}
+	if m.serveCached && cfg.cache == nil {
+		log.Fatal("MAINTENANCE_SERVE_CACHED requires a cache, set CACHE_URL")
+	}
+	message := os.Getenv("MAINTENANCE_MESSAGE")
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	retryAfter := 5 * time.Minute
+	if v := os.Getenv("MAINTENANCE_RETRY_AFTER"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second {
+			log.Fatalf("invalid MAINTENANCE_RETRY_AFTER %q, expected a duration of at least 1s", v)
+		}
+		retryAfter = d
+	}
+	m.set(os.Getenv("MAINTENANCE_MODE") != "", message, retryAfter)
+	newGaugeFunc("registry_proxy_maintenance", "Whether the proxy is in maintenance mode.", func() float64 {
+		if m.current().Enabled {
+			return 1
+		}
+		return 0
+	})
+	return m
+}
+
+func (m *maintenanceMode) current() maintenanceState {
+	return m.live.load().maintenance
+}
+
+// set switches the maintenance mode on or off. A non-empty message and a
+// non-zero retryAfter replace those of the current state.
+func (m *maintenanceMode) set(enabled bool, message string, retryAfter time.Duration) {
+	var was, state maintenanceState
+	m.live.update(func(s *configSnapshot) {
+		was = s.maintenance
+		st := &s.maintenance
+		if message != "" {
+			st.Message = message
+		}
+		if retryAfter > 0 {
+			st.retryAfter, st.RetryAfter = retryAfter, retryAfter.String()
+		}
+		if st.Enabled != enabled {
+			st.Enabled = enabled
+			st.Since = nil
+			if enabled {
+				now := time.Now()
+				st.Since = &now
+			}
+		}
+		state = *st
+	})
+	switch {
+	case state.Enabled && !was.Enabled:
+		log.Printf("maintenance mode enabled: %s", state.Message)
+	case !state.Enabled && was.Enabled:
+		log.Printf("maintenance mode disabled")
+	}
+}
+
+// middleware answers registry API requests during maintenance, from the
+// cache if possible and otherwise with 503.
+func (m *maintenanceMode) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		state := m.live.get(req.Context()).maintenance
+		if !state.Enabled {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if m.serveCached && m.serveFromCache(w, req) {
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(state.retryAfter/time.Second)))
+		writeRegistryError(w, http.StatusServiceUnavailable, "UNAVAILABLE", state.Message)
+	})
+}
+
+// serveFromCache answers pulls of cached blobs and, if stale manifests are
+// served, of cached manifests. It reports whether req was answered.
+func (m *maintenanceMode) serveFromCache(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.URL.Path == "/v2/" {
+		handleRegistryAPIVersion(w, req)
+		return true
+	}
+	rr, ok := parseRegistryPath(req.URL.Path)
+	if !ok || m.cfg.denial(rr.name) != nil {
+		return false
+	}
+	name, ok := m.cfg.upstreamName(rr.name)
+	if !ok {
+		return false
+	}
+	// The cache is keyed by the names of the upstream.
+	r := new(http.Request)
+	*r = *req
+	u := *req.URL
+	u.Path, u.RawPath = fmt.Sprintf("/v2/%s/%s/%s", name, rr.kind, rr.reference), ""
+	r.URL = &u
+	var resp *http.Response
+	switch rr.kind {
+	case "blobs":
+		resp = m.cfg.cache.serve(r)
+	case "manifests":
+		resp = m.cfg.cache.serveStaleManifest(r)
+	}
+	if resp == nil {
+		return false
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
+}
+
+// handler shows the maintenance mode on GET, enables it on POST and disables
+// it on DELETE. The JSON body of a POST may set the message and retry_after
+// of this maintenance.
+func (m *maintenanceMode) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var body struct {
+				Message    string `json:"message"`
+				RetryAfter string `json:"retry_after"`
+			}
+			if req.ContentLength != 0 {
+				if err := json.NewDecoder(io.LimitReader(req.Body, 64*1024)).Decode(&body); err != nil {
+					http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+					return
+				}
+			}
+			var retryAfter time.Duration
+			if body.RetryAfter != "" {
+				d, err := time.ParseDuration(body.RetryAfter)
+				if err != nil || d < time.Second {
+					http.Error(w, fmt.Sprintf("invalid retry_after %q", body.RetryAfter), http.StatusBadRequest)
+					return
+				}
+				retryAfter = d
+			}
+			m.set(true, body.Message, retryAfter)
+		case http.MethodDelete:
+			m.set(false, "", 0)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, m.current())
+	}
+}
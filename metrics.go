@@ -0,0 +1,264 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is implemented by everything that can be written in the Prometheus
+// text exposition format.
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []metric
+)
+
+func registerMetric(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics = append(metrics, m)
+}
+
+// metricsHandler serves all registered metrics in the Prometheus text format.
+func metricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		metricsMu.Lock()
+		for _, m := range metrics {
+			m.write(bw)
+		}
+		metricsMu.Unlock()
+		bw.Flush()
+	}
+}
+
+// counterVec is a counter partitioned by a fixed set of labels.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	registerMetric(c)
+	return c
+}
+
+// add increases the counter for labelValues, given in the order the labels
+// were declared.
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) inc(labelValues ...string) { c.add(1, labelValues...) }
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, strings.Split(k, "\xff")), formatValue(c.values[k]))
+	}
+}
+
+// gaugeFunc is a gauge whose value is computed when metrics are collected.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	registerMetric(g)
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.fn()))
+}
+
+// histogramVec is a histogram partitioned by a fixed set of labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	// counts holds the number of observations per bucket, not cumulative,
+	// and one more for those above the last bucket.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// newHistogramVec returns a histogram with the given upper bucket bounds,
+// which must be sorted.
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+	registerMetric(h)
+	return h
+}
+
+// observe adds v to the histogram for labelValues, given in the order the
+// labels were declared.
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	hv := h.values[key]
+	if hv == nil {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hv
+	}
+	hv.counts[i]++
+	hv.count++
+	hv.sum += v
+	h.mu.Unlock()
+}
+
+// quantile estimates the q-quantile of the observations for labelValues by
+// linear interpolation within their bucket, like Prometheus'
+// histogram_quantile. It returns 0 without observations, and the last bucket
+// bound for observations above it.
+func (h *histogramVec) quantile(q float64, labelValues ...string) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv := h.values[strings.Join(labelValues, "\xff")]
+	if hv == nil || hv.count == 0 {
+		return 0
+	}
+	rank := q * float64(hv.count)
+	var seen float64
+	for i, n := range hv.counts {
+		if i == len(h.buckets) {
+			break
+		}
+		if seen+float64(n) >= rank && n > 0 {
+			lower := 0.0
+			if i > 0 {
+				lower = h.buckets[i-1]
+			}
+			return lower + (h.buckets[i]-lower)*(rank-seen)/float64(n)
+		}
+		seen += float64(n)
+	}
+	return h.buckets[len(h.buckets)-1]
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	names := append(append([]string(nil), h.labels...), "le")
+	for _, k := range keys {
+		hv := h.values[k]
+		values := strings.Split(k, "\xff")
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += hv.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, append(values, formatValue(b))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, append(values, "+Inf")), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatValue(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), hv.count)
+	}
+}
+
+// infoMetric is a gauge that is always 1, with labels describing the
+// process, like its version.
+type infoMetric struct {
+	name   string
+	help   string
+	labels []string
+	values func() []string
+}
+
+func newInfoMetric(name, help string, values func() []string, labels ...string) *infoMetric {
+	m := &infoMetric{name: name, help: help, labels: labels, values: values}
+	registerMetric(m)
+	return m
+}
+
+func (m *infoMetric) write(w io.Writer) {
+	writeHeader(w, m.name, m.help, "gauge")
+	fmt.Fprintf(w, "%s%s 1\n", m.name, formatLabels(m.labels, m.values()))
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		b.WriteString(n)
+		b.WriteString("=")
+		b.WriteString(strconv.Quote(v))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
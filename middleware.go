@@ -0,0 +1,81 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// trustForwardedFor makes clientIP use the address appended to
+// X-Forwarded-For by the load balancer in front of the proxy (e.g. Cloud Run).
+var trustForwardedFor = os.Getenv("TRUST_X_FORWARDED_FOR") != ""
+
+// clientIP returns the address of the client that sent req.
+func clientIP(req *http.Request) string {
+	if trustForwardedFor {
+		if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// clientID identifies the client of req for accounting: the authenticated
+// username if there is one, otherwise the client's address.
+func clientID(req *http.Request) string {
+	if id := identityFromContext(req.Context()); id != nil {
+		return "user:" + id.username
+	}
+	return clientIP(req)
+}
+
+// countingResponseWriter records the status code and the number of body
+// bytes written to the wrapped ResponseWriter.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,475 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMirrorInterval = time.Hour
+	// mirrorBlobTimeout bounds the download of a single blob by the mirror.
+	mirrorBlobTimeout = 30 * time.Minute
+)
+
+var mirrorSyncsTotal = newCounterVec("registry_proxy_mirror_syncs_total",
+	"Mirror sync runs per configured image and result (ok or error).", "image", "result")
+
+// mirrorConfig lists the images that are kept in the cache ahead of pulls.
+type mirrorConfig struct {
+	// Images are references like "library/nginx:1.25", "team/app:v*" (tags
+	// in path.Match syntax) or "team/app@sha256:...".
+	Images []string `json:"images"`
+	// Interval is the time between sync runs, like "15m".
+	Interval string `json:"interval"`
+	// Platforms limits multi-platform images to these platforms, like
+	// "linux/amd64" or "linux/arm/v7". All platforms are mirrored if empty.
+	Platforms []string `json:"platforms"`
+}
+
+// mirrorImage is a parsed entry of mirrorConfig.Images.
+type mirrorImage struct {
+	// ref is the entry as configured.
+	ref  string
+	name string
+	// tag is a tag pattern, or a digest.
+	tag string
+}
+
+// mirrorSettings are the parsed mirror section of the config file.
+type mirrorSettings struct {
+	images    []mirrorImage
+	interval  time.Duration
+	platforms []imagePlatform
+}
+
+// mirrorStatus is the result of the last sync of an image, served on the
+// admin API.
+type mirrorStatus struct {
+	Image string `json:"image"`
+	// Tags maps the synced tags to the digest of their manifest.
+	Tags      map[string]string `json:"tags"`
+	LastSync  *time.Time        `json:"last_sync,omitempty"`
+	LastError string            `json:"last_error,omitempty"`
+
+	// blobs maps the synced tags to the digests of the blobs they use, for
+	// the platforms they were synced for.
+	blobs     map[string][]string
+	platforms []imagePlatform
+}
+
+// mirror periodically resolves the configured images and pulls manifests
+// and blobs that changed since the last run through the cache, so the
+// proxy works like a mirror of them.
+type mirror struct {
+	up    *upstreamClient
+	cache *blobCache
+	// leader is the leader election of the replicas, if enabled. Only the
+	// leader syncs images.
+	leader *leaderElector
+
+	// live holds the mirrorSettings, which change when the config file is
+	// reloaded.
+	live *liveConfig
+
+	mu sync.Mutex
+	// status maps the images that were synced to the result.
+	status map[string]*mirrorStatus
+}
+
+// getMirror returns the mirror configured in the config file, or nil if no
+// images are listed. The settings are published to live.
+func getMirror(mc mirrorConfig, cfg registryConfig, auth authenticator, live *liveConfig) *mirror {
+	if len(mc.Images) == 0 {
+		return nil
+	}
+	if cfg.cache == nil {
+		log.Fatal("mirroring images requires a cache, set CACHE_URL")
+	}
+	m := &mirror{
+		up:     newUpstreamClient(cfg, auth),
+		cache:  cfg.cache,
+		live:   live,
+		status: map[string]*mirrorStatus{},
+	}
+	m.up.client.Timeout = mirrorBlobTimeout
+	settings, err := parseMirrorSettings(mc, cfg)
+	if err != nil {
+		log.Fatalf("invalid mirror configuration: %+v", err)
+	}
+	live.update(func(s *configSnapshot) { s.mirror = settings })
+	log.Printf("mirroring %d images every %s", len(settings.images), settings.interval)
+	return m
+}
+
+// parseMirrorSettings returns the settings of mc.
+func parseMirrorSettings(mc mirrorConfig, cfg registryConfig) (mirrorSettings, error) {
+	images, interval, err := parseMirrorConfig(mc, cfg)
+	if err != nil {
+		return mirrorSettings{}, err
+	}
+	platforms, err := parseMirrorPlatforms(mc.Platforms)
+	if err != nil {
+		return mirrorSettings{}, err
+	}
+	return mirrorSettings{images: images, interval: interval, platforms: platforms}, nil
+}
+
+// parseMirrorConfig returns the images and the interval of mc.
+func parseMirrorConfig(mc mirrorConfig, cfg registryConfig) ([]mirrorImage, time.Duration, error) {
+	interval := defaultMirrorInterval
+	if mc.Interval != "" {
+		d, err := time.ParseDuration(mc.Interval)
+		if err != nil || d <= 0 {
+			return nil, 0, fmt.Errorf("invalid interval %q", mc.Interval)
+		}
+		interval = d
+	}
+	var images []mirrorImage
+	for _, ref := range mc.Images {
+		img, err := parseMirrorImage(ref)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, ok := cfg.upstreamName(img.name); !ok {
+			return nil, 0, fmt.Errorf("image %q: repository is not served by this proxy", ref)
+		}
+		images = append(images, img)
+	}
+	return images, interval, nil
+}
+
+// parseMirrorPlatforms parses platforms like "linux/amd64" or "linux/arm/v7".
+func parseMirrorPlatforms(platforms []string) ([]imagePlatform, error) {
+	var out []imagePlatform
+	for _, p := range platforms {
+		parts := strings.Split(p, "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid platform %q, expected os/architecture or os/architecture/variant", p)
+		}
+		ip := imagePlatform{OS: parts[0], Architecture: parts[1]}
+		if len(parts) == 3 {
+			ip.Variant = parts[2]
+		}
+		out = append(out, ip)
+	}
+	return out, nil
+}
+
+// wantsPlatform reports whether the manifest for p of a multi-platform image
+// is mirrored when mirroring platforms. Manifests without a platform are
+// always mirrored, a platform without a variant matches all variants.
+func wantsPlatform(platforms []imagePlatform, p *imagePlatform) bool {
+	if len(platforms) == 0 || p == nil {
+		return true
+	}
+	for _, want := range platforms {
+		if want.OS == p.OS && want.Architecture == p.Architecture && (want.Variant == "" || want.Variant == p.Variant) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloader returns the configReloader for the mirror section of the config
+// file.
+func (m *mirror) reloader(cfg registryConfig) configReloader {
+	return func(fc fileConfig) (func(*configSnapshot), error) {
+		if len(fc.Mirror.Images) == 0 {
+			return nil, fmt.Errorf("mirror: removing all images requires a restart")
+		}
+		settings, err := parseMirrorSettings(fc.Mirror, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("mirror: %v", err)
+		}
+		return func(s *configSnapshot) { s.mirror = settings }, nil
+	}
+}
+
+// mirrored reports whether the image ref is in the current settings.
+func (m *mirror) mirrored(ref string) bool {
+	for _, img := range m.live.load().mirror.images {
+		if img.ref == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMirrorImage parses a reference like parseReference, but allows tag
+// patterns.
+func parseMirrorImage(ref string) (mirrorImage, error) {
+	img := mirrorImage{ref: ref, name: ref, tag: "latest"}
+	if i := strings.Index(ref, "@"); i >= 0 {
+		img.name, img.tag = ref[:i], ref[i+1:]
+	} else if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		img.name, img.tag = ref[:i], ref[i+1:]
+	}
+	if !referenceName.MatchString(img.name) {
+		return img, fmt.Errorf("invalid repository name in %q", ref)
+	}
+	if _, err := path.Match(img.tag, ""); err != nil || img.tag == "" {
+		return img, fmt.Errorf("invalid tag pattern in %q", ref)
+	}
+	return img, nil
+}
+
+// run syncs all images every interval while this replica is the leader. It
+// never returns.
+func (m *mirror) run() {
+	for {
+		if !m.leader.isLeader() {
+			time.Sleep(leaderRetryInterval)
+			continue
+		}
+		settings := m.live.load().mirror
+		for _, img := range settings.images {
+			m.syncImage(img, settings.platforms)
+		}
+		// Forget the status of images removed from the config file.
+		m.mu.Lock()
+		for ref := range m.status {
+			if !m.mirrored(ref) {
+				delete(m.status, ref)
+			}
+		}
+		m.mu.Unlock()
+		time.Sleep(settings.interval)
+	}
+}
+
+func (m *mirror) syncImage(img mirrorImage, platforms []imagePlatform) {
+	synced, syncedBlobs := map[string]string{}, map[string][]string{}
+	m.mu.Lock()
+	if st := m.status[img.ref]; st != nil {
+		for k, v := range st.Tags {
+			synced[k] = v
+		}
+		// The blobs of other platforms don't tell whether the tags are
+		// synced for these.
+		if samePlatforms(st.platforms, platforms) {
+			for k, v := range st.blobs {
+				syncedBlobs[k] = v
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	tags, err := m.resolveTags(img)
+	result, resultBlobs := map[string]string{}, map[string][]string{}
+	for _, tag := range tags {
+		var digest string
+		var blobs []string
+		digest, blobs, err = m.syncTag(img.name, tag, platforms, synced[tag], syncedBlobs[tag])
+		if err != nil {
+			break
+		}
+		result[tag], resultBlobs[tag] = digest, blobs
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.mirrored(img.ref) {
+		// The image was removed from the config file during the sync.
+		return
+	}
+	st := m.status[img.ref]
+	if st == nil {
+		st = &mirrorStatus{Image: img.ref, Tags: map[string]string{}}
+		m.status[img.ref] = st
+	}
+	st.LastSync = &now
+	if err != nil {
+		log.Printf("mirror sync of %s failed: %+v", st.Image, err)
+		mirrorSyncsTotal.inc(st.Image, "error")
+		st.LastError = err.Error()
+		return
+	}
+	mirrorSyncsTotal.inc(st.Image, "ok")
+	st.LastError = ""
+	st.Tags, st.blobs, st.platforms = result, resultBlobs, platforms
+}
+
+func samePlatforms(a, b []imagePlatform) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveTags returns the tags or digest of the repository that img covers.
+func (m *mirror) resolveTags(img mirrorImage) ([]string, error) {
+	if isDigest(img.tag) || !strings.ContainsAny(img.tag, "*?[") {
+		return []string{img.tag}, nil
+	}
+	all, err := m.up.listTags(img.name)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, t := range all {
+		if ok, _ := path.Match(img.tag, t); ok {
+			tags = append(tags, t)
+		}
+	}
+	return tags, nil
+}
+
+// syncTag pulls the manifest tag refers to for platforms and returns its
+// digest and the blobs it uses. If the digest is still prev, only the blobs
+// synced before are checked, which keeps their references in the cache
+// alive.
+func (m *mirror) syncTag(name, tag string, platforms []imagePlatform, prev string, prevBlobs []string) (string, []string, error) {
+	info, err := m.up.headManifest(name, tag)
+	if err != nil {
+		return "", nil, err
+	}
+	if !info.Exists {
+		return "", nil, fmt.Errorf("manifest %s:%s not found", name, tag)
+	}
+	if info.Digest != "" && info.Digest == prev && prevBlobs != nil {
+		for _, d := range prevBlobs {
+			if err := m.syncBlob(name, d); err != nil {
+				return "", nil, err
+			}
+		}
+		return prev, prevBlobs, nil
+	}
+	log.Printf("mirror: syncing %s:%s", name, tag)
+	return m.syncManifest(name, tag, platforms)
+}
+
+// syncManifest pulls the manifest and everything it references into the
+// cache, and returns its digest and the blobs it uses. Of multi-platform
+// images, only platforms are pulled.
+func (m *mirror) syncManifest(name, reference string, platforms []imagePlatform) (string, []string, error) {
+	resp, err := m.up.get(http.MethodGet, name, "manifests", reference, manifestAcceptTypes)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("upstream returned status %d for manifest %s:%s", resp.StatusCode, name, reference)
+	}
+	resp = m.cache.fill(resp)
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, m.up.cfg.maxManifestSize))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read manifest %s:%s: %+v", name, reference, err)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+	}
+
+	type descriptor struct {
+		Digest   string         `json:"digest"`
+		Platform *imagePlatform `json:"platform"`
+	}
+	var mf struct {
+		Manifests []descriptor `json:"manifests"`
+		Config    *descriptor  `json:"config"`
+		Layers    []descriptor `json:"layers"`
+		Blobs     []descriptor `json:"blobs"`
+	}
+	if err := json.Unmarshal(b, &mf); err != nil {
+		return "", nil, fmt.Errorf("invalid manifest %s:%s: %+v", name, reference, err)
+	}
+	synced := []string{}
+	for _, d := range mf.Manifests {
+		if !wantsPlatform(platforms, d.Platform) {
+			continue
+		}
+		_, blobs, err := m.syncManifest(name, d.Digest, platforms)
+		if err != nil {
+			return "", nil, err
+		}
+		synced = append(synced, blobs...)
+	}
+	blobs := append(mf.Layers, mf.Blobs...)
+	if mf.Config != nil {
+		blobs = append(blobs, *mf.Config)
+	}
+	for _, d := range blobs {
+		if err := m.syncBlob(name, d.Digest); err != nil {
+			return "", nil, err
+		}
+		synced = append(synced, d.Digest)
+	}
+	return digest, synced, nil
+}
+
+// syncBlob downloads the blob into the cache, unless it is already there,
+// and records that the repository uses it.
+func (m *mirror) syncBlob(name, digest string) error {
+	if _, err := m.cache.store.stat(context.Background(), m.cache.digestKey(digest)); err == nil {
+		if upstreamName, ok := m.up.cfg.upstreamName(name); ok {
+			m.cache.refs.touchRef(digest, upstreamName)
+		}
+		return nil
+	}
+	resp, err := m.up.get(http.MethodGet, name, "blobs", digest, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream returned status %d for blob %s@%s", resp.StatusCode, name, digest)
+	}
+	// Registries redirect blob downloads to their storage, the blob is
+	// verified and cached under the path it was requested with.
+	for resp.Request.Response != nil {
+		resp.Request = resp.Request.Response.Request
+	}
+	resp = m.cache.fill(verifyBlobDigest(resp))
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return fmt.Errorf("failed to download blob %s@%s: %+v", name, digest, err)
+	}
+	return nil
+}
+
+// handler serves the status of all mirrored images.
+func (m *mirror) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		images := m.live.load().mirror.images
+		out := make([]mirrorStatus, len(images))
+		m.mu.Lock()
+		for i, img := range images {
+			out[i] = mirrorStatus{Image: img.ref, Tags: map[string]string{}}
+			if st := m.status[img.ref]; st != nil {
+				out[i] = *st
+			}
+		}
+		m.mu.Unlock()
+		writeJSON(w, http.StatusOK, out)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMirrorAppliesReloadedPlatforms(t *testing.T) {
+	content := map[string][]byte{}
+	add := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		d := sha256Digest(b)
+		content[d] = b
+		return d
+	}
+	platformManifest := func(arch string) string {
+		layer := add(arch + " layer")
+		return add(map[string]interface{}{"layers": []map[string]string{{"digest": layer}}})
+	}
+	amd64, arm64 := platformManifest("amd64"), platformManifest("arm64")
+	index := add(map[string]interface{}{"manifests": []map[string]interface{}{
+		{"digest": amd64, "platform": imagePlatform{OS: "linux", Architecture: "amd64"}},
+		{"digest": arm64, "platform": imagePlatform{OS: "linux", Architecture: "arm64"}},
+	}})
+
+	var mu sync.Mutex
+	fetched := map[string]int{}
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rr, ok := parseRegistryPath(req.URL.Path)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		digest := rr.reference
+		if digest == "latest" {
+			digest = index
+		}
+		b, ok := content[digest]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		mu.Lock()
+		fetched[digest]++
+		mu.Unlock()
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		w.Write(b)
+	}))
+	defer upstream.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(upstream.Certificate())
+	cfg := registryConfig{
+		host:            strings.TrimPrefix(upstream.URL, "https://"),
+		transport:       &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		maxManifestSize: defaultMaxManifestSize,
+	}
+	_, cache := newMemCache()
+	m := &mirror{up: newUpstreamClient(cfg, nil), cache: cache, status: map[string]*mirrorStatus{}}
+	img := mirrorImage{ref: "library/app:latest", name: "library/app", tag: "latest"}
+	m.live = newLiveConfig()
+	m.live.update(func(s *configSnapshot) { s.mirror = mirrorSettings{images: []mirrorImage{img}} })
+
+	m.syncImage(img, []imagePlatform{{OS: "linux", Architecture: "amd64"}})
+	if fetched[arm64] != 0 {
+		t.Fatal("synced the arm64 manifest, which is not mirrored")
+	}
+	m.syncImage(img, []imagePlatform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}})
+	if fetched[arm64] != 1 {
+		t.Errorf("the arm64 manifest was fetched %d times after adding its platform, want 1", fetched[arm64])
+	}
+	if st := m.status[img.ref]; st == nil || st.LastError != "" || st.Tags["latest"] != index {
+		t.Errorf("unexpected mirror status %+v", st)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxNegativeEntries bounds the number of misses remembered by a
+// negativeCache.
+const maxNegativeEntries = 10000
+
+var notFoundCacheRequestsTotal = newCounterVec("registry_proxy_not_found_cache_requests_total",
+	"Manifest and blob pulls answered with a remembered 404 (hit) or sent to the upstream (miss).", "result")
+
+// negativeCache remembers keys of requests an upstream answered with 404
+// until their ttl passes.
+type negativeCache struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	misses map[string]time.Time
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{ttl: ttl, misses: make(map[string]time.Time)}
+}
+
+// has reports whether key was added less than ttl ago.
+func (c *negativeCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.misses[key]
+	if ok && time.Now().After(t) {
+		delete(c.misses, key)
+		return false
+	}
+	return ok
+}
+
+// add remembers key for ttl. Keys are dropped once maxNegativeEntries are
+// remembered and none of them expired.
+func (c *negativeCache) add(key string) {
+	if c.ttl == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.misses) >= maxNegativeEntries {
+		for k, t := range c.misses {
+			if now.After(t) {
+				delete(c.misses, k)
+			}
+		}
+		if len(c.misses) >= maxNegativeEntries {
+			return
+		}
+	}
+	c.misses[key] = now.Add(c.ttl)
+}
+
+// forget drops the keys starting with prefix.
+func (c *negativeCache) forget(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.misses {
+		if strings.HasPrefix(k, prefix) {
+			delete(c.misses, k)
+		}
+	}
+}
+
+// notFoundCache absorbs repeated pulls of manifests and blobs that don't
+// exist, like CI jobs polling for a tag that isn't pushed yet, by answering
+// them with 404 for a while without asking the upstream again.
+type notFoundCache struct {
+	*negativeCache
+}
+
+// getNotFoundCache returns the cache configured by NOT_FOUND_CACHE_TTL, or nil
+// if 404s are not cached.
+func getNotFoundCache() *notFoundCache {
+	v := os.Getenv("NOT_FOUND_CACHE_TTL")
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("invalid NOT_FOUND_CACHE_TTL %q", v)
+	}
+	return &notFoundCache{newNegativeCache(d)}
+}
+
+// key returns the key of a manifest or blob pull by upstream repository
+// name, or "" for other requests.
+func (c *notFoundCache) key(req *http.Request) string {
+	if c == nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return ""
+	}
+	rr, ok := parseRegistryPath(req.URL.Path)
+	if !ok || (rr.kind != "manifests" && rr.kind != "blobs") {
+		return ""
+	}
+	return rr.name + "\x00" + rr.kind + "\x00" + rr.reference
+}
+
+// serve returns a 404 response for req if the upstream answered it with 404
+// recently, or nil.
+func (c *notFoundCache) serve(req *http.Request, key string) *http.Response {
+	if key == "" {
+		return nil
+	}
+	if !c.has(key) {
+		notFoundCacheRequestsTotal.inc("miss")
+		return nil
+	}
+	notFoundCacheRequestsTotal.inc("hit")
+	rr, _ := parseRegistryPath(req.URL.Path)
+	return registryErrorResponse(req, http.StatusNotFound, upstreamErrorCode(http.StatusNotFound, rr.kind),
+		"not found in the upstream registry")
+}
+
+// update remembers 404 responses to pulls, and forgets the misses of a
+// repository when something is pushed to it through the proxy.
+func (c *notFoundCache) update(key string, resp *http.Response) {
+	if c == nil {
+		return
+	}
+	if key != "" && resp.StatusCode == http.StatusNotFound {
+		c.add(key)
+		return
+	}
+	switch resp.Request.Method {
+	case http.MethodPut, http.MethodPost, http.MethodPatch:
+	default:
+		return
+	}
+	if rr, ok := parseRegistryPath(resp.Request.URL.Path); ok && resp.StatusCode < http.StatusBadRequest {
+		c.forget(rr.name + "\x00")
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+var upstreamOverridesTotal = newCounterVec("registry_proxy_upstream_override_requests_total",
+	"Requests routed to an alternate upstream with the X-Proxy-Upstream header, by upstream.", "upstream")
+
+// upstreamOverrides routes requests carrying an X-Proxy-Upstream header to
+// an alternate upstream of the config file instead of REGISTRY_HOST, so new
+// backends can be tried through the production proxy. The header must come
+// with X-Proxy-Upstream-Token set to ADMIN_TOKEN.
+type upstreamOverrides struct {
+	token string
+	// primary is the configuration the alternate upstreams share.
+	primary registryConfig
+	handler http.Handler
+	// live holds the alternate upstreams by name, which change when the
+	// config file is reloaded.
+	live *liveConfig
+}
+
+type overrideUpstreamKey struct{}
+
+// getUpstreamOverrides returns the alternate upstreams of the config file,
+// or nil if there are none. They share the configuration of primary except
+// for their host, repository prefix and credential, and bypass the caches.
+// The upstreams are published to live.
+func getUpstreamOverrides(alternates map[string]fallbackUpstream, primary registryConfig, live *liveConfig) *upstreamOverrides {
+	if len(alternates) == 0 {
+		return nil
+	}
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		log.Fatal("upstream_overrides require ADMIN_TOKEN, which authenticates the X-Proxy-Upstream header")
+	}
+	// Responses of a backend under test must not end up in the caches of
+	// production pulls.
+	primary.cachePolicy, _ = newCachePolicy([]cachePolicyRule{{MaxAge: "0s"}}, true)
+	o := &upstreamOverrides{token: token, primary: primary, live: live}
+	o.handler = registryAPIProxy(func(ctx context.Context) *registryRoundtripper {
+		return ctx.Value(overrideUpstreamKey{}).(*registryRoundtripper)
+	})
+	upstreams, err := o.upstreams(alternates, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	live.update(func(s *configSnapshot) { s.overrides = upstreams })
+	logUpstreamOverrides(upstreams)
+	return o
+}
+
+// upstreams returns the upstreams of alternates by name, keeping those of
+// prev that didn't change.
+func (o *upstreamOverrides) upstreams(alternates map[string]fallbackUpstream, prev map[string]*registryRoundtripper) (map[string]*registryRoundtripper, error) {
+	upstreams := map[string]*registryRoundtripper{}
+	for name, u := range alternates {
+		if u.Host == "" {
+			return nil, fmt.Errorf("upstream override %q has no host", name)
+		}
+		upstreams[name] = u.roundTripper(o.primary, prev[name])
+	}
+	return upstreams, nil
+}
+
+func logUpstreamOverrides(upstreams map[string]*registryRoundtripper) {
+	var names []string
+	for name, u := range upstreams {
+		names = append(names, name+"="+u.cfg.host)
+	}
+	sort.Strings(names)
+	log.Printf("upstream overrides enabled: %s", strings.Join(names, ", "))
+}
+
+// reloader applies changes of the alternate upstreams.
+func (o *upstreamOverrides) reloader() configReloader {
+	return func(fc fileConfig) (func(*configSnapshot), error) {
+		upstreams, err := o.upstreams(fc.UpstreamOverrides, o.live.load().overrides)
+		if err != nil {
+			return nil, err
+		}
+		return func(s *configSnapshot) {
+			s.overrides = upstreams
+			logUpstreamOverrides(upstreams)
+		}, nil
+	}
+}
+
+// roundTripper returns the upstream u names. It shares the configuration of
+// primary except for its host, repository prefix and credential, and
+// bypasses the caches. prev is returned if it is the same upstream, so a
+// reload keeps its tokens.
+func (u fallbackUpstream) roundTripper(primary registryConfig, prev *registryRoundtripper) *registryRoundtripper {
+	cfg := primary
+	cfg.host = canonicalHost(u.Host)
+	cfg.repoPrefix = strings.Trim(u.RepoPrefix, "/")
+	cfg.cache, cfg.tagLists, cfg.notFound, cfg.virtual = nil, nil, nil, nil
+	var auth authenticator
+	if u.AuthHeader != "" {
+		auth = authHeader(u.AuthHeader)
+	}
+	if prev != nil && prev.cfg.host == cfg.host && prev.cfg.repoPrefix == cfg.repoPrefix && prev.auth == auth {
+		return prev
+	}
+	return &registryRoundtripper{cfg: cfg, auth: auth, tokens: newUpstreamTokens(&http.Client{Transport: cfg.transport}, cfg)}
+}
+
+// middleware serves requests with a valid X-Proxy-Upstream header from the
+// named upstream, and all others with next.
+func (o *upstreamOverrides) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := req.Header.Get("X-Proxy-Upstream")
+		if name == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("X-Proxy-Upstream-Token")), []byte(o.token)) != 1 {
+			writeRegistryError(w, http.StatusForbidden, "DENIED", "X-Proxy-Upstream requires a valid X-Proxy-Upstream-Token")
+			return
+		}
+		u, ok := o.live.get(req.Context()).overrides[name]
+		if !ok {
+			writeRegistryError(w, http.StatusBadRequest, "UNSUPPORTED", fmt.Sprintf("unknown upstream %q", name))
+			return
+		}
+		upstreamOverridesTotal.inc(name)
+		log.Printf("routing request to upstream override %s: url=%s", name, req.URL)
+		// The client's credentials are meant for the primary upstream.
+		req.Header.Del("Authorization")
+		req.Header.Del("X-Proxy-Upstream")
+		req.Header.Del("X-Proxy-Upstream-Token")
+		w.Header().Set("X-Registry-Upstream", u.cfg.host)
+		o.handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), overrideUpstreamKey{}, u)))
+	})
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	registryPath    = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs|tags|referrers)/(.*)$`)
+	referenceName   = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	referenceTag    = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	referenceDigest = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+)
+
+// registryRequest describes a registry API request path like
+// /v2/<name>/manifests/<reference>.
+type registryRequest struct {
+	name string
+	// kind is one of "manifests", "blobs", "tags" or "referrers".
+	kind string
+	// reference is the tag or digest of manifests and blobs.
+	reference string
+}
+
+// parseRegistryPath parses a /v2/ API path. ok is false for paths that do not
+// address a repository, like /v2/ or /v2/_catalog.
+func parseRegistryPath(path string) (r registryRequest, ok bool) {
+	m := registryPath.FindStringSubmatch(path)
+	if m == nil {
+		return r, false
+	}
+	return registryRequest{name: m[1], kind: m[2], reference: m[3]}, true
+}
+
+// isDigest reports whether reference is a content digest rather than a tag.
+func isDigest(reference string) bool {
+	return strings.Contains(reference, ":")
+}
+
+// parseReference splits an image reference like "busybox:1.36",
+// "team/app@sha256:..." or "example.com/busybox" into the repository name and
+// the tag or digest, which defaults to "latest". A leading registry host is
+// removed if it equals host.
+func parseReference(ref, host string) (name, reference string, err error) {
+	if host != "" {
+		ref = strings.TrimPrefix(ref, host+"/")
+	}
+	name = ref
+	if i := strings.Index(ref, "@"); i >= 0 {
+		name, reference = ref[:i], ref[i+1:]
+	} else if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, reference = ref[:i], ref[i+1:]
+	}
+	if reference == "" {
+		reference = "latest"
+	}
+	if !referenceName.MatchString(name) {
+		return "", "", fmt.Errorf("invalid repository name %q", name)
+	}
+	if !referenceTag.MatchString(reference) && !referenceDigest.MatchString(reference) {
+		return "", "", fmt.Errorf("invalid tag or digest %q", reference)
+	}
+	return name, reference, nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// pingHistorySize is the number of ping results kept for the admin API.
+const pingHistorySize = 120
+
+var upstreamPingsTotal = newCounterVec("registry_proxy_upstream_pings_total",
+	"Pings of the upstream registry by result (ok or failed).", "result")
+
+// pingResult is the outcome of one ping of the upstream.
+type pingResult struct {
+	Time      time.Time `json:"time"`
+	OK        bool      `json:"ok"`
+	Status    int       `json:"status,omitempty"`
+	LatencyMs int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// upstreamPinger requests /v2/ of the upstream periodically, which keeps
+// connections and DNS entries of upstreams that expire idle ones warm, and
+// remembers the recent results as the availability history of the upstream.
+type upstreamPinger struct {
+	url      string
+	client   *http.Client
+	interval time.Duration
+
+	mu sync.Mutex
+	// history is a ring buffer of the last pingHistorySize results, next is
+	// the index the next result is written to.
+	history []pingResult
+	next    int
+}
+
+// getUpstreamPinger returns the pinger configured by UPSTREAM_PING_INTERVAL,
+// or nil if pinging is disabled.
+func getUpstreamPinger(cfg registryConfig) *upstreamPinger {
+	v := os.Getenv("UPSTREAM_PING_INTERVAL")
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < time.Second {
+		log.Fatalf("invalid UPSTREAM_PING_INTERVAL %q, expected a duration of at least 1s", v)
+	}
+	return &upstreamPinger{
+		url: "https://" + cfg.host + "/v2/",
+		// Pings share the transport and so the idle connections of proxied
+		// requests.
+		client:   &http.Client{Transport: cfg.transport, Timeout: upstreamTimeout},
+		interval: d,
+	}
+}
+
+// run pings the upstream every interval. It never returns.
+func (p *upstreamPinger) run() {
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		p.ping()
+		<-t.C
+	}
+}
+
+func (p *upstreamPinger) ping() {
+	start := time.Now()
+	r := pingResult{Time: start.UTC()}
+	resp, err := p.client.Get(p.url)
+	r.LatencyMs = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		r.Error = err.Error()
+	} else {
+		// Drain the body so the connection is reused.
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		r.Status = resp.StatusCode
+		// /v2/ answers 401 to anonymous requests, which still shows the
+		// registry is up.
+		r.OK = !upstreamUnavailable(resp.StatusCode)
+	}
+	if r.OK {
+		upstreamPingsTotal.inc("ok")
+	} else {
+		upstreamPingsTotal.inc("failed")
+		log.Printf("upstream ping failed: status=%d error=%s", r.Status, r.Error)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.history) < pingHistorySize {
+		p.history = append(p.history, r)
+	} else {
+		p.history[p.next] = r
+	}
+	p.next = (p.next + 1) % pingHistorySize
+}
+
+// results returns the ping history, oldest first.
+func (p *upstreamPinger) results() []pingResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]pingResult, 0, len(p.history))
+	if len(p.history) == pingHistorySize {
+		out = append(out, p.history[p.next:]...)
+		out = append(out, p.history[:p.next]...)
+	} else {
+		out = append(out, p.history...)
+	}
+	return out
+}
+
+// handler serves the availability history as JSON.
+func (p *upstreamPinger) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		history := p.results()
+		ok := 0
+		for _, h := range history {
+			if h.OK {
+				ok++
+			}
+		}
+		out := struct {
+			Upstream     string       `json:"upstream"`
+			Interval     string       `json:"interval"`
+			Available    bool         `json:"available"`
+			Availability float64      `json:"availability"`
+			History      []pingResult `json:"history"`
+		}{Upstream: p.url, Interval: p.interval.String(), History: history}
+		if n := len(history); n > 0 {
+			out.Available = history[n-1].OK
+			out.Availability = float64(ok) / float64(n)
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
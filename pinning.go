@@ -0,0 +1,78 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// pinningPolicy rejects manifest requests by tag for repositories whose
+// images must be deployed pinned to a digest. Tags can still be resolved to
+// digests on /resolve/.
+type pinningPolicy struct {
+	// patterns are client-visible repository names or patterns in
+	// path.Match syntax.
+	patterns []string
+}
+
+// getPinningPolicy returns the policy for the repositories listed in
+// PIN_DIGESTS, or nil if the variable is not set.
+func getPinningPolicy() *pinningPolicy {
+	v := os.Getenv("PIN_DIGESTS")
+	if v == "" {
+		return nil
+	}
+	p := &pinningPolicy{}
+	for _, pattern := range strings.Split(v, ",") {
+		pattern = strings.Trim(pattern, " /")
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("invalid repository pattern %q in PIN_DIGESTS", pattern)
+		}
+		p.patterns = append(p.patterns, pattern)
+	}
+	log.Printf("only serving manifests by digest for %s", strings.Join(p.patterns, ", "))
+	return p
+}
+
+func (p *pinningPolicy) pinned(name string) bool {
+	for _, pattern := range p.patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// middleware rejects manifest pulls by tag from pinned repositories.
+func (p *pinningPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rr, ok := parseRegistryPath(req.URL.Path)
+		if ok && rr.kind == "manifests" && !isDigest(rr.reference) && requestAction(req) == "pull" && p.pinned(rr.name) {
+			writeRegistryError(w, http.StatusForbidden, "DENIED",
+				fmt.Sprintf("%s can only be pulled by digest, resolve the tag to its digest on /resolve/%s:%s", rr.name, rr.name, rr.reference))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,53 @@
+//go:build exampleplugin
+// +build exampleplugin
+
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// This plugin is compiled in with `go build -tags exampleplugin`. It logs
+// the duration of every registry API request and of every upstream request.
+func init() {
+	registerPlugin(plugin{
+		name: "example",
+		handler: func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				start := time.Now()
+				next.ServeHTTP(w, req)
+				log.Printf("example plugin: %s %s took %s", req.Method, req.URL.Path, time.Since(start))
+			})
+		},
+		transport: func(next http.RoundTripper) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				start := time.Now()
+				resp, err := next.RoundTrip(req)
+				log.Printf("example plugin: upstream %s %s took %s", req.Method, req.URL, time.Since(start))
+				return resp, err
+			})
+		},
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
@@ -0,0 +1,78 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// plugin adds custom behavior, like policies, logging or headers, to the
+// proxy without changing its files. Plugins are compiled in: add a file to
+// this package, usually behind a build tag, that calls registerPlugin from an
+// init function, and build with that tag. See plugin_example.go.
+type plugin struct {
+	name string
+	// handler wraps the handler of the registry API (/v2/), if set. It runs
+	// after client authentication and authorization, so the identity of the
+	// client is available with identityFromContext.
+	handler func(next http.Handler) http.Handler
+	// transport wraps the transport of all requests to the upstream
+	// registry and its token service, if set.
+	transport func(next http.RoundTripper) http.RoundTripper
+}
+
+var plugins []plugin
+
+// registerPlugin adds p to the proxy. It must be called from an init
+// function. Plugins wrap the proxy in the order they are registered, so the
+// first plugin sees requests first.
+func registerPlugin(p plugin) {
+	if p.name == "" {
+		log.Fatal("plugins must have a name")
+	}
+	plugins = append(plugins, p)
+}
+
+// pluginNames returns the names of the registered plugins.
+func pluginNames() string {
+	var names []string
+	for _, p := range plugins {
+		names = append(names, p.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// wrapPluginHandlers wraps h with the handlers of all plugins.
+func wrapPluginHandlers(h http.Handler) http.Handler {
+	for i := len(plugins) - 1; i >= 0; i-- {
+		if plugins[i].handler != nil {
+			h = plugins[i].handler(h)
+		}
+	}
+	return h
+}
+
+// wrapPluginTransports wraps t with the transports of all plugins.
+func wrapPluginTransports(t http.RoundTripper) http.RoundTripper {
+	for i := len(plugins) - 1; i >= 0; i-- {
+		if plugins[i].transport != nil {
+			t = plugins[i].transport(t)
+		}
+	}
+	return t
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+var policyDecisionsTotal = newCounterVec("registry_proxy_policy_decisions_total",
+	"Decisions of the external policy engine by result (allow, deny or error).", "result")
+
+// policyInput is the input document sent to the policy engine for a registry
+// API request.
+type policyInput struct {
+	Repository string              `json:"repository,omitempty"`
+	Kind       string              `json:"kind,omitempty"`
+	Reference  string              `json:"reference,omitempty"`
+	Action     string              `json:"action"`
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	User       string              `json:"user,omitempty"`
+	Groups     []string            `json:"groups,omitempty"`
+	ClientIP   string              `json:"client_ip"`
+	Headers    map[string][]string `json:"headers"`
+}
+
+// externalPolicy asks a policy engine speaking the OPA data API, like
+// http://opa:8181/v1/data/registry/allow, whether to allow each registry API
+// request, so policies can change without rebuilding the proxy.
+type externalPolicy struct {
+	url      string
+	client   *http.Client
+	failOpen bool
+}
+
+// getExternalPolicy returns the policy engine configured by POLICY_URL, or
+// nil if there is none.
+func getExternalPolicy() *externalPolicy {
+	u := os.Getenv("POLICY_URL")
+	if u == "" {
+		return nil
+	}
+	timeout := 2 * time.Second
+	if v := os.Getenv("POLICY_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid POLICY_TIMEOUT %q", v)
+		}
+		timeout = d
+	}
+	p := &externalPolicy{url: u, client: &http.Client{Timeout: timeout}, failOpen: os.Getenv("POLICY_FAIL_OPEN") != ""}
+	log.Printf("authorizing requests with the policy at %s", u)
+	return p
+}
+
+func newPolicyInput(req *http.Request) policyInput {
+	in := policyInput{
+		Action:   requestAction(req),
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		ClientIP: clientIP(req),
+		Headers:  map[string][]string{},
+	}
+	if rr, ok := parseRegistryPath(req.URL.Path); ok {
+		in.Repository, in.Kind, in.Reference = rr.name, rr.kind, rr.reference
+	}
+	if id := identityFromContext(req.Context()); id != nil {
+		in.User, in.Groups = id.username, id.groups
+	}
+	for k, v := range req.Header {
+		// Credentials are not for the policy engine to see.
+		if k == "Authorization" || k == "Cookie" {
+			continue
+		}
+		in.Headers[k] = v
+	}
+	return in
+}
+
+// decide returns whether the policy allows the request described by in, and
+// the reason given by the policy for denials.
+func (p *externalPolicy) decide(in policyInput) (bool, string, error) {
+	b, err := json.Marshal(struct {
+		Input policyInput `json:"input"`
+	}{in})
+	if err != nil {
+		return false, "", err
+	}
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return false, "", fmt.Errorf("policy request failed: %+v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return false, "", fmt.Errorf("failed to read policy response: %+v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("policy returned status %d: %s", resp.StatusCode, body)
+	}
+	// The result is either a boolean or an object like
+	// {"allow": false, "reason": "..."}.
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return false, "", fmt.Errorf("invalid policy response: %+v", err)
+	}
+	if len(out.Result) == 0 {
+		return false, "", fmt.Errorf("policy response has no result, is the policy loaded?")
+	}
+	var allow bool
+	if err := json.Unmarshal(out.Result, &allow); err == nil {
+		return allow, "", nil
+	}
+	var decision struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(out.Result, &decision); err != nil {
+		return false, "", fmt.Errorf("policy result must be a boolean or an object with allow, got %s", out.Result)
+	}
+	return decision.Allow, decision.Reason, nil
+}
+
+// middleware rejects registry API requests the policy denies. Requests are
+// denied if the policy can't be evaluated, unless POLICY_FAIL_OPEN is set.
+func (p *externalPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v2/" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if p.allow(w, req, newPolicyInput(req)) {
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
+// allow reports whether the policy allows the request described by in, and
+// writes an error response to w if it doesn't.
+func (p *externalPolicy) allow(w http.ResponseWriter, req *http.Request, in policyInput) bool {
+	allow, reason, err := p.decide(in)
+	switch {
+	case err != nil:
+		policyDecisionsTotal.inc("error")
+		log.Printf("policy evaluation failed for url=%s: %+v", req.URL, err)
+		if !p.failOpen {
+			writeRegistryError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "the authorization policy could not be evaluated")
+			return false
+		}
+	case !allow:
+		policyDecisionsTotal.inc("deny")
+		if reason == "" {
+			reason = "denied by policy"
+		}
+		writeRegistryError(w, http.StatusForbidden, "DENIED", reason)
+		return false
+	default:
+		policyDecisionsTotal.inc("allow")
+	}
+	return true
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultPullQueueTimeout = 30 * time.Second
+
+// Priority classes of pulls, in the order they are admitted.
+const (
+	priorityLow = iota
+	priorityNormal
+	priorityHigh
+)
+
+var priorityNames = []string{"low", "normal", "high"}
+
+var pullAdmissionsTotal = newCounterVec("registry_proxy_pull_admissions_total",
+	"Pulls by priority class (high, normal or low) and admission (immediate, queued or rejected).", "priority", "result")
+
+type priorityKey struct{}
+
+var ctxKeyPriority = priorityKey{}
+
+// priorityConfig assigns pulls to priority classes.
+type priorityConfig struct {
+	// High and Low list repository names like "kube-system/*" in path.Match
+	// syntax whose pulls are admitted before, or after, all others.
+	High []string `json:"high"`
+	Low  []string `json:"low"`
+	// Upstreams maps names of upstream_overrides to the class ("high",
+	// "normal" or "low") of requests routed to them, regardless of the
+	// repository.
+	Upstreams map[string]string `json:"upstreams"`
+	// QueueTimeout is how long a pull waits for admission before it is
+	// rejected, like "10s".
+	QueueTimeout string `json:"queue_timeout"`
+}
+
+// pullScheduler limits the number of manifest and blob pulls served at the
+// same time to MAX_CONCURRENT_PULLS. Pulls beyond the limit wait, and are
+// admitted strictly by priority class and in arrival order within a class,
+// so critical images get through ahead of bulk traffic.
+type pullScheduler struct {
+	high, low    []string
+	upstreams    map[string]int
+	limit        int
+	queueTimeout time.Duration
+
+	mu      sync.Mutex
+	active  int
+	waiting [3][]chan struct{}
+}
+
+// getPullScheduler returns the scheduler configured by MAX_CONCURRENT_PULLS
+// and the priority section of the config file, or nil if neither is set.
+func getPullScheduler(pc priorityConfig, overrides map[string]fallbackUpstream) *pullScheduler {
+	limit := 0
+	if v := os.Getenv("MAX_CONCURRENT_PULLS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("invalid MAX_CONCURRENT_PULLS %q, expected a positive number", v)
+		}
+		limit = n
+	}
+	if limit == 0 && len(pc.High) == 0 && len(pc.Low) == 0 && len(pc.Upstreams) == 0 {
+		return nil
+	}
+	s := &pullScheduler{high: pc.High, low: pc.Low, upstreams: map[string]int{}, limit: limit, queueTimeout: defaultPullQueueTimeout}
+	for _, pattern := range append(append([]string{}, pc.High...), pc.Low...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("invalid repository pattern %q in priority: %+v", pattern, err)
+		}
+	}
+	for name, class := range pc.Upstreams {
+		if _, ok := overrides[name]; !ok {
+			log.Fatalf("priority.upstreams: %q is not one of upstream_overrides", name)
+		}
+		p, ok := parsePriority(class)
+		if !ok {
+			log.Fatalf("priority.upstreams: invalid class %q for %s, expected high, normal or low", class, name)
+		}
+		s.upstreams[name] = p
+	}
+	if pc.QueueTimeout != "" {
+		d, err := time.ParseDuration(pc.QueueTimeout)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid priority.queue_timeout %q", pc.QueueTimeout)
+		}
+		s.queueTimeout = d
+	}
+	if limit == 0 {
+		log.Printf("pull priorities only affect QUOTA_PER_CLIENT, set MAX_CONCURRENT_PULLS to limit concurrent pulls")
+	} else {
+		log.Printf("serving at most %d pulls at a time, queueing others for up to %s", limit, s.queueTimeout)
+		newGaugeFunc("registry_proxy_pulls_active", "Pulls being served, at most MAX_CONCURRENT_PULLS.", func() float64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return float64(s.active)
+		})
+		newGaugeFunc("registry_proxy_pulls_queued", "Pulls waiting for admission.", func() float64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			n := 0
+			for _, q := range s.waiting {
+				n += len(q)
+			}
+			return float64(n)
+		})
+	}
+	return s
+}
+
+func parsePriority(name string) (int, bool) {
+	for p, n := range priorityNames {
+		if n == name {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+// requestPriority returns the priority class of a request, normal if it
+// wasn't classified.
+func requestPriority(ctx context.Context) int {
+	if p, ok := ctx.Value(ctxKeyPriority).(int); ok {
+		return p
+	}
+	return priorityNormal
+}
+
+// classify returns the priority class of a pull of the repository name
+// through the upstream override named upstream, if any.
+func (s *pullScheduler) classify(name, upstream string) int {
+	if p, ok := s.upstreams[upstream]; ok && upstream != "" {
+		return p
+	}
+	for _, pattern := range s.high {
+		if ok, _ := path.Match(pattern, name); ok {
+			return priorityHigh
+		}
+	}
+	for _, pattern := range s.low {
+		if ok, _ := path.Match(pattern, name); ok {
+			return priorityLow
+		}
+	}
+	return priorityNormal
+}
+
+// acquire admits a pull of class p, waiting until a slot is free or ctx is
+// done. It reports whether the pull was queued.
+func (s *pullScheduler) acquire(ctx context.Context, p int) (queued bool, err error) {
+	s.mu.Lock()
+	if s.active < s.limit {
+		s.active++
+		s.mu.Unlock()
+		return false, nil
+	}
+	ch := make(chan struct{})
+	s.waiting[p] = append(s.waiting[p], ch)
+	s.mu.Unlock()
+	select {
+	case <-ch:
+		return true, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, c := range s.waiting[p] {
+			if c == ch {
+				s.waiting[p] = append(s.waiting[p][:i], s.waiting[p][i+1:]...)
+				return true, ctx.Err()
+			}
+		}
+		// The slot was handed over while ctx was done, pass it on.
+		s.releaseLocked()
+		return true, ctx.Err()
+	}
+}
+
+// release frees the slot of a pull, handing it to the first waiting pull of
+// the highest class.
+func (s *pullScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+func (s *pullScheduler) releaseLocked() {
+	for p := priorityHigh; p >= priorityLow; p-- {
+		if q := s.waiting[p]; len(q) > 0 {
+			s.waiting[p] = q[1:]
+			close(q[0])
+			return
+		}
+	}
+	s.active--
+}
+
+// middleware stores the priority class of manifest and blob pulls in the
+// request context and, with MAX_CONCURRENT_PULLS, admits them by class.
+// Pulls that wait longer than the queue timeout are rejected with 429.
+func (s *pullScheduler) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rr, ok := parseRegistryPath(req.URL.Path)
+		if !ok || (req.Method != http.MethodGet && req.Method != http.MethodHead) ||
+			(rr.kind != "manifests" && rr.kind != "blobs") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		p := s.classify(rr.name, req.Header.Get("X-Proxy-Upstream"))
+		req = req.WithContext(context.WithValue(req.Context(), ctxKeyPriority, p))
+		if s.limit == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), s.queueTimeout)
+		queued, err := s.acquire(ctx, p)
+		cancel()
+		if err != nil {
+			pullAdmissionsTotal.inc(priorityNames[p], "rejected")
+			if req.Context().Err() != nil {
+				// The client went away while waiting.
+				return
+			}
+			log.Printf("rejecting %s pull of %s, no slot became free within %s", priorityNames[p], rr.name, s.queueTimeout)
+			w.Header().Set("Retry-After", "1")
+			writeRegistryError(w, http.StatusTooManyRequests, "TOOMANYREQUESTS",
+				fmt.Sprintf("the proxy is serving %d pulls already, try again later", s.limit))
+			return
+		}
+		defer s.release()
+		if queued {
+			pullAdmissionsTotal.inc(priorityNames[p], "queued")
+		} else {
+			pullAdmissionsTotal.inc(priorityNames[p], "immediate")
+		}
+		next.ServeHTTP(w, req)
+	})
+}
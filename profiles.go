@@ -0,0 +1,192 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// registryProfile describes the quirks of a registry implementation.
+type registryProfile struct {
+	name string
+	// tokenPath is the path of the token service on the registry host, used
+	// if the registry doesn't advertise one on /v2/, which registries that
+	// allow anonymous pulls may skip.
+	tokenPath string
+	// tokenHost is the host serving the token service, the registry host if
+	// empty.
+	tokenHost string
+	// service is the service name the token service expects, used if the
+	// registry doesn't advertise one. The registry host if empty.
+	service string
+	// pathPrefix is prepended to the /v2/ paths of the registry API, for
+	// registries serving it below another path.
+	pathPrefix string
+	// maxNameDepth is the number of path components repository names may
+	// have, 0 if unlimited.
+	maxNameDepth int
+}
+
+var registryProfiles = map[string]registryProfile{
+	// distribution covers Docker Hub, GCR, Artifact Registry and other
+	// registries following the Distribution spec closely.
+	"distribution": {name: "distribution"},
+	// quay only has namespace/repository names and serves its token service
+	// on /v2/auth.
+	"quay": {name: "quay", tokenPath: "/v2/auth", maxNameDepth: 2},
+	// harbor serves its token service on /service/token and calls itself
+	// "harbor-registry" there.
+	"harbor": {name: "harbor", tokenPath: "/service/token", service: "harbor-registry"},
+	// gitlab has repository names of any depth, like
+	// group/subgroup/project/image, and serves its token service on /jwt/auth
+	// of the GitLab instance rather than the registry host.
+	"gitlab": {name: "gitlab", tokenPath: "/jwt/auth", service: "container_registry"},
+	// artifactory serves the registry API of every docker repository below
+	// /artifactory/api/docker/<repository>, set from ARTIFACTORY_REPOSITORY.
+	"artifactory": {name: "artifactory"},
+}
+
+// getRegistryProfile returns the profile selected with REGISTRY_PROFILE. It
+// defaults to quay for quay.io, gitlab for registry.gitlab.com and
+// distribution otherwise.
+func getRegistryProfile(host string) registryProfile {
+	name := os.Getenv("REGISTRY_PROFILE")
+	if name == "" {
+		name = "distribution"
+		switch host {
+		case "quay.io":
+			name = "quay"
+		case "registry.gitlab.com":
+			name = "gitlab"
+		}
+	}
+	p, ok := registryProfiles[name]
+	if !ok {
+		log.Fatalf("unknown REGISTRY_PROFILE %q, expected distribution, quay, harbor, gitlab or artifactory", name)
+	}
+	if name == "artifactory" {
+		repo := os.Getenv("ARTIFACTORY_REPOSITORY")
+		if repo == "" {
+			log.Fatal("the artifactory profile requires ARTIFACTORY_REPOSITORY")
+		}
+		p.pathPrefix = "/artifactory/api/docker/" + strings.Trim(repo, "/")
+	}
+	if name == "gitlab" {
+		// GitLab instances serve the registry on a registry.<instance> host
+		// by default.
+		p.tokenHost = strings.TrimPrefix(host, "registry.")
+		if v := os.Getenv("GITLAB_URL"); v != "" {
+			u, err := url.Parse(v)
+			if err != nil || u.Host == "" {
+				log.Fatalf("invalid GITLAB_URL %q", v)
+			}
+			p.tokenHost = u.Host
+		}
+	}
+	if name != "distribution" {
+		log.Printf("using the %s registry profile", name)
+	}
+	return p
+}
+
+// checkName returns an error if the registry can't have a repository with
+// the upstream name.
+func (p registryProfile) checkName(name string) error {
+	if p.maxNameDepth > 0 && strings.Count(name, "/")+1 > p.maxNameDepth {
+		return fmt.Errorf("%s repository names can have at most %d components, %s has more", p.name, p.maxNameDepth, name)
+	}
+	return nil
+}
+
+// rewriteLinks rewrites the pagination links of tag lists and the catalog
+// from upstream repository names to the names clients know, and makes them relative, so
+// clients follow them through the proxy.
+func rewriteLinks(resp *http.Response, cfg registryConfig) {
+	links := resp.Header["Link"]
+	if len(links) == 0 {
+		return
+	}
+	for i, l := range links {
+		start, end := strings.Index(l, "<"), strings.Index(l, ">")
+		if start < 0 || end < start {
+			continue
+		}
+		u, err := resp.Request.URL.Parse(l[start+1 : end])
+		if err != nil {
+			continue
+		}
+		if u.Path == "/v2/_catalog" {
+			q := u.Query()
+			if name, ok := cfg.clientName(q.Get("last")); ok && name != "" {
+				q.Set("last", name)
+				u.RawQuery = q.Encode()
+			}
+		} else if rr, ok := parseRegistryPath(u.Path); ok {
+			name, ok := cfg.clientName(rr.name)
+			if !ok {
+				continue
+			}
+			u.Path = fmt.Sprintf("/v2/%s/%s/%s", name, rr.kind, rr.reference)
+		}
+		u.Scheme, u.Host, u.RawPath = "", "", ""
+		links[i] = l[:start+1] + u.String() + l[end:]
+	}
+}
+
+// wrapTransport returns a transport sending requests for the registry API on
+// host below the path prefix of the profile.
+func (p registryProfile) wrapTransport(host string, t http.RoundTripper) http.RoundTripper {
+	if p.pathPrefix == "" {
+		return t
+	}
+	return &pathPrefixTransport{base: t, host: host, prefix: p.pathPrefix}
+}
+
+// pathPrefixTransport prepends prefix to the /v2/ paths of requests to host,
+// and strips it from the Location and Link headers of the responses, so the
+// rest of the proxy only sees plain registry API paths.
+type pathPrefixTransport struct {
+	base   http.RoundTripper
+	host   string
+	prefix string
+}
+
+func (t *pathPrefixTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if canonicalHost(req.URL.Host) != t.host || !strings.HasPrefix(req.URL.Path, "/v2/") {
+		return t.base.RoundTrip(req)
+	}
+	r := new(http.Request)
+	*r = *req
+	u := *req.URL
+	u.Path, u.RawPath = t.prefix+u.Path, ""
+	r.URL = &u
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	for _, h := range []string{"Location", "Link"} {
+		for i, v := range resp.Header[h] {
+			resp.Header[h][i] = strings.Replace(v, t.prefix+"/v2/", "/v2/", 1)
+		}
+	}
+	return resp, nil
+}
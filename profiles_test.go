@@ -0,0 +1,217 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// setenv sets the environment variables for a test and returns a function
+// restoring them.
+func setenv(vars map[string]string) func() {
+	orig := map[string]*string{}
+	for k, v := range vars {
+		if old, ok := os.LookupEnv(k); ok {
+			orig[k] = &old
+		} else {
+			orig[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range orig {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
+
+func TestGetRegistryProfile(t *testing.T) {
+	tests := []struct {
+		name  string
+		host  string
+		env   map[string]string
+		want  registryProfile
+		realm string
+		svc   string
+	}{{
+		name:  "distribution by default",
+		host:  "gcr.io",
+		want:  registryProfile{name: "distribution"},
+		realm: "https://gcr.io",
+		svc:   "gcr.io",
+	}, {
+		name:  "quay for quay.io",
+		host:  "quay.io",
+		want:  registryProfile{name: "quay", tokenPath: "/v2/auth", maxNameDepth: 2},
+		realm: "https://quay.io/v2/auth",
+		svc:   "quay.io",
+	}, {
+		name:  "gitlab for registry.gitlab.com",
+		host:  "registry.gitlab.com",
+		want:  registryProfile{name: "gitlab", tokenPath: "/jwt/auth", tokenHost: "gitlab.com", service: "container_registry"},
+		realm: "https://gitlab.com/jwt/auth",
+		svc:   "container_registry",
+	}, {
+		name:  "gitlab with GITLAB_URL",
+		host:  "registry.example.com",
+		env:   map[string]string{"REGISTRY_PROFILE": "gitlab", "GITLAB_URL": "https://git.example.com/"},
+		want:  registryProfile{name: "gitlab", tokenPath: "/jwt/auth", tokenHost: "git.example.com", service: "container_registry"},
+		realm: "https://git.example.com/jwt/auth",
+		svc:   "container_registry",
+	}, {
+		name:  "harbor",
+		host:  "harbor.example.com",
+		env:   map[string]string{"REGISTRY_PROFILE": "harbor"},
+		want:  registryProfile{name: "harbor", tokenPath: "/service/token", service: "harbor-registry"},
+		realm: "https://harbor.example.com/service/token",
+		svc:   "harbor-registry",
+	}, {
+		name:  "artifactory",
+		host:  "example.jfrog.io",
+		env:   map[string]string{"REGISTRY_PROFILE": "artifactory", "ARTIFACTORY_REPOSITORY": "/docker-remote/"},
+		want:  registryProfile{name: "artifactory", pathPrefix: "/artifactory/api/docker/docker-remote"},
+		realm: "https://example.jfrog.io",
+		svc:   "example.jfrog.io",
+	}, {
+		name:  "REGISTRY_PROFILE overrides the host default",
+		host:  "quay.io",
+		env:   map[string]string{"REGISTRY_PROFILE": "distribution"},
+		want:  registryProfile{name: "distribution"},
+		realm: "https://quay.io",
+		svc:   "quay.io",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"REGISTRY_PROFILE": "", "ARTIFACTORY_REPOSITORY": "", "GITLAB_URL": ""}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			defer setenv(env)()
+			p := getRegistryProfile(tt.host)
+			if p != tt.want {
+				t.Fatalf("getRegistryProfile(%q) = %+v, want %+v", tt.host, p, tt.want)
+			}
+			realm, svc, err := profileTokenService(registryConfig{host: tt.host, profile: p})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if realm != tt.realm || svc != tt.svc {
+				t.Errorf("profileTokenService() = %q, %q, want %q, %q", realm, svc, tt.realm, tt.svc)
+			}
+		})
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		profile string
+		name    string
+		ok      bool
+	}{
+		{"distribution", "a/b/c/d", true},
+		{"quay", "org/app", true},
+		{"quay", "app", true},
+		{"quay", "org/team/app", false},
+		{"gitlab", "group/subgroup/project/image", true},
+		{"harbor", "project/team/app", true},
+	}
+	for _, tt := range tests {
+		err := registryProfiles[tt.profile].checkName(tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s checkName(%q) = %v, want ok=%v", tt.profile, tt.name, err, tt.ok)
+		}
+	}
+}
+
+// roundTripFunc records the requests of a pathPrefixTransport.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestPathPrefixTransport(t *testing.T) {
+	var got string
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.URL.Path
+		h := http.Header{}
+		h.Set("Location", "/artifactory/api/docker/remote/v2/app/blobs/uploads/1")
+		h.Set("Link", `</artifactory/api/docker/remote/v2/app/tags/list?n=1&last=a>; rel="next"`)
+		return &http.Response{StatusCode: http.StatusOK, Header: h, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+	p := registryProfile{name: "artifactory", pathPrefix: "/artifactory/api/docker/remote"}
+	tr := p.wrapTransport("example.jfrog.io", base)
+
+	tests := []struct {
+		url      string
+		want     string
+		stripped bool
+	}{
+		{"https://example.jfrog.io/v2/app/manifests/latest", "/artifactory/api/docker/remote/v2/app/manifests/latest", true},
+		{"https://example.jfrog.io/v2/", "/artifactory/api/docker/remote/v2/", true},
+		{"https://example.jfrog.io/other", "/other", false},
+		{"https://auth.example.com/v2/token", "/v2/token", false},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s was sent to %s, want %s", tt.url, got, tt.want)
+		}
+		loc := resp.Header.Get("Location")
+		if stripped := loc == "/v2/app/blobs/uploads/1"; stripped != tt.stripped {
+			t.Errorf("%s: Location %q, want the prefix stripped: %v", tt.url, loc, tt.stripped)
+		}
+		if tt.stripped && resp.Header.Get("Link") != `</v2/app/tags/list?n=1&last=a>; rel="next"` {
+			t.Errorf("%s: Link %q still has the prefix", tt.url, resp.Header.Get("Link"))
+		}
+	}
+
+	if tr := (registryProfile{name: "distribution"}).wrapTransport("gcr.io", base); tr == nil {
+		t.Error("wrapTransport returned nil")
+	} else if _, ok := tr.(*pathPrefixTransport); ok {
+		t.Error("profiles without a path prefix must not wrap the transport")
+	}
+}
+
+func TestRewriteLinks(t *testing.T) {
+	cfg := registryConfig{repoPrefix: "my-project"}
+	tests := []struct {
+		link string
+		want string
+	}{
+		{`<https://gcr.io/v2/my-project/app/tags/list?last=v1&n=10>; rel="next"`, `</v2/app/tags/list?last=v1&n=10>; rel="next"`},
+		{`</v2/_catalog?last=my-project%2Fapp&n=10>; rel="next"`, `</v2/_catalog?last=app&n=10>; rel="next"`},
+		{`</v2/other/app/tags/list?n=10>; rel="next"`, `</v2/other/app/tags/list?n=10>; rel="next"`},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "https://gcr.io/v2/my-project/app/tags/list", nil)
+		resp := &http.Response{Request: req, Header: http.Header{"Link": {tt.link}}}
+		rewriteLinks(resp, cfg)
+		if got := resp.Header.Get("Link"); got != tt.want {
+			t.Errorf("rewriteLinks(%s) = %s, want %s", tt.link, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// quotaBuckets is the number of slots the rolling quota window is split into.
+const quotaBuckets = 24
+
+// transferQuota limits the number of bytes served to each client over a
+// rolling window.
+type transferQuota struct {
+	limit  int64
+	window time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*clientUsage
+}
+
+// clientUsage counts the bytes served to a client per slot of the window.
+// epochs[i] is the slot number that bytes[i] was counted for.
+type clientUsage struct {
+	bytes  [quotaBuckets]int64
+	epochs [quotaBuckets]int64
+}
+
+// getTransferQuota returns the configured per-client quota, or nil if
+// QUOTA_PER_CLIENT is not set.
+func getTransferQuota() *transferQuota {
+	limit := getSizeEnv("QUOTA_PER_CLIENT", 0)
+	if limit <= 0 {
+		return nil
+	}
+	window := 24 * time.Hour
+	if v := os.Getenv("QUOTA_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < quotaBuckets*time.Second {
+			log.Fatalf("QUOTA_WINDOW must be a duration of at least %ds, got %q", quotaBuckets, v)
+		}
+		window = d
+	}
+	q := &transferQuota{
+		limit:   limit,
+		window:  window,
+		clients: make(map[string]*clientUsage),
+	}
+	go q.gc()
+	return q
+}
+
+func (q *transferQuota) slot() time.Duration { return q.window / quotaBuckets }
+
+func (q *transferQuota) epoch(t time.Time) int64 { return t.UnixNano() / int64(q.slot()) }
+
+// usage returns the bytes served to client within the window and the time
+// until the oldest counted slot leaves the window.
+func (q *transferQuota) usage(client string, now time.Time) (int64, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u, ok := q.clients[client]
+	if !ok {
+		return 0, 0
+	}
+	cur := q.epoch(now)
+	var total int64
+	oldest := cur
+	for i := range u.bytes {
+		if u.bytes[i] > 0 && u.epochs[i] > cur-quotaBuckets {
+			total += u.bytes[i]
+			if u.epochs[i] < oldest {
+				oldest = u.epochs[i]
+			}
+		}
+	}
+	expires := time.Unix(0, (oldest+quotaBuckets)*int64(q.slot()))
+	return total, expires.Sub(now)
+}
+
+func (q *transferQuota) add(client string, n int64, now time.Time) {
+	if n <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u, ok := q.clients[client]
+	if !ok {
+		u = &clientUsage{}
+		q.clients[client] = u
+	}
+	cur := q.epoch(now)
+	i := cur % quotaBuckets
+	if u.epochs[i] != cur {
+		u.epochs[i], u.bytes[i] = cur, 0
+	}
+	u.bytes[i] += n
+}
+
+// gc periodically forgets clients that have no usage left in the window.
+func (q *transferQuota) gc() {
+	for range time.Tick(q.window) {
+		q.mu.Lock()
+		cur := q.epoch(time.Now())
+		for c, u := range q.clients {
+			idle := true
+			for i := range u.epochs {
+				if u.epochs[i] > cur-quotaBuckets {
+					idle = false
+				}
+			}
+			if idle {
+				delete(q.clients, c)
+			}
+		}
+		q.mu.Unlock()
+	}
+}
+
+// middleware rejects requests from clients that used up their quota with 429
+// and counts the bytes served to everyone else as they are written, so a
+// download that uses up the quota is cut off rather than finished. High
+// priority pulls are counted, but never rejected.
+func (q *transferQuota) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client := clientID(req)
+		high := requestPriority(req.Context()) == priorityHigh
+		if used, retry := q.usage(client, time.Now()); used >= q.limit && !high {
+			log.Printf("client %s exceeded its transfer quota (%d of %d bytes)", client, used, q.limit)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry/time.Second)+1))
+			writeRegistryError(w, http.StatusTooManyRequests, "TOOMANYREQUESTS",
+				fmt.Sprintf("transfer quota of %d bytes per %s exceeded, try again later", q.limit, q.window))
+			return
+		}
+		next.ServeHTTP(&quotaResponseWriter{ResponseWriter: w, quota: q, client: client, unlimited: high}, req)
+	})
+}
+
+var errQuotaExceeded = errors.New("transfer quota exceeded")
+
+// quotaResponseWriter counts the bytes written to the client against its
+// quota, and fails writes once the quota is used up, unless unlimited.
+type quotaResponseWriter struct {
+	http.ResponseWriter
+	quota     *transferQuota
+	client    string
+	unlimited bool
+	exceeded  bool
+}
+
+func (w *quotaResponseWriter) Write(b []byte) (int, error) {
+	if w.exceeded {
+		return 0, errQuotaExceeded
+	}
+	now := time.Now()
+	if used, _ := w.quota.usage(w.client, now); used >= w.quota.limit && !w.unlimited {
+		log.Printf("client %s exceeded its transfer quota (%d of %d bytes), aborting the response", w.client, used, w.quota.limit)
+		w.exceeded = true
+		return 0, errQuotaExceeded
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.quota.add(w.client, int64(n), now)
+	return n, err
+}
+
+func (w *quotaResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
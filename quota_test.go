@@ -0,0 +1,54 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTransferQuotaCutsOffDownloads(t *testing.T) {
+	q := &transferQuota{limit: 250, window: time.Hour, clients: make(map[string]*clientUsage)}
+	var writeErr error
+	h := q.middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 10; i++ {
+			if _, writeErr = w.Write(bytes.Repeat([]byte("x"), 100)); writeErr != nil {
+				return
+			}
+		}
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/library/app/blobs/sha256:abc", nil))
+	if writeErr != errQuotaExceeded {
+		t.Errorf("got write error %v, want %v", writeErr, errQuotaExceeded)
+	}
+	if w.Body.Len() != 300 {
+		t.Errorf("served %d bytes, want 300", w.Body.Len())
+	}
+	if used, _ := q.usage(clientID(httptest.NewRequest(http.MethodGet, "/", nil)), time.Now()); used != 300 {
+		t.Errorf("counted %d bytes, want 300", used)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/library/app/blobs/sha256:abc", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d after the quota was used up, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultSelfCheckInterval = 5 * time.Minute
+
+// selfCheck proves that the proxy can pull from the upstream registry by
+// looking up a known manifest with the proxy's credentials, at startup and
+// then periodically. Its result is the readiness of the proxy.
+type selfCheck struct {
+	up        *upstreamClient
+	image     string
+	name      string
+	reference string
+	interval  time.Duration
+
+	mu      sync.Mutex
+	err     error
+	checked time.Time
+}
+
+// getSelfCheck returns the check of SELF_CHECK_IMAGE, or nil if not set.
+func getSelfCheck(up *upstreamClient) *selfCheck {
+	image := os.Getenv("SELF_CHECK_IMAGE")
+	if image == "" {
+		return nil
+	}
+	name, reference, err := parseReference(image, up.cfg.host)
+	if err != nil {
+		log.Fatalf("invalid SELF_CHECK_IMAGE: %+v", err)
+	}
+	c := &selfCheck{up: up, image: image, name: name, reference: reference, interval: defaultSelfCheckInterval}
+	if v := os.Getenv("SELF_CHECK_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid SELF_CHECK_INTERVAL %q", v)
+		}
+		c.interval = d
+	}
+	return c
+}
+
+// start runs the first check before it returns, and the following ones in
+// the background.
+func (c *selfCheck) start() {
+	c.check()
+	go func() {
+		for range time.Tick(c.interval) {
+			c.check()
+		}
+	}()
+}
+
+func (c *selfCheck) check() {
+	err := c.pull()
+	c.mu.Lock()
+	recovered := c.err != nil || c.checked.IsZero()
+	c.err, c.checked = err, time.Now()
+	c.mu.Unlock()
+	if err != nil {
+		log.Printf("self-check failed, the proxy is not ready: %+v", err)
+	} else if recovered {
+		log.Printf("self-check passed: %s can be pulled from %s", c.image, c.up.cfg.host)
+	}
+}
+
+// pull looks up the manifest and explains why it can't be pulled.
+func (c *selfCheck) pull() error {
+	resp, err := c.up.get(http.MethodHead, c.name, "manifests", c.reference, manifestAcceptTypes)
+	if err != nil {
+		return fmt.Errorf("could not look up %s: %+v", c.image, err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("the upstream denied pulling %s (status %d), check the credentials of the proxy", c.image, resp.StatusCode)
+	case http.StatusNotFound:
+		return fmt.Errorf("%s does not exist in the upstream, check REPO_PREFIX, REPO_RULES and SELF_CHECK_IMAGE", c.image)
+	default:
+		return fmt.Errorf("the upstream returned status %d for %s", resp.StatusCode, c.image)
+	}
+}
+
+type readiness struct {
+	Ready       bool       `json:"ready"`
+	Reason      string     `json:"reason,omitempty"`
+	Image       string     `json:"image,omitempty"`
+	LastChecked *time.Time `json:"last_checked,omitempty"`
+}
+
+// readyzHandler answers 200 if the last self-check passed or no check is
+// configured, and 503 with the reason otherwise.
+func readyzHandler(c *selfCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c == nil {
+			writeJSON(w, http.StatusOK, readiness{Ready: true})
+			return
+		}
+		c.mu.Lock()
+		checked := c.checked
+		st := readiness{Ready: c.err == nil, Image: c.image, LastChecked: &checked}
+		if c.err != nil {
+			st.Reason = c.err.Error()
+		}
+		c.mu.Unlock()
+		status := http.StatusOK
+		if !st.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, st)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// imagePlatform is the platform of a manifest listed in an image index.
+type imagePlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p imagePlatform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// platformManifest is a manifest for one platform of a multi-platform image.
+type platformManifest struct {
+	Platform  string `json:"platform"`
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+type resolveResponse struct {
+	Image     string             `json:"image"`
+	Digest    string             `json:"digest"`
+	MediaType string             `json:"mediaType,omitempty"`
+	Platforms []platformManifest `json:"platforms,omitempty"`
+}
+
+// imageIndex has the fields of OCI image indexes and Docker manifest lists
+// that the proxy reads.
+type imageIndex struct {
+	Manifests []struct {
+		MediaType string         `json:"mediaType"`
+		Digest    string         `json:"digest"`
+		Platform  *imagePlatform `json:"platform"`
+	} `json:"manifests"`
+}
+
+// resolveHandler answers GET /resolve/<name>:<tag> with the digest the tag
+// currently points to, and for multi-platform images the digest of every
+// platform, so CI pipelines can pin images without registry credentials of
+// their own. Tags are only resolved if access allows the client to pull the
+// image.
+func resolveHandler(up *upstreamClient, access imageAccess) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "use GET to resolve images")
+			return
+		}
+		image := strings.TrimPrefix(r.URL.Path, "/resolve/")
+		name, reference, err := parseReference(image, r.Host)
+		if err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+			return
+		}
+		if d := up.cfg.denial(name); d != nil {
+			d.writeTo(w, r, name)
+			return
+		}
+		if !access.allowPull(w, r, name, reference) {
+			return
+		}
+		info, b, err := up.getManifest(name, reference)
+		if err != nil {
+			log.Printf("resolve: lookup of %s failed: %+v", image, err)
+			writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", err.Error())
+			return
+		}
+		if !info.Exists {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", fmt.Sprintf("%s:%s not found", name, reference))
+			return
+		}
+		out := resolveResponse{Image: image, Digest: info.Digest, MediaType: info.MediaType}
+		var idx imageIndex
+		if err := json.Unmarshal(b, &idx); err != nil {
+			log.Printf("resolve: invalid manifest %s: %+v", image, err)
+		}
+		for _, m := range idx.Manifests {
+			if m.Platform == nil {
+				continue
+			}
+			out.Platforms = append(out.Platforms, platformManifest{Platform: m.Platform.String(), Digest: m.Digest, MediaType: m.MediaType})
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBlobResumes is how often a blob download is resumed after the upstream
+// connection failed.
+const maxBlobResumes = 3
+
+var blobResumesTotal = newCounterVec("registry_proxy_blob_resumes_total",
+	"Blob downloads resumed with a Range request after the upstream connection failed, by result (resumed or failed).", "result")
+
+// resumeBlobTransfers makes the body of a successful blob download resume
+// from the last byte read with a Range request if the upstream connection
+// drops partway, so clients get the whole blob instead of a truncated one.
+// Upstreams that don't answer the Range request with the requested range
+// fail the download as before.
+func resumeBlobTransfers(resp *http.Response, transport http.RoundTripper) *http.Response {
+	if resp.StatusCode != http.StatusOK || resp.Request.Method != http.MethodGet ||
+		resp.ContentLength <= 0 || !blobPath.MatchString(resp.Request.URL.Path) {
+		return resp
+	}
+	resp.Body = &resumingBody{
+		ReadCloser: resp.Body,
+		req:        resp.Request,
+		transport:  transport,
+		size:       resp.ContentLength,
+		etag:       resp.Header.Get("ETag"),
+	}
+	return resp
+}
+
+type resumingBody struct {
+	io.ReadCloser
+	req       *http.Request
+	transport http.RoundTripper
+	size      int64
+	etag      string
+
+	read    int64
+	resumes int
+}
+
+func (b *resumingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err == nil || (err == io.EOF && b.read >= b.size) {
+		return n, err
+	}
+	for b.resumes < maxBlobResumes && b.read < b.size && b.req.Context().Err() == nil {
+		b.resumes++
+		log.Printf("upstream blob download failed after %d of %d bytes, resuming (attempt %d): url=%s: %+v",
+			b.read, b.size, b.resumes, b.req.URL, err)
+		body, rerr := b.resume()
+		if rerr != nil {
+			log.Printf("could not resume blob download: url=%s: %+v", b.req.URL, rerr)
+			blobResumesTotal.inc("failed")
+			time.Sleep(time.Duration(b.resumes) * 100 * time.Millisecond)
+			continue
+		}
+		blobResumesTotal.inc("resumed")
+		b.ReadCloser.Close()
+		b.ReadCloser = body
+		// The bytes read so far are returned with a nil error, the next
+		// Read continues on the new connection.
+		return n, nil
+	}
+	return n, err
+}
+
+// resume requests the rest of the blob from the upstream.
+func (b *resumingBody) resume() (io.ReadCloser, error) {
+	r := b.req.WithContext(b.req.Context())
+	r.Header = make(http.Header, len(b.req.Header)+2)
+	for k, v := range b.req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.read))
+	if b.etag != "" {
+		r.Header.Set("If-Range", b.etag)
+	}
+	resp, err := b.transport.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream answered the range request with status %d", resp.StatusCode)
+	}
+	if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != b.read {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream returned the wrong range %q", resp.Header.Get("Content-Range"))
+	}
+	return resp.Body, nil
+}
+
+// contentRangeStart returns the first byte of a Content-Range header like
+// "bytes 100-199/200".
+func contentRangeStart(v string) (int64, bool) {
+	if !strings.HasPrefix(v, "bytes ") {
+		return 0, false
+	}
+	v = strings.TrimPrefix(v, "bytes ")
+	i := strings.Index(v, "-")
+	if i < 0 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:i], 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// bodyRewriter modifies the bodies of upstream responses. Rewriters only
+// transform content; rewriteBody takes care of the encoding, length and
+// digest headers.
+type bodyRewriter interface {
+	// applies reports whether the rewriter modifies the body of resp.
+	applies(resp *http.Response) bool
+	// rewrite writes the transformed body read from r to w.
+	rewrite(resp *http.Response, r io.Reader, w io.Writer) error
+}
+
+// rewriteBody runs the body of resp through the rewriters that apply to it,
+// in order. Gzip encoded bodies are decoded first and served decoded.
+// Manifests are buffered, up to limit bytes, to send their new length and
+// digest; other bodies are streamed without a length.
+func rewriteBody(resp *http.Response, limit int64, rewriters ...bodyRewriter) *http.Response {
+	if resp.StatusCode != http.StatusOK || resp.Request.Method == http.MethodHead {
+		return resp
+	}
+	var active []bodyRewriter
+	for _, rw := range rewriters {
+		if rw.applies(resp) {
+			active = append(active, rw)
+		}
+	}
+	if len(active) == 0 {
+		return resp
+	}
+
+	var body io.ReadCloser = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return registryErrorResponse(resp.Request, http.StatusBadGateway, "UNKNOWN", "invalid gzip response from upstream")
+		}
+		body = struct {
+			io.Reader
+			io.Closer
+		}{zr, resp.Body}
+		resp.Header.Del("Content-Encoding")
+	}
+	for _, rw := range active {
+		body = pipeRewrite(resp, rw, body)
+	}
+	resp.Body = body
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Etag")
+	resp.ContentLength = -1
+
+	if _, ok := resp.Header["Docker-Content-Digest"]; !ok {
+		return resp
+	}
+	defer body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil || int64(len(b)) > limit {
+		log.Printf("failed to rewrite response of url=%s: %+v", resp.Request.URL, err)
+		return registryErrorResponse(resp.Request, http.StatusBadGateway, "UNKNOWN", "failed to rewrite the upstream response")
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	resp.Header.Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(b)))
+	return resp
+}
+
+// pipeRewrite returns a body streaming the output of rw for the input in.
+// Errors of rw are returned by Read; closing the body stops rw.
+func pipeRewrite(resp *http.Response, rw bodyRewriter, in io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		err := rw.rewrite(resp, in, pw)
+		in.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// jsonRewrite describes how rewriteJSON changes a JSON object.
+type jsonRewrite struct {
+	// fields maps top-level fields to functions returning their new value.
+	fields map[string]func(json.RawMessage) json.RawMessage
+	// arrays maps top-level array fields to functions returning the new
+	// value of each element, or false to drop it.
+	arrays map[string]func(json.RawMessage) (json.RawMessage, bool)
+}
+
+// rewriteJSON streams the JSON object read from r to w, changed as described
+// by rw. Arrays are rewritten element by element and other fields are copied
+// as they are, so large lists are never held in memory at once.
+func rewriteJSON(r io.Reader, w io.Writer, rw jsonRewrite) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "{"); err != nil {
+		return err
+	}
+	for i := 0; dec.More(); i++ {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("expected an object key, got %v", tok)
+		}
+		k, _ := json.Marshal(key)
+		sep := ""
+		if i > 0 {
+			sep = ","
+		}
+		if _, err := fmt.Fprintf(w, "%s%s:", sep, k); err != nil {
+			return err
+		}
+		if fn, ok := rw.arrays[key]; ok {
+			if err := rewriteArray(dec, w, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+		if fn, ok := rw.fields[key]; ok {
+			v = fn(v)
+		}
+		if _, err := w.Write(v); err != nil {
+			return err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
+
+func rewriteArray(dec *json.Decoder, w io.Writer, fn func(json.RawMessage) (json.RawMessage, bool)) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		_, err := io.WriteString(w, "null")
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("expected an array, got %v", tok)
+	}
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	n := 0
+	for dec.More() {
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+		out, ok := fn(v)
+		if !ok {
+			continue
+		}
+		if n > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+		n++
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]")
+	return err
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expected %v, got %v", want, tok)
+	}
+	return nil
+}
+
+// mapName returns a function for rewriteJSON mapping a JSON string with
+// mapping. Strings it returns false for are kept in fields and dropped from
+// arrays.
+func mapName(mapping func(string) (string, bool)) func(json.RawMessage) (json.RawMessage, bool) {
+	return func(v json.RawMessage) (json.RawMessage, bool) {
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			return v, true
+		}
+		mapped, ok := mapping(s)
+		if !ok {
+			return v, false
+		}
+		b, _ := json.Marshal(mapped)
+		return b, true
+	}
+}
+
+// tagListNames rewrites the upstream repository name in tag lists to the
+// name clients know.
+type tagListNames struct{ cfg registryConfig }
+
+func (t tagListNames) applies(resp *http.Response) bool {
+	rr, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok || rr.kind != "tags" {
+		return false
+	}
+	name, ok := t.cfg.clientName(rr.name)
+	return ok && name != rr.name
+}
+
+func (t tagListNames) rewrite(resp *http.Response, r io.Reader, w io.Writer) error {
+	name := mapName(t.cfg.clientName)
+	return rewriteJSON(r, w, jsonRewrite{fields: map[string]func(json.RawMessage) json.RawMessage{
+		"name": func(v json.RawMessage) json.RawMessage {
+			v, _ = name(v)
+			return v
+		},
+	}})
+}
+
+// catalogNames rewrites the upstream repository names in the catalog to the
+// names clients know, leaving out repositories not served by the proxy.
+type catalogNames struct{ cfg registryConfig }
+
+func (c catalogNames) applies(resp *http.Response) bool {
+	return resp.Request.URL.Path == "/v2/_catalog"
+}
+
+func (c catalogNames) rewrite(resp *http.Response, r io.Reader, w io.Writer) error {
+	return rewriteJSON(r, w, jsonRewrite{arrays: map[string]func(json.RawMessage) (json.RawMessage, bool){
+		"repositories": mapName(c.cfg.clientName),
+	}})
+}
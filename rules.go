@@ -0,0 +1,181 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// repoRule maps client-visible repository names to upstream repository names.
+// A pattern ending in "/*" maps all repositories below it, e.g. the rule
+// "team-a/*=gcr.io/project-a" maps team-a/app to project-a/app. Other
+// patterns map exactly one repository, except "*", which matches all.
+//
+// A target of "!status" or "!status:message" denies access to the matching
+// repositories instead, answering with status 401, 403 or 404 (hiding that
+// the repository exists) and the message, if any.
+type repoRule struct {
+	pattern string
+	target  string
+
+	denyStatus  int
+	denyMessage string
+}
+
+// parseRepoRules parses a comma separated list of pattern=target rules.
+// Targets may start with the registry host, which must be registryHost.
+func parseRepoRules(s, registryHost string) ([]repoRule, error) {
+	var rules []repoRule
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("rule %q is not in the form pattern=target", r)
+		}
+		pattern, target := strings.Trim(parts[0], " /"), strings.Trim(parts[1], " /")
+		if i := strings.Index(target, "/"); i > 0 && strings.ContainsAny(target[:i], ".:") {
+			target = canonicalHost(target[:i]) + target[i:]
+		}
+		if strings.HasPrefix(target, "!") {
+			rule, err := parseDenyRule(pattern, target)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %+v", r, err)
+			}
+			rules = append(rules, rule)
+			continue
+		}
+		if strings.HasPrefix(target, registryHost+"/") {
+			target = strings.TrimPrefix(target, registryHost+"/")
+		} else if i := strings.Index(target, "/"); i > 0 && strings.ContainsAny(target[:i], ".:") {
+			return nil, fmt.Errorf("rule %q targets registry %s, only %s is supported", r, target[:i], registryHost)
+		}
+		if pattern == "" || target == "" || strings.Contains(strings.TrimSuffix(pattern, "/*"), "*") {
+			return nil, fmt.Errorf("invalid rule %q", r)
+		}
+		rules = append(rules, repoRule{pattern: pattern, target: target})
+	}
+	return rules, nil
+}
+
+// parseDenyRule parses a rule whose target is "!status" or
+// "!status:message".
+func parseDenyRule(pattern, target string) (repoRule, error) {
+	if pattern == "" || (pattern != "*" && strings.Contains(strings.TrimSuffix(pattern, "/*"), "*")) {
+		return repoRule{}, fmt.Errorf("invalid pattern %q", pattern)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(target, "!"), ":", 2)
+	r := repoRule{pattern: pattern}
+	switch parts[0] {
+	case "401":
+		r.denyStatus = http.StatusUnauthorized
+	case "403":
+		r.denyStatus = http.StatusForbidden
+	case "404":
+		r.denyStatus = http.StatusNotFound
+	default:
+		return r, fmt.Errorf("denial status must be 401, 403 or 404, got %q", parts[0])
+	}
+	if len(parts) == 2 {
+		r.denyMessage = strings.TrimSpace(parts[1])
+	}
+	return r, nil
+}
+
+func (r repoRule) wildcard() bool { return strings.HasSuffix(r.pattern, "/*") }
+
+// matches reports whether the client-visible name matches the pattern.
+func (r repoRule) matches(name string) bool {
+	if r.pattern == "*" {
+		return true
+	}
+	if !r.wildcard() {
+		return name == r.pattern
+	}
+	return strings.HasPrefix(name, r.base()+"/")
+}
+
+func (r repoRule) base() string { return strings.TrimSuffix(r.pattern, "/*") }
+
+// apply maps a client-visible name, returning false if the rule doesn't match.
+func (r repoRule) apply(name string) (string, bool) {
+	if !r.matches(name) {
+		return "", false
+	}
+	if !r.wildcard() {
+		return r.target, true
+	}
+	return r.target + strings.TrimPrefix(name, r.base()), true
+}
+
+// reverse maps an upstream name back to the client-visible name.
+func (r repoRule) reverse(upstream string) (string, bool) {
+	if r.denyStatus != 0 {
+		return "", false
+	}
+	if !r.wildcard() {
+		return r.pattern, upstream == r.target
+	}
+	if !strings.HasPrefix(upstream, r.target+"/") {
+		return "", false
+	}
+	return r.base() + strings.TrimPrefix(upstream, r.target), true
+}
+
+// repoDenial is the answer to requests for a repository denied by a rule.
+type repoDenial struct {
+	status  int
+	message string
+}
+
+// denial returns how requests for the client-visible name are answered if a
+// rule denies access to it, or nil.
+func (c registryConfig) denial(name string) *repoDenial {
+	for _, r := range c.rules {
+		if !r.matches(name) {
+			continue
+		}
+		if r.denyStatus == 0 {
+			return nil
+		}
+		return &repoDenial{status: r.denyStatus, message: r.denyMessage}
+	}
+	return nil
+}
+
+// writeTo answers a request for the repository with the denial.
+func (d *repoDenial) writeTo(w http.ResponseWriter, req *http.Request, name string) {
+	switch d.status {
+	case http.StatusUnauthorized:
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/_token",service="%s"`, req.Host, req.Host))
+		writeRegistryError(w, d.status, "UNAUTHORIZED", d.messageOr(fmt.Sprintf("authentication required to access repository %s", name)))
+	case http.StatusForbidden:
+		writeRegistryError(w, d.status, "DENIED", d.messageOr(fmt.Sprintf("access to repository %s is denied", name)))
+	default:
+		writeRegistryError(w, d.status, "NAME_UNKNOWN", d.messageOr(fmt.Sprintf("repository %s is not served by this registry", name)))
+	}
+}
+
+func (d *repoDenial) messageOr(def string) string {
+	if d.message != "" {
+		return d.message
+	}
+	return def
+}
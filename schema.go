@@ -0,0 +1,267 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// configFormat constrains the values of a config file field, for checking
+// config files and for the JSON Schema of --print-schema.
+type configFormat struct {
+	desc    string
+	pattern *regexp.Regexp
+	enum    []string
+	// minimum and maximum bound numbers if bounded is set.
+	bounded          bool
+	minimum, maximum float64
+	// check validates strings beyond pattern and enum, if set.
+	check func(v string) error
+}
+
+var (
+	durationFormat = &configFormat{
+		desc:    "a duration like 90s, 15m or 8760h",
+		pattern: regexp.MustCompile(`^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`),
+	}
+	hostFormat = &configFormat{
+		desc:    "a registry host with an optional port, like gcr.io or registry.internal:5443",
+		pattern: regexp.MustCompile(`^(\[[0-9A-Fa-f:.]+\]|[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*)(:[0-9]{1,5})?$`),
+	}
+	prefixFormat = &configFormat{
+		desc:    "a repository path like my-project/images",
+		pattern: referenceName,
+	}
+	patternFormat = &configFormat{
+		desc: "a repository name or a pattern like team-a/* in path.Match syntax",
+		check: func(v string) error {
+			if _, err := path.Match(v, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q", v)
+			}
+			return nil
+		},
+	}
+	platformFormat = &configFormat{
+		desc:    "a platform like linux/amd64 or linux/arm/v7",
+		pattern: regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`),
+	}
+)
+
+// configFormats constrains fields by the name of their Go struct type and
+// JSON name. The format of a list or map applies to its elements.
+var configFormats = map[string]*configFormat{
+	"cachePolicyRule.repository": patternFormat,
+	"cachePolicyRule.kind":       {enum: []string{"blobs", "manifests", "tags", "referrers"}},
+	"cachePolicyRule.reference":  {enum: []string{"tag", "digest"}},
+	"cachePolicyRule.max_age":    durationFormat,
+	"mirrorConfig.images": {
+		desc: "an image like library/nginx:1.25, team/app:v* or team/app@sha256:...",
+		check: func(v string) error {
+			_, err := parseMirrorImage(v)
+			return err
+		},
+	},
+	"mirrorConfig.interval":            durationFormat,
+	"mirrorConfig.platforms":           platformFormat,
+	"authzRule.repositories":           patternFormat,
+	"authzRule.actions":                {enum: []string{"pull", "push", "delete", "admin"}},
+	"virtualConfig.negative_cache_ttl": durationFormat,
+	"fallbackUpstream.host":            hostFormat,
+	"fallbackUpstream.repo_prefix":     prefixFormat,
+	"shadowConfig.sample_rate":         {desc: "a fraction of reads", bounded: true, maximum: 1},
+	"canaryConfig.percent":             {desc: "a percentage of reads", bounded: true, maximum: 100},
+	"priorityConfig.high":              patternFormat,
+	"priorityConfig.low":               patternFormat,
+	"priorityConfig.upstreams":         {enum: []string{"high", "normal", "low"}},
+	"priorityConfig.queue_timeout":     durationFormat,
+}
+
+// parseFileConfig parses a config file strictly: unknown fields and values
+// of the wrong format are errors naming the field, like
+// virtual.upstreams[1].host.
+func parseFileConfig(b []byte) (fileConfig, error) {
+	var fc fileConfig
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return fc, err
+	}
+	if dec.More() {
+		return fc, fmt.Errorf("unexpected data after the configuration")
+	}
+	return fc, checkConfigValue(reflect.ValueOf(fc), "", nil)
+}
+
+// checkConfigValue checks v and the fields, elements and map values in it
+// against the config formats. format applies to strings and numbers.
+func checkConfigValue(v reflect.Value, name string, format *configFormat) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous {
+				if err := checkConfigValue(v.Field(i), name, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			tag := configFieldName(f)
+			if tag == "" {
+				continue
+			}
+			fieldName := tag
+			if name != "" {
+				fieldName = name + "." + tag
+			}
+			if err := checkConfigValue(v.Field(i), fieldName, configFormats[t.Name()+"."+tag]); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := checkConfigValue(v.Index(i), fmt.Sprintf("%s[%d]", name, i), format); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, k := range keys {
+			if err := checkConfigValue(v.MapIndex(k), name+"."+k.String(), format); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		// Empty strings leave settings at their defaults.
+		if s := v.String(); format != nil && s != "" {
+			if err := format.checkString(s); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	case reflect.Float64, reflect.Int:
+		n := v.Convert(reflect.TypeOf(float64(0))).Float()
+		if format != nil && format.bounded && (n < format.minimum || n > format.maximum) {
+			return fmt.Errorf("%s: %v is out of range, expected %s between %g and %g", name, n, format.desc, format.minimum, format.maximum)
+		}
+	}
+	return nil
+}
+
+func (f *configFormat) checkString(s string) error {
+	if f.pattern != nil && !f.pattern.MatchString(s) {
+		return fmt.Errorf("invalid value %q, expected %s", s, f.desc)
+	}
+	if len(f.enum) > 0 {
+		ok := false
+		for _, e := range f.enum {
+			ok = ok || e == s
+		}
+		if !ok {
+			return fmt.Errorf("invalid value %q, expected one of %s", s, strings.Join(f.enum, ", "))
+		}
+	}
+	if f.check != nil {
+		return f.check(s)
+	}
+	return nil
+}
+
+// configFieldName returns the JSON name of a config file field, or "" if
+// the field isn't read from the file.
+func configFieldName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// configSchema returns the JSON Schema of values of type t.
+func configSchema(t reflect.Type, format *configFormat) map[string]interface{} {
+	s := map[string]interface{}{}
+	switch t.Kind() {
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		addConfigProperties(t, props)
+		s["type"], s["properties"], s["additionalProperties"] = "object", props, false
+		return s
+	case reflect.Slice:
+		s["type"], s["items"] = "array", configSchema(t.Elem(), format)
+		return s
+	case reflect.Map:
+		s["type"], s["additionalProperties"] = "object", configSchema(t.Elem(), format)
+		return s
+	case reflect.String:
+		s["type"] = "string"
+	case reflect.Float64:
+		s["type"] = "number"
+	case reflect.Int:
+		s["type"] = "integer"
+	case reflect.Bool:
+		s["type"] = "boolean"
+	}
+	if format == nil {
+		return s
+	}
+	if format.desc != "" {
+		s["description"] = format.desc
+	}
+	if format.pattern != nil {
+		s["pattern"] = format.pattern.String()
+	}
+	if len(format.enum) > 0 {
+		s["enum"] = format.enum
+	}
+	if format.bounded {
+		s["minimum"], s["maximum"] = format.minimum, format.maximum
+	}
+	return s
+}
+
+func addConfigProperties(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			addConfigProperties(f.Type, props)
+			continue
+		}
+		if name := configFieldName(f); name != "" {
+			props[name] = configSchema(f.Type, configFormats[t.Name()+"."+name])
+		}
+	}
+}
+
+// printConfigSchema writes the JSON Schema of the config file to stdout, so
+// deployments can validate config files before rolling them out.
+func printConfigSchema() {
+	s := configSchema(reflect.TypeOf(fileConfig{}), nil)
+	s["$schema"] = "http://json-schema.org/draft-07/schema#"
+	s["title"] = "gcr-proxy configuration file"
+	b, _ := json.MarshalIndent(s, "", "  ")
+	fmt.Fprintln(os.Stdout, string(b))
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	mediaTypeSchema1       = "application/vnd.docker.distribution.manifest.v1+json"
+	mediaTypeSchema1Signed = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+// schema1Policy controls what happens to Docker schema1 manifests returned by
+// the upstream registry.
+type schema1Policy string
+
+const (
+	schema1Allow  schema1Policy = "allow"
+	schema1Warn   schema1Policy = "warn"
+	schema1Reject schema1Policy = "reject"
+)
+
+func getSchema1Policy() schema1Policy {
+	switch v := schema1Policy(strings.ToLower(os.Getenv("SCHEMA1_MANIFESTS"))); v {
+	case "":
+		return schema1Allow
+	case schema1Allow, schema1Warn, schema1Reject:
+		return v
+	default:
+		log.Fatalf("SCHEMA1_MANIFESTS must be one of allow, warn or reject, got %q", v)
+		return ""
+	}
+}
+
+// isSchema1Manifest reports whether resp carries a Docker schema1 manifest.
+func isSchema1Manifest(resp *http.Response) bool {
+	if !strings.Contains(resp.Request.URL.Path, "/manifests/") {
+		return false
+	}
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("content-type"))
+	return mt == mediaTypeSchema1 || mt == mediaTypeSchema1Signed
+}
+
+// applySchema1Policy logs or replaces schema1 manifest responses according to
+// the policy. Rejected manifests are answered with an error that tells the
+// user why the pull failed instead of handing modern clients a payload they
+// cannot use.
+func applySchema1Policy(p schema1Policy, resp *http.Response) *http.Response {
+	if p == schema1Allow || !isSchema1Manifest(resp) {
+		return resp
+	}
+	log.Printf("upstream returned a schema1 manifest for url=%s", resp.Request.URL)
+	if p != schema1Reject {
+		return resp
+	}
+	resp.Body.Close()
+	return registryErrorResponse(resp.Request, http.StatusNotAcceptable, "MANIFEST_INVALID",
+		"image uses the deprecated Docker schema1 manifest format, which this registry does not serve; re-push it with a recent client")
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// getAllowedActions returns the repository actions clients may perform
+// through the proxy, from ALLOWED_ACTIONS. Only pulls are allowed by default,
+// so the proxy can't be used to write to the upstream with its credentials.
+func getAllowedActions() map[string]bool {
+	v := os.Getenv("ALLOWED_ACTIONS")
+	if v == "" {
+		v = "pull"
+	}
+	actions := map[string]bool{}
+	for _, a := range strings.Split(v, ",") {
+		a = strings.TrimSpace(a)
+		switch a {
+		case "pull", "push", "delete":
+			actions[a] = true
+		default:
+			log.Fatalf("invalid action %q in ALLOWED_ACTIONS, expected pull, push or delete", a)
+		}
+	}
+	if len(actions) > 1 || !actions["pull"] {
+		log.Printf("clients may perform these actions through the proxy: %s", v)
+	}
+	return actions
+}
+
+// restrictScope removes the actions that are not allowed from a space
+// separated list of token scopes like "repository:foo:pull,push". The
+// wildcard action "*" is replaced with the allowed actions, and repository
+// scopes left without actions are dropped.
+func restrictScope(scope string, allowed map[string]bool) string {
+	var out []string
+	for _, p := range strings.Fields(scope) {
+		fields := strings.Split(p, ":")
+		if len(fields) < 3 || fields[0] != "repository" {
+			out = append(out, p)
+			continue
+		}
+		var actions []string
+		for _, a := range strings.Split(fields[len(fields)-1], ",") {
+			if a == "*" {
+				for _, b := range []string{"pull", "push", "delete"} {
+					if allowed[b] {
+						actions = append(actions, b)
+					}
+				}
+			} else if allowed[a] {
+				actions = append(actions, a)
+			}
+		}
+		if len(actions) > 0 {
+			fields[len(fields)-1] = strings.Join(actions, ",")
+			out = append(out, strings.Join(fields, ":"))
+		}
+	}
+	return strings.Join(out, " ")
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTokenProxyDropsUnservedScopes(t *testing.T) {
+	var got []string
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()["scope"]
+		w.Write([]byte(`{"token": "t"}`))
+	}))
+	defer tokens.Close()
+
+	rules, err := parseRepoRules("internal/*=!403", "registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := registryConfig{
+		host:           "registry.example.com",
+		repoPrefix:     "project",
+		rules:          rules,
+		allowedActions: map[string]bool{"pull": true},
+		transport:      http.DefaultTransport,
+	}
+	h := tokenProxyHandler(cfg, &tokenDiscovery{cfg: cfg, endpoint: tokens.URL, discovered: true})
+
+	tests := []struct {
+		scope string
+		want  []string
+	}{
+		{scope: "repository:app:pull", want: []string{"repository:project/app:pull"}},
+		{scope: "repository:internal/app:pull", want: nil},
+		{scope: "repository:app:pull repository:internal/app:pull", want: []string{"repository:project/app:pull"}},
+		{scope: "registry:catalog:* repository:internal/app:pull", want: []string{"registry:catalog:*"}},
+	}
+	for _, tt := range tests {
+		got = nil
+		req := httptest.NewRequest(http.MethodGet, "/_token?service=proxy&scope="+url.QueryEscape(tt.scope), nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+			t.Errorf("scope %q: upstream got %q, want %q", tt.scope, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// runSelftest implements the "selftest" command: it starts a fake upstream
+// registry and the proxy, configured from the environment like the server
+// but pointed at the fake, and pulls (and with -push, pushes) an image
+// through the proxy. It returns the exit code.
+func runSelftest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	image := fs.String("image", "selftest/app:latest", "image to pull through the proxy")
+	push := fs.Bool("push", false, "also push an image through the proxy")
+	verbose := fs.Bool("v", false, "show the log of the proxy")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	name, tag, err := parseReference(*image, "")
+	if err != nil || isDigest(tag) {
+		fmt.Fprintf(os.Stderr, "invalid -image %q, expected name:tag\n", *image)
+		return 2
+	}
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	fake := newFakeRegistry(tag)
+	upstream := httptest.NewTLSServer(fake)
+	defer upstream.Close()
+	fake.host = strings.TrimPrefix(upstream.URL, "https://")
+
+	ca, err := ioutil.TempFile("", "selftest-ca-*.pem")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write CA file: %+v\n", err)
+		return 1
+	}
+	defer os.Remove(ca.Name())
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	ca.Close()
+
+	// The configuration of the environment is used as is, except for what
+	// would reach out of the process.
+	if orig := os.Getenv("REGISTRY_HOST"); orig != "" {
+		os.Setenv("REPO_RULES", strings.Replace(os.Getenv("REPO_RULES"), orig+"/", fake.host+"/", -1))
+	}
+	os.Setenv("REGISTRY_HOST", fake.host)
+	os.Setenv("UPSTREAM_CA_FILE", ca.Name())
+	for _, k := range []string{"UPSTREAM_PROXY_URL", "SELF_CHECK_IMAGE", "ANALYTICS_BIGQUERY_TABLE", "ANALYTICS_GCS_BUCKET"} {
+		os.Unsetenv(k)
+	}
+	proxy := httptest.NewServer(newProxyServer().handler)
+	defer proxy.Close()
+
+	c := &selftestClient{
+		base:     proxy.URL,
+		client:   proxy.Client(),
+		username: os.Getenv("REGISTRY_PROXY_USERNAME"),
+		password: os.Getenv("REGISTRY_PROXY_PASSWORD"),
+	}
+	failed := 0
+	step := func(desc string, fn func() error) {
+		if err := fn(); err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %+v\n", desc, err)
+			return
+		}
+		fmt.Printf("PASS %s\n", desc)
+	}
+	step("ping /v2/", func() error { return c.expect(http.MethodGet, "/v2/", "", nil, http.StatusOK, nil) })
+	step("resolve "+*image, func() error {
+		return c.expect(http.MethodHead, "/v2/"+name+"/manifests/"+tag, "", nil, http.StatusOK, nil)
+	})
+	step("pull "+*image, func() error { return c.pull(name, tag, fake.image) })
+	step("list tags of "+name, func() error {
+		var tl struct {
+			Tags []string `json:"tags"`
+		}
+		if err := c.expect(http.MethodGet, "/v2/"+name+"/tags/list", "", nil, http.StatusOK, &tl); err != nil {
+			return err
+		}
+		if len(tl.Tags) == 0 || tl.Tags[0] != tag {
+			return fmt.Errorf("tag %s not listed: %v", tag, tl.Tags)
+		}
+		return nil
+	})
+	if *push {
+		pushed := newFakeImage([]byte("pushed through the proxy"))
+		step("push "+name+":pushed", func() error { return c.push(name, "pushed", pushed) })
+		step("pull "+name+":pushed", func() error { return c.pull(name, "pushed", pushed) })
+	}
+	if failed > 0 {
+		fmt.Printf("%d checks failed, run with -v to see the log of the proxy\n", failed)
+		return 1
+	}
+	fmt.Println("all checks passed")
+	return 0
+}
+
+// fakeImage is a single layer image.
+type fakeImage struct {
+	manifest []byte
+	blobs    map[string][]byte
+}
+
+func (i fakeImage) digest() string { return sha256Digest(i.manifest) }
+
+func sha256Digest(b []byte) string { return fmt.Sprintf("sha256:%x", sha256.Sum256(b)) }
+
+func newFakeImage(layer []byte) fakeImage {
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":["` + sha256Digest(layer) + `"]}}`)
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.config.v1+json",
+			"digest":    sha256Digest(config),
+			"size":      len(config),
+		},
+		"layers": []map[string]interface{}{{
+			"mediaType": "application/vnd.oci.image.layer.v1.tar",
+			"digest":    sha256Digest(layer),
+			"size":      len(layer),
+		}},
+	})
+	return fakeImage{
+		manifest: manifest,
+		blobs:    map[string][]byte{sha256Digest(config): config, sha256Digest(layer): layer},
+	}
+}
+
+// fakeRegistry is a minimal Distribution API implementation serving the same
+// images in every repository. It requires a bearer token from its token
+// service, which it hands out to everyone.
+type fakeRegistry struct {
+	host  string
+	image fakeImage
+
+	mu        sync.Mutex
+	manifests map[string][]byte
+	blobs     map[string][]byte
+}
+
+func newFakeRegistry(tag string) *fakeRegistry {
+	img := newFakeImage(bytes.Repeat([]byte("registry-proxy selftest layer\n"), 4096))
+	r := &fakeRegistry{
+		image:     img,
+		manifests: map[string][]byte{tag: img.manifest, img.digest(): img.manifest},
+		blobs:     map[string][]byte{},
+	}
+	for d, b := range img.blobs {
+		r.blobs[d] = b
+	}
+	return r
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"token": "selftest", "expires_in": 300})
+		return
+	}
+	if req.Header.Get("Authorization") == "" {
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="fake-registry"`, f.host))
+		writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+	if req.URL.Path == "/v2/" {
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, "/blobs/uploads/") && req.Method == http.MethodPost {
+		f.upload(w, req)
+		return
+	}
+	rr, ok := parseRegistryPath(req.URL.Path)
+	if !ok {
+		writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN", "not found")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case rr.kind == "tags":
+		var tags []string
+		for ref := range f.manifests {
+			if !isDigest(ref) {
+				tags = append(tags, ref)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": rr.name, "tags": tags})
+	case rr.kind == "manifests" && req.Method == http.MethodPut:
+		b, _ := ioutil.ReadAll(io.LimitReader(req.Body, defaultMaxManifestSize))
+		f.manifests[rr.reference] = b
+		f.manifests[sha256Digest(b)] = b
+		w.Header().Set("Docker-Content-Digest", sha256Digest(b))
+		w.WriteHeader(http.StatusCreated)
+	case rr.kind == "manifests":
+		b, ok := f.manifests[rr.reference]
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		f.serve(w, req, b)
+	case rr.kind == "blobs":
+		b, ok := f.blobs[rr.reference]
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		f.serve(w, req, b)
+	default:
+		writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN", "not found")
+	}
+}
+
+func (f *fakeRegistry) serve(w http.ResponseWriter, req *http.Request, b []byte) {
+	w.Header().Set("Docker-Content-Digest", sha256Digest(b))
+	w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+	if req.Method != http.MethodHead {
+		w.Write(b)
+	}
+}
+
+// upload implements monolithic blob uploads, POST .../blobs/uploads/?digest=.
+func (f *fakeRegistry) upload(w http.ResponseWriter, req *http.Request) {
+	b, err := ioutil.ReadAll(req.Body)
+	digest := req.URL.Query().Get("digest")
+	if err != nil || digest != sha256Digest(b) {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest does not match content")
+		return
+	}
+	f.mu.Lock()
+	f.blobs[digest] = b
+	f.mu.Unlock()
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// selftestClient talks to the proxy like docker does, getting a token from
+// the realm the proxy challenges it with.
+type selftestClient struct {
+	base     string
+	client   *http.Client
+	username string
+	password string
+	token    string
+}
+
+func (c *selftestClient) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequest(method, c.base+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("Accept", manifestAcceptTypes)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		return c.client.Do(req)
+	}
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	if err := c.login(resp.Header.Get("Www-Authenticate")); err != nil {
+		return nil, err
+	}
+	return send()
+}
+
+// login gets a token for the challenge from the proxy.
+func (c *selftestClient) login(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") {
+		return fmt.Errorf("unexpected challenge %q", challenge)
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return fmt.Errorf("invalid realm in challenge %q", challenge)
+	}
+	q := realm.Query()
+	q.Set("service", params["service"])
+	if params["scope"] != "" {
+		q.Set("scope", params["scope"])
+	}
+	// The proxy serves plain HTTP here, the realm says https.
+	req, err := http.NewRequest(http.MethodGet, c.base+realm.Path+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("token request failed: %+v", err)
+	}
+	defer resp.Body.Close()
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("token request returned status %d: %s", resp.StatusCode, bytes.TrimSpace(b))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return fmt.Errorf("invalid token response: %+v", err)
+	}
+	c.token = tr.Token
+	if c.token == "" {
+		c.token = tr.AccessToken
+	}
+	return nil
+}
+
+// expect sends a request, checks the status and decodes a JSON response
+// into out if not nil.
+func (c *selftestClient) expect(method, path, contentType string, body []byte, status int, out interface{}) error {
+	resp, err := c.do(method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s %s: failed to read response: %+v", method, path, err)
+	}
+	if resp.StatusCode != status {
+		return fmt.Errorf("%s %s: got status %d, want %d: %s", method, path, resp.StatusCode, status, bytes.TrimSpace(b))
+	}
+	if out != nil {
+		if err := json.Unmarshal(b, out); err != nil {
+			return fmt.Errorf("%s %s: invalid response: %+v", method, path, err)
+		}
+	}
+	return nil
+}
+
+// get downloads path and checks that its content matches digest.
+func (c *selftestClient) get(path, digest string) ([]byte, error) {
+	resp, err := c.do(http.MethodGet, path, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: failed to read response: %+v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: got status %d: %s", path, resp.StatusCode, bytes.TrimSpace(b))
+	}
+	if got := sha256Digest(b); got != digest {
+		return nil, fmt.Errorf("GET %s: content has digest %s, want %s", path, got, digest)
+	}
+	return b, nil
+}
+
+func (c *selftestClient) pull(name, tag string, img fakeImage) error {
+	if _, err := c.get("/v2/"+name+"/manifests/"+tag, img.digest()); err != nil {
+		return err
+	}
+	for d := range img.blobs {
+		if _, err := c.get("/v2/"+name+"/blobs/"+d, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *selftestClient) push(name, tag string, img fakeImage) error {
+	for d, b := range img.blobs {
+		err := c.expect(http.MethodPost, "/v2/"+name+"/blobs/uploads/?digest="+url.QueryEscape(d),
+			"application/octet-stream", b, http.StatusCreated, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return c.expect(http.MethodPut, "/v2/"+name+"/manifests/"+tag,
+		"application/vnd.oci.image.manifest.v1+json", img.manifest, http.StatusCreated, nil)
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxShadowRequests bounds the replayed requests in flight, further
+	// reads are not replayed.
+	maxShadowRequests = 16
+	// maxShadowMismatches is the number of recent mismatches kept for the
+	// admin API.
+	maxShadowMismatches = 100
+)
+
+var shadowRequestsTotal = newCounterVec("registry_proxy_shadow_requests_total",
+	"Reads replayed against the shadow upstream by kind and result (match, status_mismatch, digest_mismatch, error or dropped).", "kind", "result")
+
+// shadowConfig names a secondary upstream that reads are replayed against,
+// like the registry a migration moves to.
+type shadowConfig struct {
+	fallbackUpstream
+	// SampleRate is the fraction of reads replayed, all of them if 0.
+	SampleRate float64 `json:"sample_rate"`
+}
+
+// shadowReader replays the manifest and blob reads served from the primary
+// upstream against a secondary one in the background, and reports where the
+// two disagree on whether content exists or on the digest of a manifest.
+// Clients are always served by the primary.
+type shadowReader struct {
+	upstream   *upstreamClient
+	sampleRate float64
+	inflight   chan struct{}
+
+	mu         sync.Mutex
+	mismatches []shadowMismatch
+}
+
+// shadowMismatch is a read the upstreams answered differently.
+type shadowMismatch struct {
+	Time          time.Time `json:"time"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	PrimaryStatus int       `json:"primary_status"`
+	ShadowStatus  int       `json:"shadow_status"`
+	PrimaryDigest string    `json:"primary_digest,omitempty"`
+	ShadowDigest  string    `json:"shadow_digest,omitempty"`
+}
+
+// getShadowReader returns the shadow reads of the config file, or nil if
+// no shadow upstream is configured. The shadow upstream shares the
+// configuration of primary except for its host, repository prefix and
+// credential.
+func getShadowReader(sc shadowConfig, primary registryConfig) *shadowReader {
+	if sc.Host == "" {
+		return nil
+	}
+	if sc.SampleRate < 0 || sc.SampleRate > 1 {
+		log.Fatalf("invalid shadow.sample_rate %v, expected a fraction between 0 and 1", sc.SampleRate)
+	}
+	cfg := primary
+	cfg.host = canonicalHost(sc.Host)
+	cfg.repoPrefix = strings.Trim(sc.RepoPrefix, "/")
+	var auth authenticator
+	if sc.AuthHeader != "" {
+		auth = authHeader(sc.AuthHeader)
+	}
+	s := &shadowReader{
+		upstream:   newUpstreamClient(cfg, auth),
+		sampleRate: sc.SampleRate,
+		inflight:   make(chan struct{}, maxShadowRequests),
+	}
+	if s.sampleRate == 0 {
+		s.sampleRate = 1
+	}
+	log.Printf("replaying %g of reads against shadow upstream %s", s.sampleRate, cfg.host)
+	return s
+}
+
+// middleware serves requests with next and replays the manifest and blob
+// reads among them against the shadow upstream.
+func (s *shadowReader) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rr, ok := parseRegistryPath(req.URL.Path)
+		if !ok || (req.Method != http.MethodGet && req.Method != http.MethodHead) ||
+			(rr.kind != "manifests" && rr.kind != "blobs") || strings.HasPrefix(rr.reference, "uploads/") ||
+			rand.Float64() >= s.sampleRate {
+			next.ServeHTTP(w, req)
+			return
+		}
+		accept := strings.Join(req.Header["Accept"], ", ")
+		cw := &countingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, req)
+		primary := shadowMismatch{
+			Method:        req.Method,
+			Path:          req.URL.Path,
+			PrimaryStatus: cw.status,
+			PrimaryDigest: w.Header().Get("Docker-Content-Digest"),
+		}
+		select {
+		case s.inflight <- struct{}{}:
+		default:
+			shadowRequestsTotal.inc(rr.kind, "dropped")
+			return
+		}
+		go func() {
+			defer func() { <-s.inflight }()
+			s.compare(rr, accept, primary)
+		}()
+	})
+}
+
+// compare replays a read the primary answered as recorded in m.
+func (s *shadowReader) compare(rr registryRequest, accept string, m shadowMismatch) {
+	primaryFound, ok := shadowFound(m.PrimaryStatus)
+	if !ok {
+		// Errors of the primary say nothing about the content.
+		return
+	}
+	resp, err := s.upstream.get(http.MethodHead, rr.name, rr.kind, rr.reference, accept)
+	if err != nil {
+		log.Printf("shadow request for %s failed: %+v", m.Path, err)
+		shadowRequestsTotal.inc(rr.kind, "error")
+		return
+	}
+	resp.Body.Close()
+	m.ShadowStatus = resp.StatusCode
+	found, ok := shadowFound(resp.StatusCode)
+	if !ok {
+		log.Printf("shadow request for %s returned status %d", m.Path, resp.StatusCode)
+		shadowRequestsTotal.inc(rr.kind, "error")
+		return
+	}
+	result := "match"
+	if primaryFound != found {
+		result = "status_mismatch"
+	} else if rr.kind == "manifests" && primaryFound {
+		m.ShadowDigest = resp.Header.Get("Docker-Content-Digest")
+		if m.PrimaryDigest != "" && m.ShadowDigest != "" && m.PrimaryDigest != m.ShadowDigest {
+			result = "digest_mismatch"
+		}
+	}
+	shadowRequestsTotal.inc(rr.kind, result)
+	if result == "match" {
+		return
+	}
+	log.Printf("shadow %s: %s %s primary=%d %s shadow=%d %s", result, m.Method, m.Path,
+		m.PrimaryStatus, m.PrimaryDigest, m.ShadowStatus, m.ShadowDigest)
+	m.Time = time.Now()
+	s.mu.Lock()
+	s.mismatches = append(s.mismatches, m)
+	if len(s.mismatches) > maxShadowMismatches {
+		s.mismatches = s.mismatches[len(s.mismatches)-maxShadowMismatches:]
+	}
+	s.mu.Unlock()
+}
+
+// shadowFound reports whether a response with status means the content
+// exists, and false for ok if status doesn't tell, like for errors.
+// Redirects of blob requests to storage count as found.
+func shadowFound(status int) (found, ok bool) {
+	switch {
+	case status < http.StatusBadRequest:
+		return true, true
+	case status == http.StatusNotFound:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// handler lists the recent mismatches, newest first.
+func (s *shadowReader) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		out := make([]shadowMismatch, 0, len(s.mismatches))
+		for i := len(s.mismatches) - 1; i >= 0; i-- {
+			out = append(out, s.mismatches[i])
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, struct {
+			Upstream   string           `json:"upstream"`
+			Mismatches []shadowMismatch `json:"mismatches"`
+		}{s.upstream.cfg.host, out})
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sloClasses are the endpoint classes availability and latency are tracked
+// for.
+var sloClasses = []string{"token", "manifest", "blob"}
+
+var (
+	requestDuration = newHistogramVec("registry_proxy_request_duration_seconds",
+		"Time until the response to a client starts, by endpoint class (token, manifest or blob).",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}, "class")
+	requestsTotal = newCounterVec("registry_proxy_requests_total",
+		"Client requests by endpoint class (token, manifest or blob) and result (success or error, for 5xx responses).", "class", "result")
+
+	// requestSLIs are the service level indicators of the proxy.
+	requestSLIs = &sliTracker{total: map[string]int64{}, failures: map[string]int64{}}
+)
+
+// getAvailabilityTarget reads the availability objective from
+// SLO_AVAILABILITY_TARGET, like 0.999, or returns 0 if none is set.
+func getAvailabilityTarget() float64 {
+	v := os.Getenv("SLO_AVAILABILITY_TARGET")
+	if v == "" {
+		return 0
+	}
+	t, err := strconv.ParseFloat(v, 64)
+	if err != nil || t <= 0 || t >= 1 {
+		log.Fatalf("invalid SLO_AVAILABILITY_TARGET %q, expected a fraction like 0.999", v)
+	}
+	return t
+}
+
+// sliTracker counts successful and failed requests per endpoint class since
+// the proxy started. Latencies are kept in requestDuration.
+type sliTracker struct {
+	// availabilityTarget is the objective the error budget is computed for,
+	// 0 if there is none.
+	availabilityTarget float64
+
+	mu       sync.Mutex
+	total    map[string]int64
+	failures map[string]int64
+}
+
+// sloStatus are the indicators of one endpoint class, as shown by the status
+// endpoint.
+type sloStatus struct {
+	Requests     int64   `json:"requests"`
+	SuccessRatio float64 `json:"success_ratio"`
+	P50Ms        float64 `json:"p50_ms"`
+	P95Ms        float64 `json:"p95_ms"`
+	P99Ms        float64 `json:"p99_ms"`
+	// ErrorBudgetRemaining is the fraction of the errors allowed by the
+	// availability target that is left, negative once it is exceeded.
+	ErrorBudgetRemaining *float64 `json:"error_budget_remaining,omitempty"`
+}
+
+// sloClass returns the endpoint class of req, or "" if it isn't tracked.
+func sloClass(req *http.Request) string {
+	if req.URL.Path == "/_token" {
+		return "token"
+	}
+	rr, ok := parseRegistryPath(req.URL.Path)
+	if !ok || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return ""
+	}
+	switch {
+	case rr.kind == "manifests":
+		return "manifest"
+	case rr.kind == "blobs" && !strings.HasPrefix(rr.reference, "uploads/"):
+		return "blob"
+	}
+	return ""
+}
+
+func (t *sliTracker) record(class string, status int, latency time.Duration) {
+	result := "success"
+	if status >= http.StatusInternalServerError {
+		result = "error"
+	}
+	requestsTotal.inc(class, result)
+	requestDuration.observe(latency.Seconds(), class)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total[class]++
+	if result == "error" {
+		t.failures[class]++
+	}
+}
+
+// status returns the indicators of every class with requests.
+func (t *sliTracker) status() map[string]sloStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := map[string]sloStatus{}
+	for _, class := range sloClasses {
+		n := t.total[class]
+		if n == 0 {
+			continue
+		}
+		st := sloStatus{
+			Requests:     n,
+			SuccessRatio: float64(n-t.failures[class]) / float64(n),
+			P50Ms:        quantileMs(.5, class),
+			P95Ms:        quantileMs(.95, class),
+			P99Ms:        quantileMs(.99, class),
+		}
+		if t.availabilityTarget > 0 {
+			allowed := (1 - t.availabilityTarget) * float64(n)
+			remaining := 1 - float64(t.failures[class])/allowed
+			st.ErrorBudgetRemaining = &remaining
+		}
+		out[class] = st
+	}
+	return out
+}
+
+// quantileMs returns the q-quantile of the latency of class in milliseconds,
+// rounded to a tenth.
+func quantileMs(q float64, class string) float64 {
+	return math.Round(requestDuration.quantile(q, class)*10000) / 10
+}
+
+// middleware records the availability and latency of token, manifest and
+// blob requests. Latency is the time until the response starts, so it
+// doesn't depend on the size of blobs.
+func (t *sliTracker) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		class := sloClass(req)
+		if class == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		sw := &startTimingResponseWriter{ResponseWriter: w, start: time.Now()}
+		next.ServeHTTP(sw, req)
+		if sw.status == 0 {
+			sw.status, sw.latency = http.StatusOK, time.Since(sw.start)
+		}
+		t.record(class, sw.status, sw.latency)
+	})
+}
+
+// startTimingResponseWriter records the status of the response and when it
+// started.
+type startTimingResponseWriter struct {
+	http.ResponseWriter
+	start   time.Time
+	status  int
+	latency time.Duration
+}
+
+func (w *startTimingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status, w.latency = status, time.Since(w.start)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *startTimingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *startTimingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// configSnapshot is the configuration that can change while the proxy runs:
+// the upstreams with their repository rules, credentials and caches, the
+// cache policy and authorization rules, the canary and the mirrored images
+// from the config file, and the maintenance mode of /_admin/maintenance.
+// Snapshots are never modified once published; changes publish a new
+// snapshot with a higher version, so requests read their configuration
+// without locks.
+type configSnapshot struct {
+	version uint64
+	// upstream is REGISTRY_HOST.
+	upstream *registryRoundtripper
+	// canary is the canary upstream, nil if there is none.
+	canary        *registryRoundtripper
+	canaryPercent float64
+	// overrides are the upstreams of X-Proxy-Upstream by name.
+	overrides   map[string]*registryRoundtripper
+	cachePolicy []cachePolicyRule
+	authz       []authzRule
+	mirror      mirrorSettings
+	maintenance maintenanceState
+}
+
+// liveConfig holds the current configSnapshot.
+type liveConfig struct {
+	// mu serializes writers, so concurrent changes don't lose each other.
+	mu sync.Mutex
+	v  atomic.Value
+}
+
+func newLiveConfig() *liveConfig {
+	l := &liveConfig{}
+	l.v.Store(&configSnapshot{})
+	return l
+}
+
+// load returns the current snapshot.
+func (l *liveConfig) load() *configSnapshot {
+	return l.v.Load().(*configSnapshot)
+}
+
+// update publishes a copy of the current snapshot changed by fn, which must
+// replace rather than modify the slices, maps and upstreams of the snapshot
+// it is given.
+func (l *liveConfig) update(fn func(s *configSnapshot)) *configSnapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := *l.load()
+	fn(&s)
+	s.version++
+	l.v.Store(&s)
+	return &s
+}
+
+type configSnapshotKey struct{}
+
+// get returns the snapshot the request of ctx started with, or the current
+// one outside of requests.
+func (l *liveConfig) get(ctx context.Context) *configSnapshot {
+	if s, ok := ctx.Value(configSnapshotKey{}).(*configSnapshot); ok {
+		return s
+	}
+	return l.load()
+}
+
+// middleware pins the current snapshot for the duration of each request, so
+// a reload in the middle of it doesn't mix the rules of two versions.
+func (l *liveConfig) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), configSnapshotKey{}, l.load())))
+	})
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+var (
+	pullsTotal = newCounterVec("registry_proxy_pulls_total",
+		"Manifest downloads per repository and tag (by-digest pulls are counted under tag \"@digest\", untracked repositories and tags under \"other\").",
+		"repository", "tag")
+	pullBytesTotal = newCounterVec("registry_proxy_pull_bytes_total",
+		"Bytes of manifests and blobs served per repository.",
+		"repository")
+)
+
+const (
+	// maxStatsRepositories and maxStatsTags bound the repositories, and the
+	// tags per repository, that are counted separately. Clients can request
+	// any name, so later ones are counted under otherStatsLabel.
+	maxStatsRepositories = 1000
+	maxStatsTags         = 100
+	otherStatsLabel      = "other"
+)
+
+// pullStats keeps per-repository pull counters for the admin API.
+type pullStats struct {
+	mu    sync.Mutex
+	repos map[string]*repoStats
+}
+
+type repoStats struct {
+	Repository string           `json:"repository"`
+	Pulls      int64            `json:"pulls"`
+	Bytes      int64            `json:"bytes"`
+	Tags       map[string]int64 `json:"tags"`
+}
+
+func newPullStats() *pullStats {
+	return &pullStats{repos: make(map[string]*repoStats)}
+}
+
+func (s *pullStats) record(rr registryRequest, bytes int64, manifestPull bool) {
+	tag := rr.reference
+	if isDigest(tag) {
+		tag = "@digest"
+	}
+
+	s.mu.Lock()
+	st, ok := s.repos[rr.name]
+	if !ok {
+		name := rr.name
+		if len(s.repos) >= maxStatsRepositories {
+			name = otherStatsLabel
+		}
+		if st, ok = s.repos[name]; !ok {
+			st = &repoStats{Repository: name, Tags: make(map[string]int64)}
+			s.repos[name] = st
+		}
+	}
+	if _, ok := st.Tags[tag]; !ok && len(st.Tags) >= maxStatsTags {
+		tag = otherStatsLabel
+	}
+	st.Bytes += bytes
+	if manifestPull {
+		st.Pulls++
+		st.Tags[tag]++
+	}
+	repo := st.Repository
+	s.mu.Unlock()
+
+	pullBytesTotal.add(float64(bytes), repo)
+	if manifestPull {
+		pullsTotal.inc(repo, tag)
+	}
+}
+
+// middleware counts successful manifest and blob downloads.
+func (s *pullStats) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rr, ok := parseRegistryPath(req.URL.Path)
+		if !ok || req.Method != http.MethodGet || (rr.kind != "manifests" && rr.kind != "blobs") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		cw := &countingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, req)
+		if cw.status == http.StatusOK {
+			s.record(rr, cw.bytes, rr.kind == "manifests")
+		}
+	})
+}
+
+// handler lists the counters of all repositories, most pulled first.
+func (s *pullStats) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		out := make([]repoStats, 0, len(s.repos))
+		for _, st := range s.repos {
+			cp := *st
+			cp.Tags = make(map[string]int64, len(st.Tags))
+			for k, v := range st.Tags {
+				cp.Tags[k] = v
+			}
+			out = append(out, cp)
+		}
+		s.mu.Unlock()
+		sort.Slice(out, func(i, j int) bool {
+			if out[i].Pulls != out[j].Pulls {
+				return out[i].Pulls > out[j].Pulls
+			}
+			return out[i].Repository < out[j].Repository
+		})
+		writeJSON(w, http.StatusOK, out)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// version and commit are set at build time with
+// -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version   = "0.1"
+	commit    = "unknown"
+	startTime = time.Now()
+)
+
+type proxyStatus struct {
+	Version       string          `json:"version"`
+	Commit        string          `json:"commit"`
+	GoVersion     string          `json:"go_version"`
+	Config        string          `json:"config_fingerprint"`
+	Upstream      string          `json:"upstream"`
+	RepoPrefix    string          `json:"repo_prefix"`
+	Features      map[string]bool `json:"features"`
+	UptimeSeconds int64           `json:"uptime_seconds"`
+	// SLO has the service level indicators of token, manifest and blob
+	// requests since the proxy started.
+	SLO map[string]sloStatus `json:"slo"`
+}
+
+// statusHandler describes the running proxy as JSON. It must never include
+// credentials or other secrets since it is served without authentication.
+func statusHandler(cfg registryConfig, features map[string]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st := proxyStatus{
+			Version:       version,
+			Commit:        commit,
+			GoVersion:     runtime.Version(),
+			Config:        configFingerprint(),
+			Upstream:      cfg.host,
+			RepoPrefix:    cfg.repoPrefix,
+			Features:      features,
+			UptimeSeconds: int64(time.Since(startTime) / time.Second),
+			SLO:           requestSLIs.status(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(st)
+	}
+}
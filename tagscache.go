@@ -0,0 +1,150 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const maxCachedTagLists = 1000
+
+var tagListCacheRequestsTotal = newCounterVec("registry_proxy_tag_list_cache_requests_total",
+	"Tag list requests answered from the cache (hit) or the upstream (miss, bypass).", "result")
+
+// tagListCache keeps tags/list responses in memory for a few seconds, since
+// tools resolving the latest tag of a repository list its tags over and over.
+// Clients can skip the cache with a "Cache-Control: no-cache" request header.
+type tagListCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]tagListEntry
+}
+
+type tagListEntry struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// getTagListCache returns the cache configured by TAGS_CACHE_TTL, or nil.
+func getTagListCache() *tagListCache {
+	v := os.Getenv("TAGS_CACHE_TTL")
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("invalid TAGS_CACHE_TTL %q", v)
+	}
+	return &tagListCache{ttl: d, entries: make(map[string]tagListEntry)}
+}
+
+// key returns the cache key of a tag list request, or "" if req is not one.
+// It must be called before the client's credentials are replaced, since
+// responses are only shared by requests with the same credentials.
+func (c *tagListCache) key(req *http.Request) string {
+	if c == nil || req.Method != http.MethodGet {
+		return ""
+	}
+	rr, ok := parseRegistryPath(req.URL.Path)
+	if !ok || rr.kind != "tags" {
+		return ""
+	}
+	if req.Header.Get("Cache-Control") == "no-cache" {
+		tagListCacheRequestsTotal.inc("bypass")
+		return ""
+	}
+	cred := req.Header.Get("Authorization")
+	if id := identityFromContext(req.Context()); id != nil {
+		cred = "user:" + id.username
+	}
+	return cred + "\x00" + req.URL.RequestURI()
+}
+
+// serve returns the cached response for key, or nil.
+func (c *tagListCache) serve(req *http.Request, key string) *http.Response {
+	if key == "" {
+		return nil
+	}
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok || time.Now().After(e.expires) {
+		tagListCacheRequestsTotal.inc("miss")
+		return nil
+	}
+	tagListCacheRequestsTotal.inc("hit")
+	h := make(http.Header, len(e.header)+1)
+	for k, v := range e.header {
+		h[k] = v
+	}
+	h.Set("X-Cache", "HIT")
+	return newResponse(req, http.StatusOK, h, ioutil.NopCloser(bytes.NewReader(e.body)), int64(len(e.body)))
+}
+
+// fill stores a successful response under key. Larger than limit responses
+// are passed through without being cached.
+func (c *tagListCache) fill(key string, resp *http.Response, limit int64) *http.Response {
+	if key == "" || resp.StatusCode != http.StatusOK {
+		return resp
+	}
+	if limit <= 0 {
+		limit = defaultMaxManifestSize
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		resp.Body.Close()
+		return registryErrorResponse(resp.Request, http.StatusBadGateway, "UNKNOWN",
+			"failed to read tag list from upstream")
+	}
+	if int64(len(b)) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+		return resp
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	h := make(http.Header, len(resp.Header))
+	for k, v := range resp.Header {
+		h[k] = v
+	}
+	h.Del("Content-Length")
+	now := time.Now()
+	c.mu.Lock()
+	if len(c.entries) >= maxCachedTagLists {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) < maxCachedTagLists {
+		c.entries[key] = tagListEntry{header: h, body: b, expires: now.Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	return resp
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+var (
+	upstreamPullPhaseSecondsTotal = newCounterVec("registry_proxy_upstream_pull_phase_seconds_total",
+		"Time spent in the phases (dns, connect, tls, token, ttfb, transfer) of manifest and blob pulls from the upstream.", "kind", "phase")
+	upstreamPullsTimedTotal = newCounterVec("registry_proxy_upstream_pulls_timed_total",
+		"Manifest and blob pulls from the upstream whose phases are recorded.", "kind")
+	upstreamPullBytesTotal = newCounterVec("registry_proxy_upstream_pull_bytes_total",
+		"Bytes of manifests and blobs pulled from the upstream.", "kind")
+)
+
+type pullTimingKey struct{}
+
+var ctxKeyPullTiming = pullTimingKey{}
+
+// pullTiming records how long the phases of a pull from the upstream took,
+// so slow pulls can be told apart: time to first byte is spent by the
+// registry, while DNS, connecting and the transfer depend on the network.
+// Phases repeated when a request is retried with a token add up.
+type pullTiming struct {
+	kind  string
+	url   string
+	start time.Time
+
+	// mu guards the fields below, trace hooks may run concurrently.
+	mu                                             sync.Mutex
+	dnsStart, connectStart, tlsStart, wroteRequest time.Time
+	dns, connect, tls, token, ttfb                 time.Duration
+	reused                                         bool
+}
+
+// startPullTiming returns req with a trace recording the phases of the
+// upstream request, or req unchanged if it isn't a manifest or blob pull.
+// HEAD requests are left out, they are counted in
+// registry_proxy_upstream_requests_total.
+func startPullTiming(req *http.Request) (*http.Request, *pullTiming) {
+	if req.Method != http.MethodGet {
+		return req, nil
+	}
+	rr, ok := parseRegistryPath(req.URL.Path)
+	if !ok || (rr.kind != "manifests" && rr.kind != "blobs") {
+		return req, nil
+	}
+	t := &pullTiming{kind: rr.kind, url: req.URL.String(), start: time.Now()}
+	ctx := context.WithValue(req.Context(), ctxKeyPullTiming, t)
+	return req.WithContext(httptrace.WithClientTrace(ctx, t.trace())), t
+}
+
+// pullTimingFromContext returns the timing of the pull a request belongs to,
+// or nil.
+func pullTimingFromContext(ctx context.Context) *pullTiming {
+	t, _ := ctx.Value(ctxKeyPullTiming).(*pullTiming)
+	return t
+}
+
+func (t *pullTiming) trace() *httptrace.ClientTrace {
+	since := func(start time.Time) time.Duration {
+		if start.IsZero() {
+			return 0
+		}
+		return time.Since(start)
+	}
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			t.dns += since(t.dnsStart)
+			t.mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			t.connectStart = time.Now()
+			t.mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			t.connect += since(t.connectStart)
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			t.tls += since(t.tlsStart)
+			t.mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			t.wroteRequest = time.Now()
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.ttfb += since(t.wroteRequest)
+			t.mu.Unlock()
+		},
+	}
+}
+
+// addToken records time spent obtaining a token from the upstream.
+func (t *pullTiming) addToken(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.token += d
+	t.mu.Unlock()
+}
+
+// finish wraps the body of resp to record the transfer once it is read or
+// closed, and then logs and exports the phases.
+func (t *pullTiming) finish(resp *http.Response) *http.Response {
+	if t == nil {
+		return resp
+	}
+	resp.Body = &timedBody{ReadCloser: resp.Body, timing: t, status: resp.StatusCode, headers: time.Now()}
+	return resp
+}
+
+// timedBody is the body of a timed pull.
+type timedBody struct {
+	io.ReadCloser
+	timing  *pullTiming
+	status  int
+	headers time.Time
+
+	read int64
+	once sync.Once
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err == io.EOF {
+		b.once.Do(b.record)
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.once.Do(b.record)
+	return b.ReadCloser.Close()
+}
+
+func (b *timedBody) record() {
+	t := b.timing
+	transfer := time.Since(b.headers)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	upstreamPullsTimedTotal.inc(t.kind)
+	upstreamPullBytesTotal.add(float64(b.read), t.kind)
+	for phase, d := range map[string]time.Duration{
+		"dns": t.dns, "connect": t.connect, "tls": t.tls, "token": t.token, "ttfb": t.ttfb, "transfer": transfer,
+	} {
+		upstreamPullPhaseSecondsTotal.add(d.Seconds(), t.kind, phase)
+	}
+	ms := func(d time.Duration) int64 { return int64(d / time.Millisecond) }
+	log.Printf("pull timing: status=%d total_ms=%d dns_ms=%d connect_ms=%d tls_ms=%d token_ms=%d ttfb_ms=%d transfer_ms=%d bytes=%d reused_conn=%t url=%s",
+		b.status, ms(time.Since(t.start)), ms(t.dns), ms(t.connect), ms(t.tls), ms(t.token), ms(t.ttfb), ms(transfer), b.read, t.reused, t.url)
+}
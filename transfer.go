@@ -0,0 +1,170 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	transfersAbortedTotal = newCounterVec("registry_proxy_transfers_aborted_total",
+		"Manifest and blob downloads abandoned by the client before they completed.", "kind")
+	abortedTransferBytesTotal = newCounterVec("registry_proxy_aborted_transfer_bytes_total",
+		"Bytes sent to clients in downloads they abandoned.", "kind")
+)
+
+// watchTransfer ties the body of a successful manifest or blob download to
+// the context of the client request, so reading from the upstream (or the
+// cache) stops as soon as the client goes away even if the body is wrapped
+// in readers that don't watch the context, and counts abandoned downloads.
+func watchTransfer(resp *http.Response) *http.Response {
+	if resp.StatusCode != http.StatusOK || resp.Request.Method != http.MethodGet {
+		return resp
+	}
+	rr, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok || (rr.kind != "manifests" && rr.kind != "blobs") {
+		return resp
+	}
+	resp.Body = &watchedBody{
+		ReadCloser: resp.Body,
+		ctx:        resp.Request.Context(),
+		kind:       rr.kind,
+		url:        resp.Request.URL.String(),
+		size:       resp.ContentLength,
+	}
+	return resp
+}
+
+type watchedBody struct {
+	io.ReadCloser
+	ctx  context.Context
+	kind string
+	url  string
+	size int64
+
+	read int64
+	done bool
+	// closed is set atomically, Close may race with a blocked Read.
+	closed int32
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err == io.EOF {
+		b.done = true
+	}
+	return n, err
+}
+
+func (b *watchedBody) Close() error {
+	if !atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		return nil
+	}
+	if !b.done && b.ctx.Err() != nil {
+		transfersAbortedTotal.inc(b.kind)
+		abortedTransferBytesTotal.add(float64(b.read), b.kind)
+		log.Printf("client went away, aborted download after %d of %d bytes: url=%s", b.read, b.size, b.url)
+	}
+	return b.ReadCloser.Close()
+}
+
+// maxBlobRedirects is the number of redirects followed for a blob download.
+const maxBlobRedirects = 5
+
+// isRedirect reports whether status redirects the client elsewhere.
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// followBlobRedirect downloads a blob that the upstream redirected to its
+// storage, like gcr.io, Artifact Registry and Docker Hub do, so the content
+// flows through the proxy to be verified and cached. Storage URLs are
+// signed, so credentials are only sent along to the upstream host itself.
+// The returned response keeps the original request, so it is still
+// recognized as a blob download. The redirect is passed on to the client if
+// the storage can't be reached.
+func followBlobRedirect(resp *http.Response, transport http.RoundTripper) *http.Response {
+	req := resp.Request
+	if req.Method != http.MethodGet || !isRedirect(resp.StatusCode) || !blobPath.MatchString(req.URL.Path) {
+		return resp
+	}
+	target, err := fetchRedirect(req, resp, transport)
+	if err != nil {
+		log.Printf("could not follow blob redirect, passing it to the client: url=%s: %+v", req.URL, err)
+		return resp
+	}
+	resp.Body.Close()
+	target.Request = req
+	return target
+}
+
+// fetchRedirect sends req to the Location of resp, and on to further
+// redirects, and returns the final response if it is successful.
+func fetchRedirect(req *http.Request, resp *http.Response, transport http.RoundTripper) (*http.Response, error) {
+	u := req.URL
+	for i := 0; i < maxBlobRedirects; i++ {
+		loc, err := u.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect location: %+v", err)
+		}
+		next, err := http.NewRequest(req.Method, loc.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		next = next.WithContext(req.Context())
+		for _, h := range []string{"Range", "If-Range", "User-Agent"} {
+			if v := req.Header.Get(h); v != "" {
+				next.Header.Set(h, v)
+			}
+		}
+		if canonicalHost(loc.Host) == canonicalHost(req.URL.Host) {
+			next.Header.Set("Authorization", req.Header.Get("Authorization"))
+		}
+		if i > 0 {
+			resp.Body.Close()
+		}
+		resp, err = transport.RoundTrip(next)
+		if err != nil {
+			return nil, err
+		}
+		u = loc
+		switch {
+		case isRedirect(resp.StatusCode):
+			continue
+		case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent:
+			return resp, nil
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("storage answered with status %d", resp.StatusCode)
+		}
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("more than %d redirects", maxBlobRedirects)
+}
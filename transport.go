@@ -0,0 +1,79 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// getUpstreamTransport returns the transport for all requests to the
+// upstream registry and its token service. Requests go through the forward
+// proxy in UPSTREAM_PROXY_URL (http, https or socks5, with optional
+// user:password) if set, and otherwise through the proxy configured with the
+// standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+// Certificates of the upstream are also accepted if signed by the CAs in
+// UPSTREAM_CA_FILE, for registries with a private CA. Connections are opened
+// by getUpstreamDialer.
+func getUpstreamTransport() *http.Transport {
+	proxy := http.ProxyFromEnvironment
+	if v := os.Getenv("UPSTREAM_PROXY_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil {
+			log.Fatalf("invalid UPSTREAM_PROXY_URL: %+v", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			log.Fatalf("UPSTREAM_PROXY_URL scheme must be http, https or socks5, got %q", u.Scheme)
+		}
+		log.Printf("sending upstream requests through proxy %s://%s", u.Scheme, u.Host)
+		proxy = http.ProxyURL(u)
+	}
+	dialer := getUpstreamDialer()
+	if desc := dialer.describe(); desc != "" {
+		log.Printf("connecting to the upstream %s", desc)
+	}
+	t := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if path := os.Getenv("UPSTREAM_CA_FILE"); path != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("could not read UPSTREAM_CA_FILE from %s: %+v", path, err)
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			log.Fatalf("no PEM certificates found in UPSTREAM_CA_FILE %s", path)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return t
+}
@@ -0,0 +1,390 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	upstreamTimeout     = 30 * time.Second
+	defaultTokenExpiry  = 60 * time.Second
+	maxCachedTokens     = 1000
+	manifestAcceptTypes = "application/vnd.oci.image.index.v1+json, " +
+		"application/vnd.docker.distribution.manifest.list.v2+json, " +
+		"application/vnd.oci.image.manifest.v1+json, " +
+		"application/vnd.docker.distribution.manifest.v2+json, " +
+		"application/vnd.oci.artifact.manifest.v1+json"
+)
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// upstreamClient makes registry API requests of its own to the upstream
+// registry with the proxy's credentials, for features that need to look at
+// the registry rather than relay a client's request. It completes the bearer
+// token exchange when the registry asks for one.
+type upstreamClient struct {
+	cfg    registryConfig
+	auth   authenticator
+	client *http.Client
+	tokens *upstreamTokens
+}
+
+func newUpstreamClient(cfg registryConfig, auth authenticator) *upstreamClient {
+	client := &http.Client{Transport: cfg.transport, Timeout: upstreamTimeout}
+	return &upstreamClient{
+		cfg:    cfg,
+		auth:   auth,
+		client: client,
+		tokens: newUpstreamTokens(client, cfg),
+	}
+}
+
+// manifestInfo is the result of looking up a manifest in the upstream.
+type manifestInfo struct {
+	Exists    bool   `json:"exists"`
+	Digest    string `json:"digest,omitempty"`
+	MediaType string `json:"mediaType,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+}
+
+// headManifest looks up the manifest of the client-visible repository name
+// by tag or digest.
+func (u *upstreamClient) headManifest(name, reference string) (manifestInfo, error) {
+	resp, err := u.get(http.MethodHead, name, "manifests", reference, manifestAcceptTypes)
+	if err != nil {
+		return manifestInfo{}, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return manifestInfo{
+			Exists:    true,
+			Digest:    resp.Header.Get("Docker-Content-Digest"),
+			MediaType: resp.Header.Get("Content-Type"),
+			Size:      resp.ContentLength,
+		}, nil
+	case http.StatusNotFound:
+		return manifestInfo{}, nil
+	default:
+		return manifestInfo{}, fmt.Errorf("upstream returned status %d for manifest %s:%s", resp.StatusCode, name, reference)
+	}
+}
+
+// getManifest downloads the manifest of the client-visible repository name
+// by tag or digest. The body is nil if the manifest doesn't exist.
+func (u *upstreamClient) getManifest(name, reference string) (manifestInfo, []byte, error) {
+	resp, err := u.get(http.MethodGet, name, "manifests", reference, manifestAcceptTypes)
+	if err != nil {
+		return manifestInfo{}, nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return manifestInfo{}, nil, nil
+	default:
+		return manifestInfo{}, nil, fmt.Errorf("upstream returned status %d for manifest %s:%s", resp.StatusCode, name, reference)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, u.cfg.maxManifestSize+1))
+	if err != nil {
+		return manifestInfo{}, nil, fmt.Errorf("failed to read manifest %s:%s: %+v", name, reference, err)
+	}
+	if int64(len(b)) > u.cfg.maxManifestSize {
+		return manifestInfo{}, nil, fmt.Errorf("manifest %s:%s is larger than %d bytes", name, reference, u.cfg.maxManifestSize)
+	}
+	info := manifestInfo{
+		Exists:    true,
+		Digest:    resp.Header.Get("Docker-Content-Digest"),
+		MediaType: resp.Header.Get("Content-Type"),
+		Size:      int64(len(b)),
+	}
+	if info.Digest == "" {
+		info.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+	}
+	return info, b, nil
+}
+
+// listTags returns all tags of the client-visible repository name, following
+// the pagination links of the upstream.
+func (u *upstreamClient) listTags(name string) ([]string, error) {
+	upstreamName, ok := u.cfg.upstreamName(name)
+	if !ok {
+		return nil, fmt.Errorf("repository %s is not served by this proxy", name)
+	}
+	target := fmt.Sprintf("https://%s/v2/%s/tags/list", u.cfg.host, upstreamName)
+	scope := fmt.Sprintf("repository:%s:pull", upstreamName)
+	var tags []string
+	for target != "" {
+		resp, err := u.do(http.MethodGet, target, "application/json", scope)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(resp.Body, defaultMaxManifestSize))
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tags of %s: %+v", name, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("upstream returned status %d for tags of %s", resp.StatusCode, name)
+		}
+		var tl struct {
+			Tags []string `json:"tags"`
+		}
+		if err := json.Unmarshal(b, &tl); err != nil {
+			return nil, fmt.Errorf("invalid tag list of %s: %+v", name, err)
+		}
+		tags = append(tags, tl.Tags...)
+		target = nextLink(resp)
+	}
+	return tags, nil
+}
+
+// nextLink returns the absolute URL of the rel="next" Link of resp, or "".
+func nextLink(resp *http.Response) string {
+	for _, l := range resp.Header["Link"] {
+		if !strings.Contains(l, `rel="next"`) {
+			continue
+		}
+		i, j := strings.Index(l, "<"), strings.Index(l, ">")
+		if i < 0 || j < i {
+			return ""
+		}
+		next, err := resp.Request.URL.Parse(l[i+1 : j])
+		if err != nil {
+			return ""
+		}
+		return next.String()
+	}
+	return ""
+}
+
+// get sends a request for /v2/<upstream name>/<kind>/<reference>.
+func (u *upstreamClient) get(method, name, kind, reference, accept string) (*http.Response, error) {
+	upstreamName, ok := u.cfg.upstreamName(name)
+	if !ok {
+		return nil, fmt.Errorf("repository %s is not served by this proxy", name)
+	}
+	target := fmt.Sprintf("https://%s/v2/%s/%s/%s", u.cfg.host, upstreamName, kind, reference)
+	scope := fmt.Sprintf("repository:%s:pull", upstreamName)
+	return u.do(method, target, accept, scope)
+}
+
+func (u *upstreamClient) do(method, target, accept, scope string) (*http.Response, error) {
+	send := func(authz string) (*http.Response, error) {
+		req, err := http.NewRequest(method, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if authz != "" {
+			req.Header.Set("Authorization", authz)
+		}
+		req.Header.Set("User-Agent", "gcr-proxy/"+version)
+		return u.client.Do(req)
+	}
+
+	var cred string
+	if u.auth != nil {
+		cred = u.auth.AuthHeader()
+	}
+	authz := u.tokens.cached(cred, scope)
+	if authz == "" {
+		authz = cred
+	}
+	resp, err := send(authz)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %+v", target, err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("Www-Authenticate")
+	resp.Body.Close()
+	authz, err = u.tokens.exchange(challenge, scope, cred)
+	if err != nil {
+		return nil, fmt.Errorf("upstream denied access to %s: %+v", target, err)
+	}
+	resp, err = send(authz)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %+v", target, err)
+	}
+	return resp, nil
+}
+
+// upstreamTokens obtains bearer tokens from the upstream registry's token
+// service and caches them per credential and scope until they expire.
+type upstreamTokens struct {
+	client  *http.Client
+	maxSize int64
+	// realmHosts are the hosts credentials may be sent to.
+	realmHosts realmAllowlist
+
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+	// flights makes concurrent requests for the same token wait for one
+	// exchange with the token service.
+	flights flightGroup
+}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+// newUpstreamTokens returns the token exchange for the upstream in cfg, which
+// only accepts the token services of getTokenRealmHosts.
+func newUpstreamTokens(client *http.Client, cfg registryConfig) *upstreamTokens {
+	maxSize := cfg.maxTokenSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxTokenResponseSize
+	}
+	return &upstreamTokens{client: client, maxSize: maxSize, realmHosts: getTokenRealmHosts(cfg), tokens: make(map[string]cachedToken)}
+}
+
+// cached returns the Authorization header value of a still valid token
+// obtained earlier for cred and scope, or "" if there is none.
+func (t *upstreamTokens) cached(cred, scope string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tok, ok := t.tokens[cred+"\x00"+scope]; ok && time.Now().Before(tok.expires) {
+		return "Bearer " + tok.token
+	}
+	return ""
+}
+
+// exchange answers a Bearer WWW-Authenticate challenge: it requests a token
+// for scope (or the scope in the challenge if empty) from the realm,
+// presenting cred if it is basic auth, and returns the Authorization header
+// value to retry the request with.
+func (t *upstreamTokens) exchange(challenge, scope, cred string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") || params["realm"] == "" {
+		return "", fmt.Errorf("unsupported challenge www-authenticate: %q", challenge)
+	}
+	if scope == "" {
+		scope = params["scope"]
+	}
+	if authz := t.cached(cred, scope); authz != "" {
+		return authz, nil
+	}
+	v, err, shared := t.flights.do(cred+"\x00"+scope, func() (interface{}, error) {
+		return t.fetch(params, scope, cred)
+	})
+	if shared {
+		tokenRequestsCoalescedTotal.inc()
+	}
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// fetch requests a token for scope from the token service described by the
+// challenge params and caches it. Realms off the allowed hosts are refused,
+// so a challenge can't make the proxy send cred anywhere else.
+func (t *upstreamTokens) fetch(params map[string]string, scope, cred string) (string, error) {
+	realm := params["realm"]
+	if err := t.realmHosts.check(realm); err != nil {
+		return "", err
+	}
+	tu, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm %q: %+v", realm, err)
+	}
+	q := tu.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	}
+	tu.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tu.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(cred, "Basic ") {
+		req.Header.Set("Authorization", cred)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request to %s failed: %+v", realm, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, t.maxSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read token response from %s: %+v", realm, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token service %s returned status %d: %s", realm, resp.StatusCode, b)
+	}
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(b, &tr); err != nil {
+		return "", fmt.Errorf("failed to parse token response from %s: %+v", realm, err)
+	}
+	if tr.Token == "" {
+		tr.Token = tr.AccessToken
+	}
+	expiry := defaultTokenExpiry
+	if tr.ExpiresIn > 0 {
+		expiry = time.Duration(tr.ExpiresIn) * time.Second
+	}
+	t.mu.Lock()
+	if len(t.tokens) >= maxCachedTokens {
+		now := time.Now()
+		for k, v := range t.tokens {
+			if now.After(v.expires) {
+				delete(t.tokens, k)
+			}
+		}
+	}
+	t.tokens[cred+"\x00"+scope] = cachedToken{token: tr.Token, expires: time.Now().Add(expiry - expiry/10)}
+	t.mu.Unlock()
+	return "Bearer " + tr.Token, nil
+}
+
+// parseChallenge splits a WWW-Authenticate header value into its scheme and
+// parameters.
+func parseChallenge(v string) (string, map[string]string) {
+	params := make(map[string]string)
+	v = strings.TrimSpace(v)
+	i := strings.IndexByte(v, ' ')
+	if i < 0 {
+		return v, params
+	}
+	for _, m := range challengeParam.FindAllStringSubmatch(v[i+1:], -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	return v[:i], params
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+)
+
+type validateRequest struct {
+	Image string `json:"image"`
+}
+
+type validateResponse struct {
+	Image string `json:"image"`
+	manifestInfo
+	Error string `json:"error,omitempty"`
+}
+
+// validateHandler reports whether the image reference in the request body
+// exists in the upstream registry and which digest it resolves to, so that
+// admission controllers can check and pin images without registry
+// credentials of their own. Images are only looked up if the repository
+// rules and access allow the client to pull them.
+func validateHandler(up *upstreamClient, access imageAccess) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "use POST to validate images")
+			return
+		}
+		var in validateRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&in); err != nil || in.Image == "" {
+			writeRegistryError(w, http.StatusBadRequest, "UNSUPPORTED", `request body must be a JSON object like {"image": "name:tag"}`)
+			return
+		}
+		out := validateResponse{Image: in.Image}
+		name, reference, err := parseReference(in.Image, r.Host)
+		if err != nil {
+			out.Error = err.Error()
+			writeJSON(w, http.StatusBadRequest, out)
+			return
+		}
+		if d := up.cfg.denial(name); d != nil {
+			d.writeTo(w, r, name)
+			return
+		}
+		if !access.allowPull(w, r, name, reference) {
+			return
+		}
+		out.manifestInfo, err = up.headManifest(name, reference)
+		if err != nil {
+			log.Printf("validate: lookup of %s failed: %+v", in.Image, err)
+			out.Error = err.Error()
+			writeJSON(w, http.StatusBadGateway, out)
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
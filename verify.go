@@ -0,0 +1,132 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+var blobPath = regexp.MustCompile(`^/v2/(.+)/blobs/((sha256|sha512):([a-f0-9]+))$`)
+
+var blobDigestMismatchesTotal = newCounterVec("registry_proxy_blob_digest_mismatches_total",
+	"Blob downloads aborted because their content did not match the requested digest.")
+
+// verifyBlobDigest wraps the body of a successful blob download so that the
+// content is hashed while it streams to the client. Blobs the upstream
+// redirects to its storage are only verified if the proxy follows the
+// redirect, see followBlobRedirect. If the content does not
+// match the digest in the request path, the body fails instead of ending
+// cleanly, which makes the reverse proxy abort the client connection.
+func verifyBlobDigest(resp *http.Response) *http.Response {
+	req := resp.Request
+	if req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return resp
+	}
+	m := blobPath.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		return resp
+	}
+	var h hash.Hash
+	switch m[3] {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	}
+	resp.Body = &digestVerifier{
+		r:      resp.Body,
+		h:      h,
+		digest: m[2],
+		want:   m[4],
+		url:    req.URL.String(),
+	}
+	return resp
+}
+
+// digestVerifier holds back the most recently read chunk of the body until
+// the next read succeeds, so the final bytes of a corrupt blob are never
+// delivered to the client.
+type digestVerifier struct {
+	r      io.ReadCloser
+	h      hash.Hash
+	digest string
+	want   string
+	url    string
+
+	held []byte
+	buf  []byte
+	err  error
+}
+
+func (d *digestVerifier) Read(p []byte) (int, error) {
+	if d.err != nil && len(d.held) == 0 {
+		return 0, d.err
+	}
+	for d.err == nil {
+		if cap(d.buf) < len(p) {
+			d.buf = make([]byte, len(p))
+		}
+		n, err := d.r.Read(d.buf[:len(p)])
+		d.h.Write(d.buf[:n])
+		if err == io.EOF {
+			d.err = d.verify()
+		} else if err != nil {
+			d.err = err
+		}
+		if n == 0 {
+			continue
+		}
+		out := copy(p, d.held)
+		if out < len(d.held) {
+			// p is smaller than the held chunk, keep the rest for later.
+			d.held = append(d.held[out:], d.buf[:n]...)
+			return out, nil
+		}
+		d.held = append(d.held[:0], d.buf[:n]...)
+		if out > 0 {
+			return out, nil
+		}
+	}
+	if d.err != io.EOF {
+		d.held = nil
+		return 0, d.err
+	}
+	n := copy(p, d.held)
+	d.held = d.held[n:]
+	if len(d.held) > 0 {
+		return n, nil
+	}
+	return n, io.EOF
+}
+
+func (d *digestVerifier) verify() error {
+	if got := hex.EncodeToString(d.h.Sum(nil)); got != d.want {
+		log.Printf("blob digest mismatch, aborting response: url=%s expected=%s got=%s", d.url, d.digest, got)
+		blobDigestMismatchesTotal.inc()
+		return fmt.Errorf("blob content does not match digest %s", d.digest)
+	}
+	return io.EOF
+}
+
+func (d *digestVerifier) Close() error { return d.r.Close() }
@@ -0,0 +1,172 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var virtualRequestsTotal = newCounterVec("registry_proxy_virtual_requests_total",
+	"Pull requests tried on the upstreams of a virtual registry by result (hit, miss or skipped).", "upstream", "result")
+
+// fallbackUpstream is a registry tried for pulls that REGISTRY_HOST doesn't
+// have, in the configuration file.
+type fallbackUpstream struct {
+	// Host is the registry host, with an optional port.
+	Host string `json:"host"`
+	// RepoPrefix is put before the repository names on this upstream, like
+	// REPO_PREFIX.
+	RepoPrefix string `json:"repo_prefix"`
+	// AuthHeader is the Authorization header value for this upstream, like
+	// AUTH_HEADER. Requests are anonymous if empty.
+	AuthHeader string `json:"auth_header"`
+}
+
+// virtualConfig makes the proxy a virtual registry serving pulls from an
+// ordered list of upstreams.
+type virtualConfig struct {
+	Upstreams []fallbackUpstream `json:"upstreams"`
+	// NegativeCacheTTL is how long an upstream that didn't have a manifest,
+	// blob or tag list is not asked for it again, like "5m". Defaults to 1m.
+	NegativeCacheTTL string `json:"negative_cache_ttl"`
+}
+
+// virtualRegistry tries pulls that REGISTRY_HOST answers with 404 on a list
+// of fallback upstreams in order, and serves the first hit. It remembers
+// misses for a while, so known misses go to the next upstream directly.
+type virtualRegistry struct {
+	primary   registryConfig
+	upstreams []*upstreamClient
+	misses    *negativeCache
+}
+
+// getVirtualRegistry returns the virtual registry of the config file, or nil
+// if no fallback upstreams are configured. Fallback upstreams use the
+// transport and size limits of primary.
+func getVirtualRegistry(vc virtualConfig, primary registryConfig) *virtualRegistry {
+	if len(vc.Upstreams) == 0 {
+		return nil
+	}
+	ttl := time.Minute
+	if vc.NegativeCacheTTL != "" {
+		d, err := time.ParseDuration(vc.NegativeCacheTTL)
+		if err != nil || d < 0 {
+			log.Fatalf("invalid virtual.negative_cache_ttl %q", vc.NegativeCacheTTL)
+		}
+		ttl = d
+	}
+	v := &virtualRegistry{primary: primary, misses: newNegativeCache(ttl)}
+	hosts := []string{primary.host}
+	for i, u := range vc.Upstreams {
+		if u.Host == "" {
+			log.Fatalf("virtual upstream %d has no host", i+1)
+		}
+		cfg := registryConfig{
+			host:            canonicalHost(u.Host),
+			repoPrefix:      strings.Trim(u.RepoPrefix, "/"),
+			transport:       primary.transport,
+			maxManifestSize: primary.maxManifestSize,
+			maxTokenSize:    primary.maxTokenSize,
+		}
+		var auth authenticator
+		if u.AuthHeader != "" {
+			auth = authHeader(u.AuthHeader)
+		}
+		// Blobs may take longer to download than the timeout of the
+		// upstream client.
+		client := &http.Client{Transport: cfg.transport}
+		v.upstreams = append(v.upstreams, &upstreamClient{
+			cfg:    cfg,
+			auth:   auth,
+			client: client,
+			tokens: newUpstreamTokens(client, cfg),
+		})
+		hosts = append(hosts, cfg.host)
+	}
+	log.Printf("serving pulls as a virtual registry of %s", strings.Join(hosts, ", "))
+	return v
+}
+
+// pull reports whether req is a pull that may be served by another upstream.
+func (v *virtualRegistry) pull(req *http.Request) bool {
+	if v == nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return false
+	}
+	rr, ok := parseRegistryPath(req.URL.Path)
+	return ok && rr.kind != "referrers"
+}
+
+func (v *virtualRegistry) missKey(host string, req *http.Request) string {
+	return host + req.URL.RequestURI()
+}
+
+// knownMissing reports whether upstream host answered req with 404 recently.
+func (v *virtualRegistry) knownMissing(host string, req *http.Request) bool {
+	return v.misses.has(v.missKey(host, req))
+}
+
+// remember records that upstream host answered req with 404.
+func (v *virtualRegistry) remember(host string, req *http.Request) {
+	v.misses.add(v.missKey(host, req))
+}
+
+// serve tries req, which the primary upstream doesn't have, on the fallback
+// upstreams and returns the first successful response, or nil if none has
+// it. req addresses the primary upstream's repository name.
+func (v *virtualRegistry) serve(req *http.Request) *http.Response {
+	rr, _ := parseRegistryPath(req.URL.Path)
+	name, ok := v.primary.clientName(rr.name)
+	if !ok {
+		return nil
+	}
+	accept := strings.Join(req.Header["Accept"], ", ")
+	for _, u := range v.upstreams {
+		if v.knownMissing(u.cfg.host, req) {
+			virtualRequestsTotal.inc(u.cfg.host, "skipped")
+			continue
+		}
+		upstreamName, _ := u.cfg.upstreamName(name)
+		target := fmt.Sprintf("https://%s/v2/%s/%s/%s", u.cfg.host, upstreamName, rr.kind, rr.reference)
+		if req.URL.RawQuery != "" {
+			target += "?" + req.URL.RawQuery
+		}
+		resp, err := u.do(req.Method, target, accept, fmt.Sprintf("repository:%s:pull", upstreamName))
+		if err != nil {
+			log.Printf("virtual registry: request to %s failed: %+v", u.cfg.host, err)
+			virtualRequestsTotal.inc(u.cfg.host, "miss")
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusNotFound {
+				v.remember(u.cfg.host, req)
+			}
+			virtualRequestsTotal.inc(u.cfg.host, "miss")
+			continue
+		}
+		virtualRequestsTotal.inc(u.cfg.host, "hit")
+		log.Printf("virtual registry: serving %s from %s", req.URL.Path, u.cfg.host)
+		rewriteLinks(resp, u.cfg)
+		resp.Request = req
+		resp.Header.Set("X-Registry-Upstream", u.cfg.host)
+		return resp
+	}
+	return nil
+}
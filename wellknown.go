@@ -0,0 +1,80 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+)
+
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+// wellKnownConfig holds the content served for the static files that crawlers
+// and scanners ask for, so these requests are answered by the proxy instead of
+// being redirected to the backend registry.
+type wellKnownConfig struct {
+	robotsTxt   string
+	securityTxt string
+	favicon     []byte
+}
+
+func getWellKnownConfig() wellKnownConfig {
+	cfg := wellKnownConfig{
+		robotsTxt:   defaultRobotsTxt,
+		securityTxt: os.Getenv("SECURITY_TXT"),
+	}
+	if v := os.Getenv("ROBOTS_TXT"); v != "" {
+		cfg.robotsTxt = v
+	}
+	if path := os.Getenv("FAVICON_FILE"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("could not read favicon file from %s: %+v", path, err)
+		}
+		cfg.favicon = b
+	}
+	return cfg
+}
+
+// registerWellKnownHandlers adds handlers for /robots.txt, /favicon.ico and
+// /.well-known/security.txt to the mux.
+func registerWellKnownHandlers(mux *http.ServeMux, cfg wellKnownConfig) {
+	mux.Handle("/robots.txt", textHandler(cfg.robotsTxt))
+	mux.Handle("/.well-known/security.txt", textHandler(cfg.securityTxt))
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		if len(cfg.favicon) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/x-icon")
+		w.Write(cfg.favicon)
+	})
+}
+
+// textHandler serves body as plain text, or 404 if body is empty.
+func textHandler(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if body == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, body)
+	}
+}